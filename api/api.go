@@ -8,15 +8,47 @@ const (
 	CollectionGarages  = "garages"
 	ObjectGarage       = "{garage-id:" + patternID + "}"
 	CollectionSections = "sections"
+	CollectionSessions = "sessions"
+	CollectionWebhooks = "webhooks"
+	ObjectWebhook      = "{webhook-id:" + patternID + "}"
 	ObjectSection      = "{section-name:" + patternSectionName + "}"
 	Control            = "control"
+	Audit              = "audit"
+	Restore            = "restore"
+	Export             = "export"
+	Import             = "import"
+	Quote              = "quote"
+	Devices            = "devices"
+	ObjectDevice       = "{device-id:" + patternDeviceID + "}"
+	Offline            = "offline"
+	Config             = "config"
+	Registration       = "registration"
+	Tokens             = "tokens"
+	ObjectToken        = "{token-id:" + patternID + "}"
 
 	Actions          = "actions"
 	ActionUpdate     = "update"
 	ActionDisconnect = "disconnect"
+	ActionShutdown   = "shutdown"
+	ActionAudit      = "audit"
+
+	QueryForce     = "force"
+	QueryHard      = "hard"
+	QueryDeleted   = "deleted"
+	QueryFormat    = "format"
+	QueryDryRun    = "dry_run"
+	QueryOpen      = "open"
+	QuerySpotType  = "type"
+	QueryMinFree   = "min_free"
+	QueryArrival   = "arrival"
+	QueryDeparture = "departure"
+
+	FormatJSON = "json"
+	FormatCSV  = "csv"
 
 	patternID          = `[0-9a-f]{8}`
 	patternSectionName = `[0-9a-zA-Z]+`
+	patternDeviceID    = `[0-9a-zA-Z._-]+`
 )
 
 // Path returns an API path constructed from given elements
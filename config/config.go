@@ -8,9 +8,44 @@ import (
 
 // DBConfig is a database configuration object
 type DBConfig struct {
-	ConnString string `json:"conn_string"`
-	Database   string `json:"database"`
-	Collection string `json:"collection"`
+	ConnString      string `json:"conn_string"`
+	Database        string `json:"database"`
+	Collection      string `json:"collection"`
+	AuditCollection string `json:"audit_collection"`
+
+	// SessionsCollection stores completed parking sessions
+	SessionsCollection string `json:"sessions_collection"`
+
+	// WebhooksCollection stores webhook subscriptions, and
+	// WebhookQueueCollection the deliveries to them not made yet
+	WebhooksCollection     string `json:"webhooks_collection"`
+	WebhookQueueCollection string `json:"webhook_queue_collection"`
+
+	// DevicesCollection stores the configurations of the devices
+	DevicesCollection string `json:"devices_collection"`
+
+	// ProvisioningCollection stores the tokens devices register with, and
+	// RegistrationsCollection the devices registered with them
+	ProvisioningCollection  string `json:"provisioning_collection"`
+	RegistrationsCollection string `json:"registrations_collection"`
+}
+
+// AlertSink is a destination of device alerts, of type "log", or "webhook"
+// with a URL and an optional secret to sign the alerts with
+type AlertSink struct {
+	Type   string `json:"type"`
+	URL    string `json:"url,omitempty"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// AlertsConfig is a device alerting configuration object
+type AlertsConfig struct {
+	Sinks []AlertSink `json:"sinks"`
+
+	// A device is flapping once its updates time out FlappingDrops times
+	// within FlappingWindowMinutes
+	FlappingDrops         int `json:"flapping_drops"`
+	FlappingWindowMinutes int `json:"flapping_window_minutes"`
 }
 
 // Config is a configuration object
@@ -20,6 +55,16 @@ type Config struct {
 	DevAddr   string   `json:"dev_addr"`
 	DevPort   int      `json:"dev_port"`
 	DBConfig  DBConfig `json:"db_config"`
+
+	Alerts AlertsConfig `json:"alerts"`
+
+	// SectionAliasGraceDays is the number of days a former section name
+	// keeps resolving to the renamed section
+	SectionAliasGraceDays int `json:"section_alias_grace_days"`
+
+	// DeletedRetentionDays is the number of days soft-deleted garages and
+	// sections are kept before they are purged
+	DeletedRetentionDays int `json:"deleted_retention_days"`
 }
 
 // ReadConfig reads a configuration file
@@ -2,8 +2,10 @@ package db
 
 import (
 	"context"
+	"strings"
 	"time"
 
+	"github.com/cicovic-andrija/spot/config"
 	"github.com/cicovic-andrija/spot/resources"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -13,15 +15,22 @@ import (
 
 // Client represents a database client object
 type Client struct {
-	client     *mongo.Client
-	database   string
-	collection string
+	client             *mongo.Client
+	database           string
+	collection         string
+	auditCollection    string
+	sessionsCollection string
+	webhooksCollection string
+	queueCollection    string
+	devicesCollection  string
+	tokensCollection   string
+	regsCollection     string
 }
 
-func NewClient(connstring, database, collection string) (*Client, error) {
+func NewClient(cfg config.DBConfig) (*Client, error) {
 	ctx, cancelConnect := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancelConnect()
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(connstring))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.ConnString))
 	if err != nil {
 		return nil, err
 	}
@@ -33,7 +42,18 @@ func NewClient(connstring, database, collection string) (*Client, error) {
 		return nil, err
 	}
 
-	return &Client{client: client, database: database, collection: collection}, nil
+	return &Client{
+		client:             client,
+		database:           cfg.Database,
+		collection:         cfg.Collection,
+		auditCollection:    cfg.AuditCollection,
+		sessionsCollection: cfg.SessionsCollection,
+		webhooksCollection: cfg.WebhooksCollection,
+		queueCollection:    cfg.WebhookQueueCollection,
+		devicesCollection:  cfg.DevicesCollection,
+		tokensCollection:   cfg.ProvisioningCollection,
+		regsCollection:     cfg.RegistrationsCollection,
+	}, nil
 }
 
 func (c *Client) FindAllGarages(ctx context.Context) (map[string]*resources.Garage, error) {
@@ -69,24 +89,37 @@ func (c *Client) InsertGarage(ctx context.Context, garage *resources.Garage) err
 			"city":        garage.City,
 			"address":     garage.Address,
 			"geolocation": garage.Geolocation,
+			"hours":       garage.Hours,
+			"tariff":      garage.Tariff,
 			"sections":    garage.Sections,
+			"version":     garage.Version,
 		},
 	)
 	return err
 }
 
-func (c *Client) UpdateGarage(ctx context.Context, id string, newname string, newcity string, newaddress string) error {
+// UpdateGarage replaces garage properties, or only those listed in fields
+// if it is not nil
+func (c *Client) UpdateGarage(ctx context.Context, id string, garage *resources.Garage, fields []string) error {
 	collection := c.client.Database(c.database).Collection(c.collection)
 
-	update := bson.M{}
-	if newname != "" {
-		update["name"] = newname
+	properties := bson.M{
+		"name":                  garage.Name,
+		"city":                  garage.City,
+		"address":               garage.Address,
+		"geolocation.longitude": garage.Geolocation.Longitude,
+		"geolocation.latitude":  garage.Geolocation.Latitude,
+		"hours":                 garage.Hours,
+		"tariff":                garage.Tariff,
 	}
-	if newcity != "" {
-		update["city"] = newcity
-	}
-	if newaddress != "" {
-		update["address"] = newaddress
+
+	// Opening hours and tariffs are merged before they are stored, and are
+	// stored as a whole if any of their properties changes
+	update := bson.M{"version": garage.Version}
+	for k, v := range properties {
+		if selected(fields, k) || selectedObject(fields, k) {
+			update[k] = v
+		}
 	}
 
 	_, err := collection.UpdateOne(
@@ -107,16 +140,58 @@ func (c *Client) DeleteGarage(ctx context.Context, id string) error {
 	return err
 }
 
+func (c *Client) SoftDeleteGarage(ctx context.Context, id string, deletedAt time.Time) error {
+	collection := c.client.Database(c.database).Collection(c.collection)
+
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{
+			"id": id,
+		},
+		bson.M{
+			"$set": bson.M{"deleted_at": deletedAt},
+		},
+	)
+	return err
+}
+
+func (c *Client) RestoreGarage(ctx context.Context, id string) error {
+	collection := c.client.Database(c.database).Collection(c.collection)
+
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{
+			"id": id,
+		},
+		bson.M{
+			"$unset": bson.M{"deleted_at": ""},
+		},
+	)
+	return err
+}
+
+func sectionDocument(section *resources.Section) bson.M {
+	doc := bson.M{
+		"id":          section.ID,
+		"name":        section.Name,
+		"level":       section.Level,
+		"description": section.Description,
+		"total_spots": section.TotalSpots,
+		"spot_types":  section.SpotTypes,
+		"aliases":     section.Aliases,
+		"version":     section.Version,
+	}
+	if section.DeletedAt != nil {
+		doc["deleted_at"] = section.DeletedAt
+	}
+	return doc
+}
+
 func (c *Client) InsertSection(ctx context.Context, garageID string, section *resources.Section) error {
 	collection := c.client.Database(c.database).Collection(c.collection)
 
 	update := bson.M{
-		"sections": bson.M{
-			"name":        section.Name,
-			"level":       section.Level,
-			"description": section.Description,
-			"total_spots": section.TotalSpots,
-		},
+		"sections": sectionDocument(section),
 	}
 
 	_, err := collection.UpdateOne(
@@ -131,31 +206,45 @@ func (c *Client) InsertSection(ctx context.Context, garageID string, section *re
 	return err
 }
 
-func (c *Client) UpdateSection(
-	ctx context.Context,
-	garageID string,
-	sectionName string,
-	newname string,
-	newlevel string,
-	newdescription string,
-	newtotalspots int,
-) error {
+// UpdateSection replaces section properties, or only those listed in fields
+// if it is not nil
+func (c *Client) UpdateSection(ctx context.Context, garageID string, sectionID string, section *resources.Section, fields []string) error {
 	collection := c.client.Database(c.database).Collection(c.collection)
 
-	update := bson.M{}
-	if newname != "" {
-		update["sections.$.name"] = newname
-	}
-	if newlevel != "" {
-		update["sections.$.level"] = newlevel
+	properties := bson.M{
+		"name":        section.Name,
+		"level":       section.Level,
+		"description": section.Description,
+		"total_spots": section.TotalSpots,
+		"spot_types":  section.SpotTypes,
 	}
-	if newdescription != "" {
-		update["sections.$.description"] = newdescription
+
+	update := bson.M{
+		"sections.$.aliases": section.Aliases,
+		"sections.$.version": section.Version,
 	}
-	if newtotalspots > 0 {
-		update["sections.$.total_spots"] = newtotalspots
+	for k, v := range properties {
+		if selected(fields, k) {
+			update["sections.$."+k] = v
+		}
 	}
 
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{
+			"id":          garageID,
+			"sections.id": sectionID,
+		},
+		bson.M{
+			"$set": update,
+		},
+	)
+	return err
+}
+
+func (c *Client) SetSectionID(ctx context.Context, garageID string, sectionName string, sectionID string) error {
+	collection := c.client.Database(c.database).Collection(c.collection)
+
 	_, err := collection.UpdateOne(
 		ctx,
 		bson.M{
@@ -163,18 +252,58 @@ func (c *Client) UpdateSection(
 			"sections.name": sectionName,
 		},
 		bson.M{
-			"$set": update,
+			"$set": bson.M{"sections.$.id": sectionID},
 		},
 	)
 	return err
 }
 
-func (c *Client) DeleteSection(ctx context.Context, garageID string, sectionName string) error {
+// SoftDeleteSection moves a section to the garage's deleted sections, the
+// section's DeletedAt must be set
+func (c *Client) SoftDeleteSection(ctx context.Context, garageID string, section *resources.Section) error {
+	collection := c.client.Database(c.database).Collection(c.collection)
+
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{
+			"id": garageID,
+		},
+		bson.M{
+			"$pull": bson.M{"sections": bson.M{"id": section.ID}},
+			"$push": bson.M{"deleted_sections": sectionDocument(section)},
+		},
+	)
+	return err
+}
+
+// RestoreSection moves a section back from the garage's deleted sections
+func (c *Client) RestoreSection(ctx context.Context, garageID string, section *resources.Section) error {
+	collection := c.client.Database(c.database).Collection(c.collection)
+
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{
+			"id": garageID,
+		},
+		bson.M{
+			"$pull": bson.M{"deleted_sections": bson.M{"id": section.ID}},
+			"$push": bson.M{"sections": sectionDocument(section)},
+		},
+	)
+	return err
+}
+
+// DeleteSection permanently removes a section, whether it is soft-deleted
+// or not
+func (c *Client) DeleteSection(ctx context.Context, garageID string, sectionID string) error {
 	collection := c.client.Database(c.database).Collection(c.collection)
 
 	update := bson.M{
 		"sections": bson.M{
-			"name": sectionName,
+			"id": sectionID,
+		},
+		"deleted_sections": bson.M{
+			"id": sectionID,
 		},
 	}
 
@@ -189,3 +318,397 @@ func (c *Client) DeleteSection(ctx context.Context, garageID string, sectionName
 	)
 	return err
 }
+
+// AuditFilter selects audit log entries, zero values match any entry
+type AuditFilter struct {
+	Actor     string
+	Action    string
+	GarageID  string
+	SectionID string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+func (c *Client) InsertAuditEntry(ctx context.Context, entry *resources.AuditEntry) error {
+	collection := c.client.Database(c.database).Collection(c.auditCollection)
+	_, err := collection.InsertOne(ctx, entry)
+	return err
+}
+
+func (c *Client) FindAuditEntries(ctx context.Context, filter AuditFilter) ([]resources.AuditEntry, error) {
+	collection := c.client.Database(c.database).Collection(c.auditCollection)
+
+	query := bson.M{}
+	if filter.Actor != "" {
+		query["actor"] = filter.Actor
+	}
+	if filter.Action != "" {
+		query["action"] = filter.Action
+	}
+	if filter.GarageID != "" {
+		query["garage_id"] = filter.GarageID
+	}
+	if filter.SectionID != "" {
+		query["section_id"] = filter.SectionID
+	}
+	timestamp := bson.M{}
+	if !filter.Since.IsZero() {
+		timestamp["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		timestamp["$lt"] = filter.Until
+	}
+	if len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+
+	opts := options.Find().SetSort(bson.M{"timestamp": -1})
+	if filter.Limit > 0 {
+		opts.SetLimit(int64(filter.Limit))
+	}
+
+	cursor, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	entries := []resources.AuditEntry{}
+	for cursor.Next(ctx) {
+		e := resources.AuditEntry{}
+		if err = cursor.Decode(&e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, cursor.Err()
+}
+
+// SessionFilter selects ended parking sessions of a garage by the section
+// and by the time they started, zero values match any session
+type SessionFilter struct {
+	GarageID  string
+	SectionID string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+// InsertSession stores an ongoing session, unless it has already been
+// stored, e.g. ended by a concurrent update
+func (c *Client) InsertSession(ctx context.Context, session *resources.Session) error {
+	collection := c.client.Database(c.database).Collection(c.sessionsCollection)
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{"id": session.ID},
+		bson.M{"$setOnInsert": session},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// ReplaceSession stores the session in place of its ongoing version
+func (c *Client) ReplaceSession(ctx context.Context, session *resources.Session) error {
+	collection := c.client.Database(c.database).Collection(c.sessionsCollection)
+	_, err := collection.ReplaceOne(
+		ctx,
+		bson.M{"id": session.ID},
+		session,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// FindOngoingSessions returns the sessions which have not ended
+func (c *Client) FindOngoingSessions(ctx context.Context) ([]resources.Session, error) {
+	collection := c.client.Database(c.database).Collection(c.sessionsCollection)
+
+	cursor, err := collection.Find(ctx, bson.M{"end": bson.M{"$exists": false}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	sessions := []resources.Session{}
+	for cursor.Next(ctx) {
+		s := resources.Session{}
+		if err = cursor.Decode(&s); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, cursor.Err()
+}
+
+func (c *Client) FindSessions(ctx context.Context, filter SessionFilter) ([]resources.Session, error) {
+	collection := c.client.Database(c.database).Collection(c.sessionsCollection)
+
+	query := bson.M{"garage_id": filter.GarageID, "end": bson.M{"$exists": true}}
+	if filter.SectionID != "" {
+		query["section_id"] = filter.SectionID
+	}
+	start := bson.M{}
+	if !filter.Since.IsZero() {
+		start["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		start["$lt"] = filter.Until
+	}
+	if len(start) > 0 {
+		query["start"] = start
+	}
+
+	opts := options.Find().SetSort(bson.M{"start": -1})
+	if filter.Limit > 0 {
+		opts.SetLimit(int64(filter.Limit))
+	}
+
+	cursor, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	sessions := []resources.Session{}
+	for cursor.Next(ctx) {
+		s := resources.Session{}
+		if err = cursor.Decode(&s); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, cursor.Err()
+}
+
+func (c *Client) FindAllWebhooks(ctx context.Context) (map[string]*resources.Webhook, error) {
+	collection := c.client.Database(c.database).Collection(c.webhooksCollection)
+
+	cursor, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	webhooks := make(map[string]*resources.Webhook)
+	for cursor.Next(ctx) {
+		w := &resources.Webhook{}
+		if err = cursor.Decode(w); err != nil {
+			return nil, err
+		}
+		webhooks[w.ID] = w
+	}
+
+	return webhooks, cursor.Err()
+}
+
+func (c *Client) InsertWebhook(ctx context.Context, webhook *resources.Webhook) error {
+	collection := c.client.Database(c.database).Collection(c.webhooksCollection)
+	_, err := collection.InsertOne(ctx, webhook)
+	return err
+}
+
+// DeleteWebhook removes a webhook subscription and its queued deliveries
+func (c *Client) DeleteWebhook(ctx context.Context, id string) error {
+	collection := c.client.Database(c.database).Collection(c.webhooksCollection)
+	if _, err := collection.DeleteOne(ctx, bson.M{"id": id}); err != nil {
+		return err
+	}
+
+	queue := c.client.Database(c.database).Collection(c.queueCollection)
+	_, err := queue.DeleteMany(ctx, bson.M{"webhook_id": id})
+	return err
+}
+
+func (c *Client) InsertDelivery(ctx context.Context, delivery *resources.WebhookDelivery) error {
+	collection := c.client.Database(c.database).Collection(c.queueCollection)
+	_, err := collection.InsertOne(ctx, delivery)
+	return err
+}
+
+// FindDueDeliveries returns up to limit deliveries due by the given time,
+// the longest due first
+func (c *Client) FindDueDeliveries(ctx context.Context, now time.Time, limit int) ([]resources.WebhookDelivery, error) {
+	collection := c.client.Database(c.database).Collection(c.queueCollection)
+
+	opts := options.Find().SetSort(bson.M{"next_attempt": 1}).SetLimit(int64(limit))
+	cursor, err := collection.Find(ctx, bson.M{"next_attempt": bson.M{"$lte": now}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	deliveries := []resources.WebhookDelivery{}
+	for cursor.Next(ctx) {
+		d := resources.WebhookDelivery{}
+		if err = cursor.Decode(&d); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, cursor.Err()
+}
+
+// RescheduleDelivery records a failed attempt of a delivery
+func (c *Client) RescheduleDelivery(ctx context.Context, delivery *resources.WebhookDelivery) error {
+	collection := c.client.Database(c.database).Collection(c.queueCollection)
+
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{
+			"id": delivery.ID,
+		},
+		bson.M{
+			"$set": bson.M{
+				"attempts":     delivery.Attempts,
+				"next_attempt": delivery.NextAttempt,
+				"last_error":   delivery.LastError,
+			},
+		},
+	)
+	return err
+}
+
+func (c *Client) DeleteDelivery(ctx context.Context, id string) error {
+	collection := c.client.Database(c.database).Collection(c.queueCollection)
+	_, err := collection.DeleteOne(ctx, bson.M{"id": id})
+	return err
+}
+
+func selected(fields []string, field string) bool {
+	if fields == nil {
+		return true
+	}
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// selectedObject reports whether any property of the object is listed in
+// fields
+func selectedObject(fields []string, object string) bool {
+	for _, f := range fields {
+		if strings.HasPrefix(f, object+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) FindAllDeviceConfigs(ctx context.Context) (map[string]*resources.DeviceConfig, error) {
+	collection := c.client.Database(c.database).Collection(c.devicesCollection)
+
+	cursor, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	configs := make(map[string]*resources.DeviceConfig)
+	for cursor.Next(ctx) {
+		d := &resources.DeviceConfig{}
+		if err = cursor.Decode(d); err != nil {
+			return nil, err
+		}
+		configs[d.ID] = d
+	}
+
+	return configs, cursor.Err()
+}
+
+// ReplaceDeviceConfig inserts the configuration of a device, or replaces it
+func (c *Client) ReplaceDeviceConfig(ctx context.Context, config *resources.DeviceConfig) error {
+	collection := c.client.Database(c.database).Collection(c.devicesCollection)
+	_, err := collection.ReplaceOne(
+		ctx,
+		bson.M{"id": config.ID},
+		config,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (c *Client) DeleteDeviceConfig(ctx context.Context, id string) error {
+	collection := c.client.Database(c.database).Collection(c.devicesCollection)
+	_, err := collection.DeleteOne(ctx, bson.M{"id": id})
+	return err
+}
+
+func (c *Client) FindAllProvisioningTokens(ctx context.Context) (map[string]*resources.ProvisioningToken, error) {
+	collection := c.client.Database(c.database).Collection(c.tokensCollection)
+
+	cursor, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	tokens := make(map[string]*resources.ProvisioningToken)
+	for cursor.Next(ctx) {
+		t := &resources.ProvisioningToken{}
+		if err = cursor.Decode(t); err != nil {
+			return nil, err
+		}
+		tokens[t.ID] = t
+	}
+
+	return tokens, cursor.Err()
+}
+
+func (c *Client) InsertProvisioningToken(ctx context.Context, token *resources.ProvisioningToken) error {
+	collection := c.client.Database(c.database).Collection(c.tokensCollection)
+	_, err := collection.InsertOne(ctx, token)
+	return err
+}
+
+func (c *Client) DeleteProvisioningToken(ctx context.Context, id string) error {
+	collection := c.client.Database(c.database).Collection(c.tokensCollection)
+	_, err := collection.DeleteOne(ctx, bson.M{"id": id})
+	return err
+}
+
+func (c *Client) FindAllRegistrations(ctx context.Context) (map[string]*resources.DeviceRegistration, error) {
+	collection := c.client.Database(c.database).Collection(c.regsCollection)
+
+	cursor, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	regs := make(map[string]*resources.DeviceRegistration)
+	for cursor.Next(ctx) {
+		r := &resources.DeviceRegistration{}
+		if err = cursor.Decode(r); err != nil {
+			return nil, err
+		}
+		regs[r.DeviceID] = r
+	}
+
+	return regs, cursor.Err()
+}
+
+// ReplaceRegistration inserts the registration of a device, or replaces it
+func (c *Client) ReplaceRegistration(ctx context.Context, reg *resources.DeviceRegistration) error {
+	collection := c.client.Database(c.database).Collection(c.regsCollection)
+	_, err := collection.ReplaceOne(
+		ctx,
+		bson.M{"device_id": reg.DeviceID},
+		reg,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (c *Client) DeleteRegistration(ctx context.Context, deviceID string) error {
+	collection := c.client.Database(c.database).Collection(c.regsCollection)
+	_, err := collection.DeleteOne(ctx, bson.M{"device_id": deviceID})
+	return err
+}
@@ -11,41 +11,329 @@ type (
 
 	// Garage represents a garage resource
 	Garage struct {
-		ID          string      `bson:"id" json:"id"`
-		Name        string      `bson:"name" json:"name"`
-		City        string      `bson:"city" json:"city"`
-		Address     string      `bson:"address" json:"address"`
-		Geolocation Geolocation `bson:"geolocation" json:"geolocation"`
-		Sections    []Section   `bson:"sections" json:"sections"`
+		ID              string        `bson:"id" json:"id"`
+		Name            string        `bson:"name" json:"name"`
+		City            string        `bson:"city" json:"city"`
+		Address         string        `bson:"address" json:"address"`
+		Geolocation     Geolocation   `bson:"geolocation" json:"geolocation"`
+		Hours           *OpeningHours `bson:"hours,omitempty" json:"hours,omitempty"`
+		Tariff          *Tariff       `bson:"tariff,omitempty" json:"tariff,omitempty"`
+		Sections        []Section     `bson:"sections" json:"sections"`
+		Version         int           `bson:"version" json:"-"`
+		DeletedAt       *time.Time    `bson:"deleted_at,omitempty" json:"-"`
+		DeletedSections []Section     `bson:"deleted_sections" json:"-"`
+	}
+
+	// OpeningHours is the weekly schedule of a garage, in the garage's time
+	// zone, with exceptions for particular dates such as holidays. A garage
+	// without opening hours is always open.
+	OpeningHours struct {
+		Timezone   string          `bson:"timezone" json:"timezone"`
+		Weekly     []OpeningPeriod `bson:"weekly" json:"weekly"`
+		Exceptions []OpeningPeriod `bson:"exceptions" json:"exceptions"`
+	}
+
+	// OpeningPeriod is a period between opening and closing time, "15:04",
+	// on a day of the week or, for exceptions, a date, "2006-01-02". Closing
+	// time not after opening time means the garage closes the next day. An
+	// exception without opening and closing time means the garage is closed
+	// that date.
+	OpeningPeriod struct {
+		Day   string `bson:"day,omitempty" json:"day,omitempty"`
+		Date  string `bson:"date,omitempty" json:"date,omitempty"`
+		Open  string `bson:"open" json:"open"`
+		Close string `bson:"close" json:"close"`
+	}
+
+	// Tariff is the price list of a garage. Parking is charged by the minute
+	// at the hourly rate, or the rate of the time-of-day band the minute falls
+	// in, plus the surcharge for the type of the spot. The daily cap, if any,
+	// limits the price of every 24 hours from arrival.
+	Tariff struct {
+		Currency   string             `bson:"currency" json:"currency"`
+		Timezone   string             `bson:"timezone" json:"timezone"`
+		HourlyRate float64            `bson:"hourly_rate" json:"hourly_rate"`
+		DailyCap   float64            `bson:"daily_cap" json:"daily_cap"`
+		Bands      []TariffBand       `bson:"bands" json:"bands"`
+		Surcharges map[string]float64 `bson:"surcharges" json:"surcharges"`
+	}
+
+	// TariffBand is an hourly rate between two times of day, "15:04". A band
+	// ending not after it starts ends the next day.
+	TariffBand struct {
+		From       string  `bson:"from" json:"from"`
+		To         string  `bson:"to" json:"to"`
+		HourlyRate float64 `bson:"hourly_rate" json:"hourly_rate"`
+	}
+
+	// QuoteRespObj is a JSON response object with the price of parking in a
+	// garage
+	QuoteRespObj struct {
+		GarageID  string    `json:"garage_id"`
+		SpotType  string    `json:"spot_type"`
+		Arrival   time.Time `json:"arrival"`
+		Departure time.Time `json:"departure"`
+		Minutes   int       `json:"minutes"`
+		Currency  string    `json:"currency"`
+		Price     float64   `json:"price"`
 	}
 
 	// GarageRespObj is a JSON response object representing a garage
 	GarageRespObj struct {
-		ID          string      `json:"id"`
-		Name        string      `json:"name"`
-		City        string      `json:"city"`
-		Address     string      `json:"address"`
-		Geolocation Geolocation `json:"geolocation"`
-		FreeSpots   int         `json:"free_spots"`
+		ID              string         `json:"id"`
+		Name            string         `json:"name"`
+		City            string         `json:"city"`
+		Address         string         `json:"address"`
+		Geolocation     Geolocation    `json:"geolocation"`
+		Hours           *OpeningHours  `json:"hours,omitempty"`
+		Tariff          *Tariff        `json:"tariff,omitempty"`
+		Open            bool           `json:"open"`
+		FreeSpots       int            `json:"free_spots"`
+		FreeSpotsByType map[string]int `json:"free_spots_by_type"`
+		Version         int            `json:"version"`
+		DeletedAt       *time.Time     `json:"deleted_at,omitempty"`
 	}
 
 	// Section represents a garage section resource
 	Section struct {
-		Name        string `bson:"name" json:"name"`
-		Level       string `bson:"level" json:"level"`
-		Description string `bson:"description" json:"description"`
-		TotalSpots  int    `bson:"total_spots" json:"total_spots"`
-		FreeSpots   int
-		Spots       []Spot
+		ID          string         `bson:"id" json:"id"`
+		Name        string         `bson:"name" json:"name"`
+		Level       string         `bson:"level" json:"level"`
+		Description string         `bson:"description" json:"description"`
+		TotalSpots  int            `bson:"total_spots" json:"total_spots"`
+		SpotTypes   []SpotRange    `bson:"spot_types" json:"spot_types"`
+		Aliases     []SectionAlias `bson:"aliases" json:"-"`
+		Version     int            `bson:"version" json:"-"`
+		DeletedAt   *time.Time     `bson:"deleted_at,omitempty" json:"-"`
+		FreeSpots   int            `bson:"-" json:"-"`
+		Spots       []Spot         `bson:"-" json:"-"`
+	}
+
+	// SpotRange assigns a type to the spots numbered From to To, inclusive.
+	// Spots can have more than one type, and spots without one are standard.
+	SpotRange struct {
+		Type string `bson:"type" json:"type"`
+		From int    `bson:"from" json:"from"`
+		To   int    `bson:"to" json:"to"`
+	}
+
+	// SectionAlias is a former section name which can still be used to
+	// address the section until it expires
+	SectionAlias struct {
+		Name    string    `bson:"name"`
+		Expires time.Time `bson:"expires"`
 	}
 
 	// SectionRespObj is a JSON response object representing a section
 	SectionRespObj struct {
-		Name        string `json:"name"`
-		Level       string `json:"level"`
-		Description string `json:"description"`
-		TotalSpots  int    `json:"total_spots"`
-		FreeSpots   int    `json:"free_spots"`
+		ID              string         `json:"id"`
+		Name            string         `json:"name"`
+		Level           string         `json:"level"`
+		Description     string         `json:"description"`
+		TotalSpots      int            `json:"total_spots"`
+		SpotTypes       []SpotRange    `json:"spot_types,omitempty"`
+		FreeSpots       int            `json:"free_spots"`
+		FreeSpotsByType map[string]int `json:"free_spots_by_type"`
+		Version         int            `json:"version"`
+		DeletedAt       *time.Time     `json:"deleted_at,omitempty"`
+		RemovedSpots    []int          `json:"removed_spots,omitempty"`
+	}
+
+	// FreeSpotsDiscrepancy is a JSON response object describing a section
+	// whose free spots count did not match the state of its spots
+	FreeSpotsDiscrepancy struct {
+		GarageID      string `json:"garage_id"`
+		SectionName   string `json:"section_name"`
+		RecordedCount int    `json:"recorded_free_spots"`
+		ActualCount   int    `json:"actual_free_spots"`
+	}
+
+	// AuditEntry is a record of a change made to a resource
+	AuditEntry struct {
+		Timestamp time.Time              `bson:"timestamp" json:"timestamp"`
+		Actor     string                 `bson:"actor" json:"actor"`
+		Action    string                 `bson:"action" json:"action"`
+		Target    string                 `bson:"target" json:"target"`
+		GarageID  string                 `bson:"garage_id,omitempty" json:"garage_id,omitempty"`
+		SectionID string                 `bson:"section_id,omitempty" json:"section_id,omitempty"`
+		Before    map[string]interface{} `bson:"before,omitempty" json:"before,omitempty"`
+		After     map[string]interface{} `bson:"after,omitempty" json:"after,omitempty"`
+	}
+
+	// ImportChange is a JSON response object describing a change made to a
+	// garage or a section by an import, or one which would be made
+	ImportChange struct {
+		Action    string                 `json:"action"`
+		GarageID  string                 `json:"garage_id,omitempty"`
+		SectionID string                 `json:"section_id,omitempty"`
+		Name      string                 `json:"name"`
+		Before    map[string]interface{} `json:"before,omitempty"`
+		After     map[string]interface{} `json:"after,omitempty"`
+		Error     string                 `json:"error,omitempty"`
+	}
+
+	// ImportReport is a JSON response object listing the changes of an import
+	ImportReport struct {
+		DryRun  bool           `json:"dry_run"`
+		Applied bool           `json:"applied"`
+		Changes []ImportChange `json:"changes"`
+	}
+
+	// Session is a period a parking spot was taken, with the fee for it if
+	// the garage has a tariff. A session ends when the spot is free again or
+	// its device is disconnected, and is ongoing until then.
+	Session struct {
+		ID        string     `bson:"id" json:"id"`
+		GarageID  string     `bson:"garage_id" json:"garage_id"`
+		SectionID string     `bson:"section_id" json:"section_id"`
+		Spot      int        `bson:"spot" json:"spot"`
+		Label     string     `bson:"label" json:"label"`
+		SpotTypes []string   `bson:"spot_types" json:"spot_types"`
+		Start     time.Time  `bson:"start" json:"start"`
+		End       *time.Time `bson:"end,omitempty" json:"end,omitempty"`
+		EndReason string     `bson:"end_reason,omitempty" json:"end_reason,omitempty"`
+		Duration  int        `bson:"duration_seconds" json:"duration_seconds"`
+		Fee       *float64   `bson:"fee,omitempty" json:"fee,omitempty"`
+		Currency  string     `bson:"currency,omitempty" json:"currency,omitempty"`
+	}
+
+	// DeviceConfig is the tuning of the monitor with the ID, or of all the
+	// monitors if the ID is "default". Values which are not set are taken
+	// from the default, and then from the monitor's own flags.
+	DeviceConfig struct {
+		ID                  string    `bson:"id" json:"id"`
+		HeartbeatInterval   int       `bson:"heartbeat_interval,omitempty" json:"heartbeat_interval,omitempty"`
+		DiscoveryInterval   int       `bson:"discovery_interval,omitempty" json:"discovery_interval,omitempty"`
+		StateUpdateInterval int       `bson:"state_update_interval,omitempty" json:"state_update_interval,omitempty"`
+		TakenRatio          float64   `bson:"taken_ratio,omitempty" json:"taken_ratio,omitempty"`
+		UpdatedAt           time.Time `bson:"updated_at" json:"updated_at"`
+	}
+
+	// ProvisioningToken lets devices register for spots in a section of a
+	// garage until it expires. It is created for the section given by name
+	// or ID, and the token itself is only returned then.
+	ProvisioningToken struct {
+		ID        string    `bson:"id" json:"id"`
+		Token     string    `bson:"token" json:"token,omitempty"`
+		GarageID  string    `bson:"garage_id" json:"garage_id"`
+		Section   string    `bson:"-" json:"section,omitempty"`
+		SectionID string    `bson:"section_id" json:"section_id"`
+		ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+		CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	}
+
+	// RegistrationReq is a JSON request object of a device registering with
+	// a provisioning token for the number of spots it watches, one if not
+	// given. A registered device also presents its secret.
+	RegistrationReq struct {
+		Token  string `json:"token"`
+		Secret string `json:"secret,omitempty"`
+		Spots  int    `json:"spots,omitempty"`
+	}
+
+	// DeviceRegistration is the assignment of a device to spots of a
+	// section. Only the hash of the device's secret is kept, and the secret
+	// is only returned when it is generated.
+	DeviceRegistration struct {
+		DeviceID     string         `bson:"device_id" json:"device_id"`
+		GarageID     string         `bson:"garage_id" json:"garage_id"`
+		SectionID    string         `bson:"section_id" json:"section_id"`
+		SectionName  string         `bson:"-" json:"section_name"`
+		Spots        []AssignedSpot `bson:"spots" json:"spots"`
+		Secret       string         `bson:"-" json:"secret,omitempty"`
+		SecretHash   string         `bson:"secret_hash" json:"-"`
+		RegisteredAt time.Time      `bson:"registered_at" json:"registered_at"`
+	}
+
+	// AssignedSpot is a spot assigned to a registered device
+	AssignedSpot struct {
+		Number int    `bson:"number" json:"number"`
+		Label  string `bson:"label" json:"label"`
+	}
+
+	// Webhook is a subscription to occupancy events. Events of the listed
+	// types, or of any type if none is listed, are delivered to the URL when
+	// they happen in the given garage and section, or in any if not given.
+	Webhook struct {
+		ID         string    `bson:"id" json:"id"`
+		URL        string    `bson:"url" json:"url"`
+		Secret     string    `bson:"secret" json:"secret,omitempty"`
+		Events     []string  `bson:"events" json:"events"`
+		GarageID   string    `bson:"garage_id,omitempty" json:"garage_id,omitempty"`
+		SectionID  string    `bson:"section_id,omitempty" json:"section_id,omitempty"`
+		Threshold  int       `bson:"threshold,omitempty" json:"threshold,omitempty"`
+		MinOffline int       `bson:"min_offline,omitempty" json:"min_offline,omitempty"`
+		CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+	}
+
+	// WebhookEvent is the payload delivered to a webhook
+	WebhookEvent struct {
+		ID           string    `bson:"id" json:"id"`
+		Type         string    `bson:"type" json:"type"`
+		Timestamp    time.Time `bson:"timestamp" json:"timestamp"`
+		GarageID     string    `bson:"garage_id" json:"garage_id"`
+		GarageName   string    `bson:"garage_name" json:"garage_name"`
+		SectionID    string    `bson:"section_id" json:"section_id"`
+		SectionName  string    `bson:"section_name" json:"section_name"`
+		TotalSpots   int       `bson:"total_spots" json:"total_spots"`
+		FreeSpots    int       `bson:"free_spots" json:"free_spots"`
+		Threshold    int       `bson:"threshold,omitempty" json:"threshold,omitempty"`
+		OfflineSpots int       `bson:"offline_spots,omitempty" json:"offline_spots,omitempty"`
+	}
+
+	// WebhookDelivery is a queued delivery of an event to a webhook
+	WebhookDelivery struct {
+		ID          string       `bson:"id"`
+		WebhookID   string       `bson:"webhook_id"`
+		Event       WebhookEvent `bson:"event"`
+		Attempts    int          `bson:"attempts"`
+		NextAttempt time.Time    `bson:"next_attempt"`
+		LastError   string       `bson:"last_error,omitempty"`
+	}
+
+	// OfflineSpot is a JSON response object describing a spot whose device
+	// is offline, or recently timed out
+	OfflineSpot struct {
+		GarageID      string     `json:"garage_id"`
+		GarageName    string     `json:"garage_name"`
+		SectionID     string     `json:"section_id"`
+		SectionName   string     `json:"section_name"`
+		Spot          int        `json:"spot"`
+		Label         string     `json:"label"`
+		Online        bool       `json:"online"`
+		LastSeen      time.Time  `json:"last_seen"`
+		OfflineSince  *time.Time `json:"offline_since,omitempty"`
+		OfflineReason string     `json:"offline_reason,omitempty"`
+		Drops         int        `json:"recent_drops"`
+		LastDrop      *time.Time `json:"last_drop,omitempty"`
+		Flapping      bool       `json:"flapping"`
+	}
+
+	// DeviceAlert is a notification about the device of a spot
+	DeviceAlert struct {
+		Type        string    `json:"type"`
+		Timestamp   time.Time `json:"timestamp"`
+		GarageID    string    `json:"garage_id"`
+		GarageName  string    `json:"garage_name"`
+		SectionID   string    `json:"section_id"`
+		SectionName string    `json:"section_name"`
+		Spot        int       `json:"spot"`
+		Label       string    `json:"label"`
+		LastSeen    time.Time `json:"last_seen"`
+		Drops       int       `json:"recent_drops"`
+	}
+
+	// UpdateResult is a JSON response object telling whether the update of
+	// a spot was applied, ignored as older than the spot's state, or rejected
+	UpdateResult struct {
+		Number int    `json:"number"`
+		Result string `json:"result"`
+		Reason string `json:"reason,omitempty"`
+	}
+
+	// UpdateRespObj is a JSON response object of a spots' update
+	UpdateRespObj struct {
+		Results []UpdateResult `json:"results"`
 	}
 
 	// Spot represents a parking spot
@@ -54,5 +342,25 @@ type (
 		Online     bool
 		Taken      bool
 		LastUpdate time.Time
+
+		// ObservedAt is the time the device observed the spot's state, which
+		// is when it was updated unless the update was delayed
+		ObservedAt time.Time
+
+		// Sequence is the sequence number of the device's update, if it
+		// sent one
+		Sequence uint64
+
+		// Session is the ongoing parking session of a taken spot
+		Session *Session
+
+		// LastSeen is the time of the last message from the spot's device,
+		// and LastLabel its label, both kept when the spot goes offline.
+		// Drops are the recent times the device's updates timed out.
+		LastSeen      time.Time
+		LastLabel     string
+		OfflineSince  time.Time
+		OfflineReason string
+		Drops         []time.Time
 	}
 )
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	// defaultTakenRatio is the part of the distance to the empty spot within
+	// which a car is detected, unless tuned otherwise
+	defaultTakenRatio = 0.8
+
+	// defaultBaseline is the distance [cm] to the empty spot assumed for a
+	// spot which is not calibrated
+	defaultBaseline = 250.0
+
+	// calibrationSamples is the number of distances measured to calibrate a
+	// spot
+	calibrationSamples = 30
+)
+
+// calibration is the distance [cm] to each empty spot, by spot number,
+// measured in the calibration mode and kept in a JSON file
+type calibration map[int]float64
+
+func readCalibration(path string) (calibration, error) {
+	cal := calibration{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cal, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read calibration file %s: %v", path, err)
+	}
+	if err = json.Unmarshal(data, &cal); err != nil {
+		return nil, fmt.Errorf("calibration file %s decoding error: %v", path, err)
+	}
+	return cal, nil
+}
+
+func (cal calibration) save(path string) error {
+	data, err := json.MarshalIndent(cal, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write calibration file %s: %v", path, err)
+	}
+	return nil
+}
+
+// baseline returns the distance [cm] to the empty spot
+func (cal calibration) baseline(number int) float64 {
+	baseline, ok := cal[number]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "spot #%d not calibrated, assuming %.1fcm to the empty spot\n", number, defaultBaseline)
+		baseline = defaultBaseline
+	}
+	return baseline
+}
+
+// calibrate measures the distance to each empty spot, one spot at a time so
+// that the sensors do not hear each other's echoes
+func calibrate(spots []*spotHardware, samples int) (calibration, error) {
+	cal := calibration{}
+	for _, spot := range spots {
+		spot.green.on()
+		distances := []float64{}
+		var lastErr error
+		for i := 0; i < samples; i++ {
+			if i > 0 {
+				time.Sleep(tick)
+			}
+			if d, err := spot.sensor.distance(); err != nil {
+				lastErr = err
+			} else {
+				distances = append(distances, d)
+			}
+		}
+		spot.green.off()
+
+		if len(distances) <= samples/2 {
+			return nil, fmt.Errorf("spot #%d: only %d of %d distances measured, last error: %v", spot.number, len(distances), samples, lastErr)
+		}
+		baseline := median(distances)
+		if baseline*defaultTakenRatio < minRange {
+			return nil, fmt.Errorf("spot #%d: empty spot too close to the sensor (%.1fcm)", spot.number, baseline)
+		}
+		cal[spot.number] = baseline
+	}
+	return cal, nil
+}
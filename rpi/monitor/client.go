@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// requestTimeout is how long a request to the server may take
+	requestTimeout = 10 * time.Second
+
+	// backoffMin is the delay before the first retry of a failed request,
+	// doubled with every failure up to backoffMax
+	backoffMin = time.Second
+	backoffMax = 5 * time.Minute
+
+	// disconnectTimeout is how long disconnecting the spots is retried for
+	// when the monitor stops
+	disconnectTimeout = 30 * time.Second
+)
+
+// rejectedError is a response of the server refusing the request, which is
+// not retried, as it would be refused again
+type rejectedError struct {
+	status string
+	body   string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("request rejected by the server: %s: %s", e.status, e.body)
+}
+
+// newHTTPClient returns a client whose requests time out, so that a server
+// which hangs cannot block the updates
+func newHTTPClient() *http.Client {
+	return &http.Client{Timeout: requestTimeout}
+}
+
+// retryable reports whether a request which failed with the status code may
+// succeed later
+func retryable(status int) bool {
+	return status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// backoff returns the delay before the next retry after the number of
+// failures in a row, with random jitter, so that the monitors do not all
+// retry at once when the server is back
+func backoff(failures int, random *rand.Rand) time.Duration {
+	delay := backoffMin
+	for i := 1; i < failures && delay < backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > backoffMax {
+		delay = backoffMax
+	}
+	return delay/2 + time.Duration(random.Int63n(int64(delay/2)+1))
+}
+
+// postUpdate sends a bulk update of the spots to the server
+func postUpdate(httpclient *http.Client, url string, params []actionMsgParams) error {
+	return postAction(context.Background(), httpclient, url, actionMsg{Action: "update", Params: params})
+}
+
+// postAction sends the action to the server, failing with a rejectedError if
+// the server refuses it
+func postAction(ctx context.Context, httpclient *http.Client, url string, action actionMsg) error {
+	reqBody, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	authenticate(req)
+	resp, err := httpclient.Do(req)
+	if err != nil {
+		recordResponse("", err)
+		return err
+	}
+	defer resp.Body.Close()
+	recordResponse(resp.Status, nil)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if retryable(resp.StatusCode) {
+		return fmt.Errorf("server error: %s", resp.Status)
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &rejectedError{status: resp.Status, body: strings.TrimSpace(string(body))}
+}
+
+// replay sends the queued updates in order, in bulk updates of up to
+// replayBatch updates, until the queue is empty or sending fails. Updates
+// rejected by the server are dropped.
+func replay(httpclient *http.Client, url string, queue *updateQueue) error {
+	for queue.len() > 0 {
+		params := queue.peek(replayBatch)
+		if err := postUpdate(httpclient, url, params); err != nil {
+			if _, rejected := err.(*rejectedError); !rejected {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		if err := queue.pop(len(params)); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to save update queue: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// disconnect takes the spots offline on the server, retrying until
+// disconnectTimeout passes, so that the spots of a stopped monitor are not
+// shown online until the server times them out
+func disconnect(url string, spots []spotConfig) error {
+	if len(spots) == 0 {
+		return nil
+	}
+	action := actionMsg{Action: "disconnect"}
+	for _, s := range spots {
+		action.Params = append(action.Params, actionMsgParams{Number: s.Number})
+	}
+
+	deadline := time.Now().Add(disconnectTimeout)
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	httpclient := newHTTPClient()
+	for failures := 1; ; failures++ {
+		// The last request is cut short by the deadline, while the client
+		// times out the others
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		err := postAction(ctx, httpclient, url, action)
+		cancel()
+		if _, rejected := err.(*rejectedError); err == nil || rejected {
+			return err
+		}
+		delay := backoff(failures, random)
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "failed to disconnect: %v, retrying in %v\n", err, delay)
+		time.Sleep(delay)
+	}
+}
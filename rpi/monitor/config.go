@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type (
+	// spotConfig is a parking spot watched by the monitor, with the BCM
+	// pins of its sensor and status LEDs, or a simulated distance profile
+	spotConfig struct {
+		Number     int    `json:"number"`
+		Label      string `json:"label"`
+		TriggerPin int    `json:"trigger_pin"`
+		EchoPin    int    `json:"echo_pin"`
+		RedPin     int    `json:"red_pin"`
+		GreenPin   int    `json:"green_pin"`
+		Simulate   string `json:"simulate,omitempty"`
+	}
+
+	// monitorConfig lists the parking spots watched by the monitor; the
+	// blue LED shows the mode of the whole monitor, and the ID selects its
+	// configuration on the server
+	monitorConfig struct {
+		ID               string       `json:"id"`
+		URL              string       `json:"url"`
+		QueueFile        string       `json:"queue_file"`
+		CalibrationFile  string       `json:"calibration_file"`
+		StatusAddr       string       `json:"status_addr"`
+		RegistrationFile string       `json:"registration_file"`
+		BluePin          int          `json:"blue_pin"`
+		Spots            []spotConfig `json:"spots"`
+	}
+)
+
+// defaultConfig is a monitor of a single spot wired as in the README
+func defaultConfig(url string, number int, label string, simulate string) monitorConfig {
+	return monitorConfig{
+		URL:     url,
+		BluePin: bcmPinLEDBlue,
+		Spots: []spotConfig{
+			{
+				Number:     number,
+				Label:      label,
+				TriggerPin: bcmPinHCSR04Trigger,
+				EchoPin:    bcmPinHCSR04Echo,
+				RedPin:     bcmPinLEDRed,
+				GreenPin:   bcmPinLEDGreen,
+				Simulate:   simulate,
+			},
+		},
+	}
+}
+
+func readConfig(fileName string) (cfg monitorConfig, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		err = fmt.Errorf("failed to open config file %s: %v", fileName, err)
+		return
+	}
+	defer file.Close()
+
+	cfg.BluePin = bcmPinLEDBlue
+	if err = json.NewDecoder(file).Decode(&cfg); err != nil {
+		err = fmt.Errorf("config file %s decoding error: %v", fileName, err)
+	}
+	return
+}
+
+// validConfig checks that spots are listed once, and that every BCM pin is
+// used for one purpose only. Spots are numbered by the registration, if the
+// monitor is registered.
+func validConfig(cfg *monitorConfig) error {
+	if len(cfg.Spots) == 0 {
+		return fmt.Errorf("no spots listed")
+	}
+
+	numbers := make(map[int]bool)
+	pins := make(map[int]string)
+	usePin := func(pin int, use string) error {
+		if pin < 0 || pin > 27 {
+			return fmt.Errorf("%s: BCM pin %d not in range [0, 27]", use, pin)
+		}
+		if other, used := pins[pin]; used {
+			return fmt.Errorf("%s: BCM pin %d already used for %s", use, pin, other)
+		}
+		pins[pin] = use
+		return nil
+	}
+	if err := usePin(cfg.BluePin, "blue LED"); err != nil {
+		return err
+	}
+
+	for _, s := range cfg.Spots {
+		if s.Number < 1 {
+			return fmt.Errorf("invalid spot number %d", s.Number)
+		}
+		if numbers[s.Number] {
+			return fmt.Errorf("spot #%d listed more than once", s.Number)
+		}
+		numbers[s.Number] = true
+
+		if s.Simulate != "" {
+			if _, err := parseProfile(s.Simulate); err != nil {
+				return fmt.Errorf("spot #%d: %v", s.Number, err)
+			}
+			continue
+		}
+		for _, p := range []struct {
+			pin int
+			use string
+		}{
+			{s.TriggerPin, "trigger"},
+			{s.EchoPin, "echo"},
+			{s.RedPin, "red LED"},
+			{s.GreenPin, "green LED"},
+		} {
+			if err := usePin(p.pin, fmt.Sprintf("spot #%d %s", s.Number, p.use)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
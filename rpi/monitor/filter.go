@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// outlierTolerance is how far [cm] a sample may be from the median of
+	// the samples, and outlierRatio how far relative to the median, before
+	// it is rejected as an outlier; the larger of the two is used
+	outlierTolerance = 5.0
+	outlierRatio     = 0.1
+)
+
+func median(samples []float64) float64 {
+	sorted := append([]float64{}, samples...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// filterDistance returns the median of the valid samples of a measurement,
+// after rejecting the outliers. It fails unless the samples left are the
+// majority of the expected ones, as the sensor cannot be trusted then.
+func filterDistance(samples []float64, expected int) (float64, error) {
+	if len(samples) == 0 {
+		return 0, fmt.Errorf("no valid samples")
+	}
+
+	m := median(samples)
+	tolerance := math.Max(outlierTolerance, outlierRatio*m)
+	inliers := []float64{}
+	for _, s := range samples {
+		if math.Abs(s-m) <= tolerance {
+			inliers = append(inliers, s)
+		}
+	}
+	if len(inliers) <= expected/2 {
+		return 0, fmt.Errorf("only %d of %d samples consistent", len(inliers), expected)
+	}
+	return median(inliers), nil
+}
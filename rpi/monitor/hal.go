@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/stianeikeland/go-rpio"
+)
+
+type (
+	// distanceSensor measures the distance to the nearest object [cm], and
+	// fails if it cannot measure a valid one
+	distanceSensor interface {
+		distance() (float64, error)
+	}
+
+	// led is a status light
+	led interface {
+		on()
+		off()
+		toggle()
+	}
+
+	// spotHardware is the sensor of a parking spot and its status lights,
+	// red and green showing whether the spot is taken or free
+	spotHardware struct {
+		number int
+		sensor distanceSensor
+		red    led
+		green  led
+	}
+
+	// hardware is the spots' hardware and the blue status light showing the
+	// mode of the monitor
+	hardware struct {
+		blue  led
+		spots []*spotHardware
+	}
+
+	gpioLED struct {
+		pin rpio.Pin
+	}
+
+	// hcsr04 is an HC-SR04 ultrasonic sensor, measuring the distance from a
+	// few pings at once
+	hcsr04 struct {
+		trigger rpio.Pin
+		echo    rpio.Pin
+	}
+)
+
+const (
+	// pings is the number of pings of a distance measurement, and pingGap
+	// the time after a ping, letting its echoes fade
+	pings   = 5
+	pingGap = 60 * time.Millisecond
+
+	// echoStartTimeout is how long the echo pulse is waited for after the
+	// trigger, and echoTimeout how long it may last; the sensor's pulse is
+	// 38ms long when nothing is in range
+	echoStartTimeout = 10 * time.Millisecond
+	echoTimeout      = 40 * time.Millisecond
+
+	// minRange and maxRange are the distances [cm] the sensor can measure
+	minRange = 2.0
+	maxRange = 400.0
+)
+
+// pinging is held by the sensor pinging until its echoes fade, so that the
+// sensors of the spots, measuring at the same time, do not hear each other's
+// echoes
+var pinging sync.Mutex
+
+const (
+	bcmPinLEDRed        = 25
+	bcmPinLEDGreen      = 12
+	bcmPinLEDBlue       = 16
+	bcmPinHCSR04Trigger = 17
+	bcmPinHCSR04Echo    = 4
+)
+
+func newGPIOLED(bcmPin int) *gpioLED {
+	l := &gpioLED{pin: rpio.Pin(bcmPin)}
+	l.pin.Output()
+	return l
+}
+
+func (l *gpioLED) on()     { l.pin.High() }
+func (l *gpioLED) off()    { l.pin.Low() }
+func (l *gpioLED) toggle() { l.pin.Toggle() }
+
+func newHCSR04(bcmPinTrigger, bcmPinEcho int) *hcsr04 {
+	s := &hcsr04{trigger: rpio.Pin(bcmPinTrigger), echo: rpio.Pin(bcmPinEcho)}
+	s.trigger.Output()
+	s.echo.Input()
+
+	s.trigger.Low()
+	time.Sleep(2 * time.Second)
+	return s
+}
+
+// ping measures the distance from a single echo, failing if the echo does not
+// come, e.g. if the sensor is disconnected, or is out of range
+func (s *hcsr04) ping() (float64, error) {
+	s.trigger.High()
+	time.Sleep(100 * time.Microsecond)
+	s.trigger.Low()
+
+	deadline := time.Now().Add(echoStartTimeout)
+	for s.echo.Read() == rpio.Low {
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("no echo within %v", echoStartTimeout)
+		}
+	}
+	pulseStart := time.Now()
+	deadline = pulseStart.Add(echoTimeout)
+	for s.echo.Read() == rpio.High {
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("echo longer than %v", echoTimeout)
+		}
+	}
+
+	distance := time.Since(pulseStart).Seconds() * 17150.0
+	if distance < minRange || distance > maxRange {
+		return 0, fmt.Errorf("distance %.1fcm out of range", distance)
+	}
+	return distance, nil
+}
+
+// pingAlone pings while no other sensor does, and waits for the echoes to
+// fade before letting another one ping
+func (s *hcsr04) pingAlone() (float64, error) {
+	pinging.Lock()
+	defer pinging.Unlock()
+	defer time.Sleep(pingGap)
+	return s.ping()
+}
+
+func (s *hcsr04) distance() (float64, error) {
+	samples := []float64{}
+	var err error
+	for i := 0; i < pings; i++ {
+		var d float64
+		if d, err = s.pingAlone(); err == nil {
+			samples = append(samples, d)
+		}
+	}
+	if len(samples) == 0 {
+		return 0, err
+	}
+	return filterDistance(samples, pings)
+}
+
+// usesGPIO reports whether any of the spots' hardware is connected to the
+// GPIO pins
+func usesGPIO(cfg *monitorConfig) bool {
+	for _, s := range cfg.Spots {
+		if s.Simulate == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// initHardware sets up the hardware of the spots, connected to the GPIO
+// pins, which must be open if any is, or simulated
+func initHardware(cfg *monitorConfig) (*hardware, error) {
+	hw := &hardware{blue: &simLED{name: "blue"}}
+	if usesGPIO(cfg) {
+		hw.blue = newGPIOLED(cfg.BluePin)
+	}
+
+	for _, s := range cfg.Spots {
+		if s.Simulate != "" {
+			profile, err := parseProfile(s.Simulate)
+			if err != nil {
+				return nil, err
+			}
+			hw.spots = append(hw.spots, &spotHardware{
+				number: s.Number,
+				sensor: newSimSensor(profile),
+				red:    &simLED{name: fmt.Sprintf("#%d red", s.Number)},
+				green:  &simLED{name: fmt.Sprintf("#%d green", s.Number)},
+			})
+			continue
+		}
+		hw.spots = append(hw.spots, &spotHardware{
+			number: s.Number,
+			sensor: newHCSR04(s.TriggerPin, s.EchoPin),
+			red:    newGPIOLED(s.RedPin),
+			green:  newGPIOLED(s.GreenPin),
+		})
+	}
+	return hw, nil
+}
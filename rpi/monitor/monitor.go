@@ -1,16 +1,17 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"flag"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/stianeikeland/go-rpio"
@@ -23,82 +24,64 @@ type (
 	// Mode of device execution
 	Mode int
 
+	// actionMsgParams is the update of a spot; the sequence grows with
+	// every update, so that the server can tell retried updates apart
 	actionMsgParams struct {
-		Number int    `json:"number"`
-		Label  string `json:"label"`
-		Taken  bool   `json:"taken"`
+		Number     int        `json:"number"`
+		Label      string     `json:"label"`
+		Taken      bool       `json:"taken"`
+		Fault      bool       `json:"fault,omitempty"`
+		ObservedAt *time.Time `json:"observed_at,omitempty"`
+		Sequence   uint64     `json:"sequence,omitempty"`
 	}
 
 	actionMsg struct {
 		Action string            `json:"action"`
 		Params []actionMsgParams `json:"params"`
 	}
+
+	// spotUpdate is the state of a parking spot to send to the server, and
+	// when it was observed
+	spotUpdate struct {
+		number     int
+		state      State
+		observedAt time.Time
+	}
 )
 
 const (
-	bcmPinLEDRed        = 25
-	bcmPinLEDGreen      = 12
-	bcmPinLEDBlue       = 16
-	bcmPinHCSR04Trigger = 17
-	bcmPinHCSR04Echo    = 4
-	sTaken              = State(0)
-	sFree               = State(1)
-	mNormal             = Mode(0)
-	mPanic              = Mode(1)
+	sTaken  = State(0)
+	sFree   = State(1)
+	sFault  = State(2)
+	mNormal = Mode(0)
+	mPanic  = Mode(1)
 )
 
 var (
-	redLED            rpio.Pin
-	greenLED          rpio.Pin
-	blueLED           rpio.Pin
-	hcsr04Trigger     rpio.Pin
-	hcsr04Echo        rpio.Pin
+	// tick is the time between two distance samples, and the unit of all
+	// intervals
+	tick = time.Second
+
+	// batchWindow is how long updates of other spots are waited for, to be
+	// sent together with the first one
+	batchWindow = 100 * time.Millisecond
+
+	// replayBatch is the number of queued updates sent at once
+	replayBatch = 50
+
 	maxNoupdateIntrvl int32
 	panicCh           = make(chan struct{})
 	nopanicCh         = make(chan struct{})
-	httpReqCh         = make(chan State, 16)
+	httpReqCh         = make(chan spotUpdate, 16)
 )
 
-func initGPIO() {
-	redLED = rpio.Pin(bcmPinLEDRed)
-	redLED.Output()
-
-	greenLED = rpio.Pin(bcmPinLEDGreen)
-	greenLED.Output()
-
-	blueLED = rpio.Pin(bcmPinLEDBlue)
-	blueLED.Output()
-
-	hcsr04Trigger = rpio.Pin(bcmPinHCSR04Trigger)
-	hcsr04Trigger.Output()
-
-	hcsr04Echo = rpio.Pin(bcmPinHCSR04Echo)
-	hcsr04Echo.Input()
-
-	hcsr04Trigger.Low()
-	time.Sleep(2 * time.Second)
-}
-
-func cmdistance() float64 {
-	var pulseStart, pulseEnd time.Time
-	hcsr04Trigger.High()
-	time.Sleep(100 * time.Microsecond)
-	hcsr04Trigger.Low()
-	time.Now()
-	for hcsr04Echo.Read() == rpio.Low {
-		pulseStart = time.Now()
-	}
-	for hcsr04Echo.Read() == rpio.High {
-		pulseEnd = time.Now()
-	}
-	duration := pulseEnd.Sub(pulseStart)
-	return duration.Seconds() * 17150.0
-}
-
-func modeController(quit chan struct{}, heartbeatIntrvl, discoveryIntrvl int) {
-	blueLED.High()
+// modeController shows the mode on the blue LED, and sets the interval of the
+// updates sent without a change of state: heartbeats in the normal mode, or
+// the discovery interval in the panic mode
+func modeController(quit chan struct{}, hw *hardware) {
+	hw.blue.on()
 	mode := mNormal
-	atomic.StoreInt32(&maxNoupdateIntrvl, int32(heartbeatIntrvl))
+	atomic.StoreInt32(&maxNoupdateIntrvl, int32(getTuning().HeartbeatIntrvl))
 	wg := sync.WaitGroup{}
 	ch := make(chan struct{})
 	for {
@@ -114,213 +97,606 @@ func modeController(quit chan struct{}, heartbeatIntrvl, discoveryIntrvl int) {
 					case <-ch:
 						wg.Done()
 						return
-					case <-time.After(time.Second / 2):
-						blueLED.Toggle()
+					case <-time.After(tick / 2):
+						hw.blue.toggle()
 					}
 				}
 			}()
 			mode = mPanic
-			atomic.StoreInt32(&maxNoupdateIntrvl, int32(discoveryIntrvl))
+			recordMode(mode)
+			atomic.StoreInt32(&maxNoupdateIntrvl, int32(getTuning().DiscoveryIntrvl))
 		case <-nopanicCh:
 			if mode == mNormal {
 				continue
 			}
 			ch <- struct{}{}
 			wg.Wait()
-			blueLED.High()
+			hw.blue.on()
 			mode = mNormal
-			atomic.StoreInt32(&maxNoupdateIntrvl, int32(heartbeatIntrvl))
+			recordMode(mode)
+			atomic.StoreInt32(&maxNoupdateIntrvl, int32(getTuning().HeartbeatIntrvl))
+		case <-retuneCh:
+			if mode == mPanic {
+				atomic.StoreInt32(&maxNoupdateIntrvl, int32(getTuning().DiscoveryIntrvl))
+			} else {
+				atomic.StoreInt32(&maxNoupdateIntrvl, int32(getTuning().HeartbeatIntrvl))
+			}
 		case <-quit:
 			if mode == mPanic {
 				ch <- struct{}{}
 				wg.Wait()
 			}
-			blueLED.Low()
+			hw.blue.off()
 			return
 		}
 	}
 }
 
-func httpRunner(quit chan struct{}, url string, number int, label string) {
-	httpclient := &http.Client{}
-	actionMsg := actionMsg{Action: "update", Params: []actionMsgParams{actionMsgParams{Number: number, Label: label}}}
+// httpRunner sends the updates of the spots to the server, as bulk updates of
+// all the spots updated within the batch window. Updates which cannot be sent
+// are queued, and sent before any newer update once the server is reachable.
+// Failed requests are retried with exponential backoff, during which newer
+// updates are only queued; the mode controller is told when sending starts or
+// stops failing.
+func httpRunner(quit chan struct{}, url string, spots []spotConfig, queue *updateQueue) {
+	httpclient := newHTTPClient()
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	labels := make(map[int]string)
+	for _, s := range spots {
+		labels[s.Number] = s.Label
+	}
+	// Starting from the time [us] keeps the sequence growing across restarts
+	sequence := uint64(time.Now().UnixNano() / int64(time.Microsecond))
 
+	var (
+		failures int
+		retry    <-chan time.Time
+	)
 	for {
+		var err error
 		select {
-		case state := <-httpReqCh:
-			actionMsg.Params[0].Taken = state == sTaken
-			reqBody, err := json.Marshal(actionMsg)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%v\n", err.Error())
-				continue
+		case update := <-httpReqCh:
+			// Only the latest state of a spot updated more than once is sent
+			batch := map[int]spotUpdate{update.number: update}
+			timeout := time.After(batchWindow)
+		collect:
+			for {
+				select {
+				case update = <-httpReqCh:
+					batch[update.number] = update
+				case <-timeout:
+					break collect
+				}
+			}
+
+			// Updates of spots removed by a reload may be left over from
+			// the previous runner
+			params := []actionMsgParams{}
+			for number, update := range batch {
+				label, known := labels[number]
+				if !known {
+					continue
+				}
+				observedAt := update.observedAt
+				params = append(params, actionMsgParams{
+					Number:     number,
+					Label:      label,
+					Taken:      update.state == sTaken,
+					Fault:      update.state == sFault,
+					ObservedAt: &observedAt,
+				})
 			}
-			req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(reqBody))
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%v\n", err.Error())
+			if len(params) == 0 {
 				continue
 			}
-			resp, err := httpclient.Do(req)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%v\n", err.Error())
-				panicCh <- struct{}{}
+			sort.Slice(params, func(i, j int) bool { return params[i].Number < params[j].Number })
+			for i := range params {
+				sequence++
+				params[i].Sequence = sequence
+			}
+
+			if failures > 0 {
+				pushQueue(queue, params)
+				recordQueued(queue.len())
 				continue
 			}
-			resp.Body.Close()
-			nopanicCh <- struct{}{}
+			if queue.len() == 0 {
+				if err = postUpdate(httpclient, url, params); err != nil {
+					if _, rejected := err.(*rejectedError); rejected {
+						fmt.Fprintf(os.Stderr, "%v\n", err)
+						err = nil
+					} else {
+						pushQueue(queue, params)
+					}
+				}
+			} else {
+				pushQueue(queue, params)
+				err = replay(httpclient, url, queue)
+			}
+		case <-retry:
+			err = replay(httpclient, url, queue)
 		case <-quit:
 			return
 		}
+		recordQueued(queue.len())
+
+		if err != nil {
+			failures++
+			delay := backoff(failures, random)
+			fmt.Fprintf(os.Stderr, "%v, retrying in %v\n", err, delay.Round(time.Millisecond))
+			retry = time.After(delay)
+			if failures == 1 {
+				panicCh <- struct{}{}
+			}
+		} else if failures > 0 {
+			failures, retry = 0, nil
+			nopanicCh <- struct{}{}
+		}
 	}
 }
 
-func stateController(quit chan struct{}, maxdist float64, stateUpdateIntrvl int) {
-	greenLED.High()
-	state := sFree
-	var newstate State
+func pushQueue(queue *updateQueue, params []actionMsgParams) {
+	if err := queue.push(params); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save update queue: %v\n", err)
+	}
+}
+
+// stateController watches the spot, which is taken when a car is within the
+// taken ratio of the distance [cm] to the empty spot. A sensor which fails to
+// measure the distance for as long as a state must last to change puts the
+// spot in the fault state, shown with both LEDs on. The first state is sent
+// once measured, so that restarting the controller, e.g. on reload, does not
+// report taken spots as free.
+func stateController(quit chan struct{}, hw *spotHardware, baseline float64) {
+	var state, newstate State
+	var sensorErr error
 	sinceLastChange := 0
 	sinceLastUpdate := 0
-	httpReqCh <- state
+	heartbeats := atomic.LoadUint32(&forcedHeartbeats)
+
+	measure := func(t tuning) (float64, error) {
+		dist, err := hw.sensor.distance()
+		switch {
+		case err != nil:
+			newstate = sFault
+			sensorErr = err
+			hw.red.on()
+			hw.green.on()
+		case dist > baseline*t.TakenRatio:
+			newstate = sFree
+			hw.red.off()
+			hw.green.on()
+		default:
+			newstate = sTaken
+			hw.red.on()
+			hw.green.off()
+		}
+		return dist, err
+	}
+
+	// A failing sensor is measured again for as long as a state must last
+	for faults := 1; ; faults++ {
+		select {
+		case <-time.After(tick):
+		case <-quit:
+			hw.red.off()
+			hw.green.off()
+			return
+		}
+		t := getTuning()
+		dist, err := measure(t)
+		recordMeasurement(hw.number, dist, err, newstate, newstate)
+		if newstate != sFault || faults >= t.StateUpdateIntrvl {
+			break
+		}
+	}
+	if newstate == sFault {
+		fmt.Fprintf(os.Stderr, "spot #%d sensor fault: %v\n", hw.number, sensorErr)
+	}
+	state = newstate
+	httpReqCh <- spotUpdate{hw.number, state, time.Now()}
 
 	for {
 		select {
-		case <-time.After(time.Second):
-			if dist := cmdistance(); dist > maxdist {
-				newstate = sFree
-				redLED.Low()
-				greenLED.High()
-			} else {
-				newstate = sTaken
-				redLED.High()
-				greenLED.Low()
-			}
+		case <-time.After(tick):
+			t := getTuning()
+			dist, err := measure(t)
 
 			sinceLastUpdate++
 			if state != newstate {
 				sinceLastChange++
-				if sinceLastChange == stateUpdateIntrvl {
-					state = newstate
-					sinceLastChange = 0
-					sinceLastUpdate = 0
-					httpReqCh <- state
-					continue
-				}
 			} else {
 				sinceLastChange = 0
 			}
 
-			if int32(sinceLastUpdate) >= atomic.LoadInt32(&maxNoupdateIntrvl) {
+			forced := atomic.LoadUint32(&forcedHeartbeats)
+			if state != newstate && sinceLastChange >= t.StateUpdateIntrvl {
+				if newstate == sFault {
+					fmt.Fprintf(os.Stderr, "spot #%d sensor fault: %v\n", hw.number, sensorErr)
+				} else if state == sFault {
+					fmt.Fprintf(os.Stderr, "spot #%d sensor recovered\n", hw.number)
+				}
+				state = newstate
+				sinceLastChange = 0
+				sinceLastUpdate = 0
+				heartbeats = forced
+				httpReqCh <- spotUpdate{hw.number, state, time.Now()}
+			} else if int32(sinceLastUpdate) >= atomic.LoadInt32(&maxNoupdateIntrvl) || forced != heartbeats {
 				sinceLastUpdate = 0
-				httpReqCh <- state
+				heartbeats = forced
+				httpReqCh <- spotUpdate{hw.number, state, time.Now()}
 			}
+			recordMeasurement(hw.number, dist, err, newstate, state)
 		case <-quit:
-			redLED.Low()
-			greenLED.Low()
+			hw.red.off()
+			hw.green.off()
 			return
 		}
 	}
 }
 
-func disconnect(url string, number int) {
-	httpclient := &http.Client{}
-	actionMsg := actionMsg{Action: "disconnect", Params: []actionMsgParams{actionMsgParams{Number: number}}}
-	reqBody, err := json.Marshal(actionMsg)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to disconnect: %v\n", err.Error())
-		return
+type (
+	// options are the flags the monitor is started with
+	options struct {
+		url             string
+		label           string
+		number          int
+		id              string
+		local           tuning
+		simulate        string
+		conffile        string
+		queuefile       string
+		calfile         string
+		statusAddr      string
+		regfile         string
+		token           string
+		calibrationMode bool
 	}
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(reqBody))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to disconnect: %v\n", err.Error())
-		return
+
+	// settings are what the monitor runs with, from the flags, the config
+	// file and the registration, loaded again on SIGHUP
+	settings struct {
+		cfg        monitorConfig
+		url        string
+		id         string
+		queuefile  string
+		calfile    string
+		statusAddr string
+
+		// The credentials of the registered monitor
+		deviceID     string
+		deviceSecret string
+	}
+
+	// workers are the goroutines of the running monitor
+	workers struct {
+		wg        sync.WaitGroup
+		quitM     chan struct{}
+		quitS     []chan struct{}
+		quitH     chan struct{}
+		quitC     chan struct{}
+		statusSrv *http.Server
+	}
+)
+
+// load reads the config file and the registration, registering the monitor
+// first if a provisioning token is given
+func load(opts *options, token string) (*settings, error) {
+	s := &settings{
+		url:        opts.url,
+		id:         opts.id,
+		queuefile:  opts.queuefile,
+		calfile:    opts.calfile,
+		statusAddr: opts.statusAddr,
+	}
+	regfile := opts.regfile
+
+	if opts.conffile != "" {
+		cfg, err := readConfig(opts.conffile)
+		if err != nil {
+			return nil, err
+		}
+		s.cfg = cfg
+		if cfg.URL != "" {
+			s.url = cfg.URL
+		}
+	} else {
+		s.cfg = defaultConfig(opts.url, opts.number, opts.label, opts.simulate)
+	}
+
+	if s.cfg.QueueFile != "" {
+		s.queuefile = s.cfg.QueueFile
+	}
+	if s.cfg.CalibrationFile != "" {
+		s.calfile = s.cfg.CalibrationFile
+	}
+	if s.cfg.StatusAddr != "" {
+		s.statusAddr = s.cfg.StatusAddr
 	}
-	resp, err := httpclient.Do(req)
+	if s.cfg.RegistrationFile != "" {
+		regfile = s.cfg.RegistrationFile
+	}
+
+	if !strings.HasPrefix(s.url, "http://") {
+		s.url = "http://" + s.url
+	}
+
+	if s.cfg.ID != "" {
+		s.id = s.cfg.ID
+	}
+	if s.id == "" {
+		s.id, _ = os.Hostname()
+	}
+
+	// The registration numbers and labels the spots, and sets the section
+	// they are in, unlike the flags and the config file
+	reg, err := readRegistration(regfile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to disconnect: %v\n", err.Error())
-		return
+		return nil, err
+	}
+	if token != "" {
+		if reg, err = register(newHTTPClient(), s.url, s.id, token, len(s.cfg.Spots), reg); err != nil {
+			return nil, fmt.Errorf("registration failed: %v", err)
+		}
+		if err = reg.save(regfile); err != nil {
+			return nil, err
+		}
+		for _, spot := range reg.Spots {
+			fmt.Printf("registered as %s for spot #%d (%s) of section %s\n", reg.DeviceID, spot.Number, spot.Label, reg.SectionName)
+		}
+	}
+	if reg != nil {
+		if err = reg.apply(&s.cfg); err != nil {
+			return nil, fmt.Errorf("registration file %s: %v", regfile, err)
+		}
+		s.url = reg.actionsURL(s.url)
+		s.deviceID, s.deviceSecret = reg.DeviceID, reg.Secret
+	}
+	if err = validConfig(&s.cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
 	}
-	resp.Body.Close()
+	return s, nil
 }
 
-func main() {
-	var (
-		url               string
-		label             string
-		maxdist           float64
-		number            int
-		heartbeatIntrvl   int
-		discoveryIntrvl   int
-		stateUpdateIntrvl int
-		wg                sync.WaitGroup
-	)
+// start runs the controllers of the hardware, the updates of the server, the
+// configuration poller and the status server
+func start(s *settings, hw *hardware, cal calibration, queue *updateQueue, local tuning) *workers {
+	deviceID, deviceSecret = s.deviceID, s.deviceSecret
+	w := &workers{
+		quitM: make(chan struct{}),
+		quitS: make([]chan struct{}, len(hw.spots)),
+		quitH: make(chan struct{}),
+		quitC: make(chan struct{}),
+	}
 
-	flag.StringVar(&url, "url", "http://localhost:8000/", "Spot service API endpoint")
-	flag.IntVar(&number, "number", 0, "Parking spot number")
-	flag.StringVar(&label, "label", "", "Parking spot label")
-	flag.Float64Var(&maxdist, "maxdist", 200.0, "Maximal valid distance [cm]")
-	flag.IntVar(&heartbeatIntrvl, "heartbeatintrvl", 900, "Heartbeat interval [s]")
-	flag.IntVar(&discoveryIntrvl, "discoveryintrvl", 30, "Server discovery interval [s]")
-	flag.IntVar(&stateUpdateIntrvl, "stateupdateintrvl", 5, "Change state interval [s]")
-	flag.Parse()
+	w.wg.Add(1)
+	go func() {
+		modeController(w.quitM, hw)
+		w.wg.Done()
+	}()
+
+	for i, spot := range hw.spots {
+		w.wg.Add(1)
+		w.quitS[i] = make(chan struct{})
+		go func(quit chan struct{}, spot *spotHardware) {
+			stateController(quit, spot, cal.baseline(spot.number))
+			w.wg.Done()
+		}(w.quitS[i], spot)
+	}
+
+	w.wg.Add(1)
+	go func() {
+		httpRunner(w.quitH, s.url, s.cfg.Spots, queue)
+		w.wg.Done()
+	}()
+
+	// The configuration is polled unless there is no server API to poll
+	if configURL := deviceConfigURL(s.url, s.id); configURL != "" {
+		w.wg.Add(1)
+		go func() {
+			configPoller(w.quitC, configURL, local)
+			w.wg.Done()
+		}()
+	}
+
+	if s.statusAddr != "" {
+		w.statusSrv = &http.Server{Addr: s.statusAddr, Handler: statusHandler()}
+		go func(srv *http.Server) {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				fmt.Fprintf(os.Stderr, "status server: %v\n", err)
+			}
+		}(w.statusSrv)
+	}
+	return w
+}
 
-	if !strings.HasPrefix(url, "http://") {
-		url = "http://" + url
+// stop stops the workers and waits for them, turning off the LEDs. Each
+// worker is stopped before the one it sends to, the state controllers before
+// the HTTP runner and the HTTP runner before the mode controller, so that
+// none of them is stuck sending to a stopped one.
+func (w *workers) stop() {
+	for _, quit := range w.quitS {
+		quit <- struct{}{}
 	}
+	w.quitH <- struct{}{}
+	w.quitM <- struct{}{}
+	close(w.quitC)
+	w.wg.Wait()
+	if w.statusSrv != nil {
+		w.statusSrv.Close()
+	}
+}
 
-	if maxdist < 2.0 || maxdist > 400.0 {
-		maxdist = 200.0
-		fmt.Fprintf(os.Stderr, "maxdist not in range [2.0, 400.0], defaulting to 200.0cm")
+// removedSpots returns the spots of the old settings which the new ones do
+// not update any more
+func removedSpots(old *settings, new *settings) []spotConfig {
+	if old.url != new.url {
+		return old.cfg.Spots
 	}
+	kept := make(map[int]bool)
+	for _, s := range new.cfg.Spots {
+		kept[s.Number] = true
+	}
+	removed := []spotConfig{}
+	for _, s := range old.cfg.Spots {
+		if !kept[s.Number] {
+			removed = append(removed, s)
+		}
+	}
+	return removed
+}
 
-	if heartbeatIntrvl < 1 {
-		heartbeatIntrvl = 900
+func main() {
+	var opts options
+
+	flag.StringVar(&opts.url, "url", "http://localhost:8000/", "Spot service API endpoint")
+	flag.IntVar(&opts.number, "number", 0, "Parking spot number")
+	flag.StringVar(&opts.label, "label", "", "Parking spot label")
+	flag.StringVar(&opts.id, "id", "", "Device ID of the configuration on the server (host name if empty)")
+	flag.IntVar(&opts.local.HeartbeatIntrvl, "heartbeatintrvl", 900, "Heartbeat interval [s]")
+	flag.IntVar(&opts.local.DiscoveryIntrvl, "discoveryintrvl", 30, "Server discovery interval [s]")
+	flag.IntVar(&opts.local.StateUpdateIntrvl, "stateupdateintrvl", 5, "Change state interval [s]")
+	flag.Float64Var(&opts.local.TakenRatio, "takenratio", defaultTakenRatio, "Part of the distance to the empty spot within which the spot is taken")
+	flag.StringVar(&opts.conffile, "config", "", "Config file listing the parking spots, instead of -number, -label and -simulate")
+	flag.StringVar(&opts.queuefile, "queue", "monitor.queue", "File keeping updates not sent yet (none if empty)")
+	flag.StringVar(&opts.calfile, "calibration", "monitor.calibration", "File keeping the distances to the empty spots")
+	flag.StringVar(&opts.statusAddr, "status", "", "Address of the local status server, e.g. :8080 (none if empty)")
+	flag.StringVar(&opts.regfile, "registration", "monitor.registration", "File keeping the spots the monitor is registered for")
+	flag.StringVar(&opts.token, "register", "", "Provisioning token to register the monitor with, getting its spots assigned")
+	flag.BoolVar(&opts.calibrationMode, "calibrate", false, "Measure the distances to the empty spots, save them and exit")
+	flag.StringVar(&opts.simulate, "simulate", "", "Simulate the hardware, measuring a distance profile, e.g. 250:10,40:60 [cm:s,...]")
+	flag.Parse()
+
+	s, err := load(&opts, opts.token)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+
+	local := opts.local
+	if local.HeartbeatIntrvl < 1 {
+		local.HeartbeatIntrvl = 900
 		fmt.Fprintf(os.Stderr, "invalid heartbeatintrvl value, defaulting to 900s")
 	}
 
-	if discoveryIntrvl < 1 {
-		discoveryIntrvl = 30
+	if local.DiscoveryIntrvl < 1 {
+		local.DiscoveryIntrvl = 30
 		fmt.Fprintf(os.Stderr, "invalid discoveryintrvl value, defaulting to 30s")
 	}
 
-	if stateUpdateIntrvl < 1 {
-		stateUpdateIntrvl = 5
+	if local.StateUpdateIntrvl < 1 {
+		local.StateUpdateIntrvl = 5
 		fmt.Fprintf(os.Stderr, "invalid stateupdateintrvl value, defaulting to 5s")
 	}
 
-	err := rpio.Open()
+	if local.TakenRatio <= 0 || local.TakenRatio >= 1 {
+		local.TakenRatio = defaultTakenRatio
+		fmt.Fprintf(os.Stderr, "takenratio not in range (0, 1), defaulting to %v", defaultTakenRatio)
+	}
+	setTuning(local)
+
+	// GPIO stays open across reloads, and is opened by the first reload
+	// which needs it
+	gpioOpen := false
+	openGPIO := func(cfg *monitorConfig) {
+		if !gpioOpen && usesGPIO(cfg) {
+			if err := rpio.Open(); err != nil {
+				panic("failed to open GPIO: " + err.Error())
+			}
+			gpioOpen = true
+		}
+	}
+	defer func() {
+		if gpioOpen {
+			rpio.Close()
+		}
+	}()
+
+	// initialize sets up the hardware, and reads the calibration and the
+	// queue of the settings
+	initialize := func(s *settings) (hw *hardware, cal calibration, queue *updateQueue, err error) {
+		openGPIO(&s.cfg)
+		if hw, err = initHardware(&s.cfg); err != nil {
+			return
+		}
+		if cal, err = readCalibration(s.calfile); err != nil {
+			return
+		}
+		queue, err = openQueue(s.queuefile)
+		return
+	}
+
+	hw, cal, queue, err := initialize(s)
 	if err != nil {
-		panic("failed to open GPIO: " + err.Error())
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
 	}
-	defer rpio.Close()
-	initGPIO()
 
-	wg.Add(1)
-	quitM := make(chan struct{})
-	go func() {
-		modeController(quitM, heartbeatIntrvl, discoveryIntrvl)
-		wg.Done()
-	}()
+	if opts.calibrationMode {
+		measured, err := calibrate(hw.spots, calibrationSamples)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "calibration failed: %v\n", err)
+			os.Exit(1)
+		}
+		for _, spot := range hw.spots {
+			cal[spot.number] = measured[spot.number]
+			fmt.Printf("spot #%d: %.1fcm to the empty spot\n", spot.number, measured[spot.number])
+		}
+		if err = cal.save(s.calfile); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	wg.Add(1)
-	quitS := make(chan struct{})
-	go func() {
-		stateController(quitS, maxdist, stateUpdateIntrvl)
-		wg.Done()
-	}()
+	w := start(s, hw, cal, queue, local)
+
+	// SIGHUP restarts the monitor with the config file and the registration
+	// read again, and restarts it as it was if they fail to load. The
+	// workers are stopped first, as the hardware and the queue file cannot
+	// be shared with the new ones.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		fmt.Println("reloading the configuration")
+		next, err := load(&opts, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reload failed: %v\n", err)
+			continue
+		}
 
-	wg.Add(1)
-	quitH := make(chan struct{})
-	go func() {
-		httpRunner(quitH, url, number, label)
-		wg.Done()
-	}()
+		w.stop()
+		nextHW, nextCal, nextQueue, err := initialize(next)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reload failed: %v\n", err)
+			next = s
+			if nextHW, nextCal, nextQueue, err = initialize(s); err != nil {
+				fmt.Fprintf(os.Stderr, "restart failed: %v\n", err)
+				if err = disconnect(s.url, s.cfg.Spots); err != nil {
+					fmt.Fprintf(os.Stderr, "failed to disconnect: %v\n", err)
+				}
+				os.Exit(1)
+			}
+		}
 
-	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, os.Interrupt)
-	<-sigint
-	quitM <- struct{}{}
-	quitS <- struct{}{}
-	quitH <- struct{}{}
-	wg.Wait()
+		// Queued updates of the removed spots would be sent to the server of
+		// the new settings, or without the spots' labels
+		removed := removedSpots(s, next)
+		if err = nextQueue.drop(removed); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to save update queue: %v\n", err)
+		}
+		if err = disconnect(s.url, removed); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to disconnect: %v\n", err)
+		}
+		s = next
+		w = start(s, nextHW, nextCal, nextQueue, local)
+	}
 
-	disconnect(url, number)
+	w.stop()
+	if err = disconnect(s.url, s.cfg.Spots); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to disconnect: %v\n", err)
+	}
 }
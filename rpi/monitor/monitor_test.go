@@ -0,0 +1,942 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	tick = time.Millisecond
+	requestTimeout = 50 * time.Millisecond
+	backoffMin = 5 * time.Millisecond
+	backoffMax = 20 * time.Millisecond
+	configPollIntrvl = 5 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+func simSpot(t *testing.T, number int, profile string) *spotHardware {
+	steps, err := parseProfile(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &spotHardware{
+		number: number,
+		red:    &simLED{},
+		green:  &simLED{},
+		sensor: newSimSensor(steps),
+	}
+}
+
+func expectState(t *testing.T, expected State) {
+	select {
+	case update := <-httpReqCh:
+		if update.state != expected {
+			t.Errorf("Unexpected state: %d. Expected: %d", update.state, expected)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("State %d not sent", expected)
+	}
+}
+
+// eventually reports whether the condition is met within a second
+func eventually(cond func() bool) bool {
+	for i := 0; i < 1000; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func drainStates() {
+	for {
+		select {
+		case <-httpReqCh:
+		default:
+			return
+		}
+	}
+}
+
+func TestParseProfile(t *testing.T) {
+	for _, profile := range []string{"", "250", "250:0", "-1:5", "250:5,x:1", "fault"} {
+		if _, err := parseProfile(profile); err == nil {
+			t.Errorf("Profile '%s' accepted", profile)
+		}
+	}
+
+	profile, err := parseProfile("250:2,fault:1,40:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sensor := newSimSensor(profile)
+	expected := []float64{250, 250, -1, 40, 40}
+	for i, e := range expected {
+		d, err := sensor.distance()
+		if e < 0 && err == nil {
+			t.Errorf("Sample %d measured: %v. Expected a fault", i, d)
+		} else if e >= 0 && (err != nil || d != e) {
+			t.Errorf("Unexpected distance of sample %d: %v (%v). Expected: %v", i, d, err, e)
+		}
+	}
+}
+
+func TestFilterDistance(t *testing.T) {
+	for _, c := range []struct {
+		samples  []float64
+		expected float64
+	}{
+		{[]float64{100, 102, 98, 101, 99}, 100},
+		// Echoes of other objects are rejected
+		{[]float64{100, 30, 102, 98, 380}, 100},
+		// Missing samples are fine while the rest are the majority
+		{[]float64{200, 204, 202}, 202},
+	} {
+		if d, err := filterDistance(c.samples, 5); err != nil {
+			t.Errorf("Samples %v: %v", c.samples, err)
+		} else if d != c.expected {
+			t.Errorf("Unexpected distance of samples %v: %v. Expected: %v", c.samples, d, c.expected)
+		}
+	}
+
+	for _, samples := range [][]float64{nil, {100, 102}, {100, 30, 250, 380, 101}} {
+		if d, err := filterDistance(samples, 5); err == nil {
+			t.Errorf("Samples %v measured: %v", samples, d)
+		}
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	spots := []*spotHardware{simSpot(t, 1, "240:5,241:5,900:1,240:100"), simSpot(t, 2, "230:100")}
+	cal, err := calibrate(spots, 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cal[1] != 240 || cal[2] != 230 {
+		t.Errorf("Unexpected calibration: %v", cal)
+	}
+	if baseline := cal.baseline(2); baseline != 230 {
+		t.Errorf("Unexpected baseline: %v", baseline)
+	}
+	if baseline := cal.baseline(3); baseline != defaultBaseline {
+		t.Errorf("Unexpected baseline of a spot not calibrated: %v", baseline)
+	}
+
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "monitor.calibration")
+	if err = cal.save(path); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := readCalibration(path); err != nil {
+		t.Error(err)
+	} else if len(saved) != 2 || saved[1] != 240 || saved[2] != 230 {
+		t.Errorf("Unexpected saved calibration: %v", saved)
+	}
+
+	if _, err = calibrate([]*spotHardware{simSpot(t, 1, "240:5,fault:100")}, 12); err == nil {
+		t.Error("Spot with a faulty sensor calibrated")
+	}
+}
+
+func TestValidConfig(t *testing.T) {
+	cfg := defaultConfig("localhost:8000", 1, "A-1", "")
+	cfg.Spots = append(cfg.Spots, spotConfig{Number: 2, TriggerPin: 5, EchoPin: 6, RedPin: 13, GreenPin: 19})
+	cfg.Spots = append(cfg.Spots, spotConfig{Number: 3, Simulate: "250:10"})
+	if err := validConfig(&cfg); err != nil {
+		t.Error(err)
+	}
+
+	for _, s := range []spotConfig{
+		{Number: 0, Simulate: "250:10"},
+		{Number: 2, Simulate: "250:10"},
+		{Number: 4, Simulate: "250"},
+		{Number: 4, TriggerPin: 20, EchoPin: 21, RedPin: 22, GreenPin: bcmPinLEDBlue},
+		{Number: 4, TriggerPin: 20, EchoPin: 21, RedPin: 22, GreenPin: 28},
+	} {
+		invalid := cfg
+		invalid.Spots = append(append([]spotConfig{}, cfg.Spots...), s)
+		if err := validConfig(&invalid); err == nil {
+			t.Errorf("Spot accepted: %+v", s)
+		}
+	}
+}
+
+func TestStateController(t *testing.T) {
+	drainStates()
+	setTuning(tuning{HeartbeatIntrvl: 1000, DiscoveryIntrvl: 30, StateUpdateIntrvl: 3, TakenRatio: 0.8})
+	atomic.StoreInt32(&maxNoupdateIntrvl, 1000)
+	hw := simSpot(t, 1, "250:2,40:3,250:1,40:1000")
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		stateController(quit, hw, 250)
+		close(done)
+	}()
+
+	// The initial state, then the change which lasted long enough; the
+	// single sample in between is ignored
+	expectState(t, sFree)
+	expectState(t, sTaken)
+	if !hw.red.(*simLED).isOn() || hw.green.(*simLED).isOn() {
+		t.Error("Unexpected LEDs, expected red on and green off")
+	}
+
+	t.Log("Sending heartbeats")
+	atomic.StoreInt32(&maxNoupdateIntrvl, 5)
+	expectState(t, sTaken)
+	drainStates()
+
+	quit <- struct{}{}
+	<-done
+	if hw.red.(*simLED).isOn() || hw.green.(*simLED).isOn() {
+		t.Error("LEDs left on")
+	}
+	drainStates()
+}
+
+func TestStateControllerFault(t *testing.T) {
+	drainStates()
+	setTuning(tuning{HeartbeatIntrvl: 1000, DiscoveryIntrvl: 30, StateUpdateIntrvl: 3, TakenRatio: 0.8})
+	atomic.StoreInt32(&maxNoupdateIntrvl, 1000)
+	hw := simSpot(t, 1, "250:2,fault:3,40:1000")
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		stateController(quit, hw, 250)
+		close(done)
+	}()
+
+	expectState(t, sFree)
+	expectState(t, sFault)
+	expectState(t, sTaken)
+
+	quit <- struct{}{}
+	<-done
+	drainStates()
+}
+
+func TestStateControllerInitial(t *testing.T) {
+	drainStates()
+	setTuning(tuning{HeartbeatIntrvl: 1000, DiscoveryIntrvl: 30, StateUpdateIntrvl: 3, TakenRatio: 0.8})
+	atomic.StoreInt32(&maxNoupdateIntrvl, 1000)
+
+	// The first state sent is the measured one, after a failing sensor is
+	// measured again for as long as a state must last
+	for _, tc := range []struct {
+		profile string
+		state   State
+	}{
+		{"40:1000", sTaken},
+		{"fault:2,40:1000", sTaken},
+		{"fault:1000", sFault},
+	} {
+		hw := simSpot(t, 1, tc.profile)
+		quit := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			stateController(quit, hw, 250)
+			close(done)
+		}()
+
+		expectState(t, tc.state)
+		quit <- struct{}{}
+		<-done
+		drainStates()
+	}
+}
+
+func TestStatusServer(t *testing.T) {
+	drainStates()
+	setTuning(tuning{HeartbeatIntrvl: 1000, DiscoveryIntrvl: 30, StateUpdateIntrvl: 3, TakenRatio: 0.8})
+	atomic.StoreInt32(&maxNoupdateIntrvl, 1000)
+	recordQueued(2)
+	recordResponse("503 Service Unavailable", nil)
+	hw := simSpot(t, 7, "40:1000")
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		stateController(quit, hw, 250)
+		close(done)
+	}()
+	expectState(t, sTaken)
+	recorded := func() bool {
+		for _, spot := range currentStatus().Spots {
+			if spot.Number == 7 && spot.State == "taken" {
+				return true
+			}
+		}
+		return false
+	}
+	if !eventually(recorded) {
+		t.Fatal("Taken state of spot #7 not recorded")
+	}
+
+	srv := httptest.NewServer(statusHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status monitorStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spot *spotStatus
+	for i := range status.Spots {
+		if status.Spots[i].Number == 7 {
+			spot = &status.Spots[i]
+		}
+	}
+	if spot == nil {
+		t.Fatalf("Spot #7 not in status: %+v", status)
+	}
+	if spot.Distance != 40 || spot.MeasuredState != "taken" || spot.State != "taken" {
+		t.Errorf("Unexpected spot status: %+v", *spot)
+	}
+	if status.Queued != 2 || status.LastResponse == nil || status.LastResponse.Status != "503 Service Unavailable" {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+	if status.Tuning.HeartbeatIntrvl != 1000 || status.Tuning.StateUpdateIntrvl != 3 {
+		t.Errorf("Unexpected tuning: %+v", status.Tuning)
+	}
+
+	if resp, err = http.Get(srv.URL + "/heartbeat"); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status of GET /heartbeat: %d", resp.StatusCode)
+	}
+
+	t.Log("Forcing a heartbeat")
+	if resp, err = http.Post(srv.URL+"/heartbeat", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Unexpected status of POST /heartbeat: %d", resp.StatusCode)
+	}
+	expectState(t, sTaken)
+
+	quit <- struct{}{}
+	<-done
+	drainStates()
+	recordQueued(0)
+}
+
+func TestRegister(t *testing.T) {
+	var received []registrationReq
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/garages/0a1b2c3d/sections/4e5f6a7b/actions" {
+			if id, secret, ok := r.BasicAuth(); !ok || id != "pi-1" || secret != "s3cret" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+			return
+		}
+		if r.URL.Path != "/v1/devices/pi-1/registration" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req registrationReq
+		json.NewDecoder(r.Body).Decode(&req)
+		received = append(received, req)
+		if req.Token != "t0ken" {
+			http.Error(w, "invalid provisioning token or device secret", http.StatusUnauthorized)
+			return
+		}
+		reg := registration{
+			DeviceID:    "pi-1",
+			GarageID:    "0a1b2c3d",
+			SectionID:   "4e5f6a7b",
+			SectionName: "A",
+			Spots:       []assignedSpot{{3, "A-3"}, {5, "A-5"}},
+		}
+		status := http.StatusOK
+		if req.Secret == "" {
+			reg.Secret = "s3cret"
+			status = http.StatusCreated
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(reg)
+	}))
+	defer srv.Close()
+
+	client := newHTTPClient()
+	if _, err := register(client, srv.URL+"/", "pi-1", "invalid", 2, nil); err == nil {
+		t.Error("Registered with an invalid token")
+	}
+	reg, err := register(client, srv.URL+"/", "pi-1", "t0ken", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Secret != "s3cret" || len(reg.Spots) != 2 {
+		t.Errorf("Unexpected registration: %+v", reg)
+	}
+
+	// Registering again presents the secret, which the server does not send
+	// back
+	reg, err = register(client, srv.URL+"/v1/garages/x/sections/y/actions", "pi-1", "t0ken", 2, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := received[len(received)-1]; last.Secret != "s3cret" || last.Spots != 2 {
+		t.Errorf("Unexpected registration request: %+v", last)
+	}
+	if reg.Secret != "s3cret" {
+		t.Errorf("Secret lost: %+v", reg)
+	}
+
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "monitor.registration")
+	if stored, err := readRegistration(path); err != nil || stored != nil {
+		t.Errorf("Unexpected registration of a monitor not registered: %+v (%v)", stored, err)
+	}
+	if err = reg.save(path); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := readRegistration(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Secret != "s3cret" || stored.SectionID != "4e5f6a7b" {
+		t.Errorf("Unexpected stored registration: %+v", stored)
+	}
+
+	cfg := defaultConfig(srv.URL, 0, "", "250:10")
+	if err = stored.apply(&cfg); err == nil {
+		t.Error("Registration for 2 spots applied to 1")
+	}
+	cfg.Spots = append(cfg.Spots, spotConfig{Simulate: "250:10"})
+	if err = stored.apply(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Spots[0].Number != 3 || cfg.Spots[1].Label != "A-5" {
+		t.Errorf("Unexpected spots: %+v", cfg.Spots)
+	}
+	if err = validConfig(&cfg); err != nil {
+		t.Error(err)
+	}
+
+	// Updates are sent to the section by ID, with the credentials
+	url := stored.actionsURL(srv.URL + "/")
+	if err = postUpdate(client, url, []actionMsgParams{{Number: 3}}); err == nil {
+		t.Error("Update sent without credentials")
+	}
+	deviceID, deviceSecret = stored.DeviceID, stored.Secret
+	defer func() { deviceID, deviceSecret = "", "" }()
+	if err = postUpdate(client, url, []actionMsgParams{{Number: 3}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	var failing, requests int32
+	var received actionMsg
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.AddInt32(&failing, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/rejected" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path == "/hangs" {
+			time.Sleep(time.Second)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer srv.Close()
+	defer func(timeout time.Duration) { disconnectTimeout = timeout }(disconnectTimeout)
+	disconnectTimeout = 200 * time.Millisecond
+	spots := []spotConfig{{Number: 1}, {Number: 3}}
+
+	t.Log("Retrying failed requests")
+	atomic.StoreInt32(&failing, 2)
+	if err := disconnect(srv.URL, spots); err != nil {
+		t.Error(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Unexpected number of requests: %d. Expected: 3", n)
+	}
+	if received.Action != "disconnect" || len(received.Params) != 2 || received.Params[1].Number != 3 {
+		t.Errorf("Unexpected disconnect: %+v", received)
+	}
+
+	t.Log("Giving up on a rejected request")
+	atomic.StoreInt32(&requests, 0)
+	if err := disconnect(srv.URL+"/rejected", spots); err == nil {
+		t.Error("Rejected disconnect succeeded")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Unexpected number of requests: %d. Expected: 1", n)
+	}
+
+	t.Log("Giving up after the timeout")
+	atomic.StoreInt32(&failing, 1000)
+	started := time.Now()
+	if err := disconnect(srv.URL, spots); err == nil {
+		t.Error("Failed disconnect succeeded")
+	}
+	if elapsed := time.Since(started); elapsed > disconnectTimeout+100*time.Millisecond {
+		t.Errorf("Disconnect took %v", elapsed)
+	}
+
+	t.Log("Cutting a request to a hung server short at the timeout")
+	defer func(timeout time.Duration) { requestTimeout = timeout }(requestTimeout)
+	requestTimeout = 10 * time.Second
+	started = time.Now()
+	if err := disconnect(srv.URL+"/hangs", spots); err == nil {
+		t.Error("Failed disconnect succeeded")
+	}
+	if elapsed := time.Since(started); elapsed > disconnectTimeout+100*time.Millisecond {
+		t.Errorf("Disconnect took %v", elapsed)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conffile := filepath.Join(dir, "monitor.json")
+	writeConfig := func(config string) {
+		if err := ioutil.WriteFile(conffile, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := &options{
+		url:      "localhost:8000/v1/garages/0a1b2c3d/sections/A/actions",
+		id:       "pi-1",
+		conffile: conffile,
+		regfile:  filepath.Join(dir, "monitor.registration"),
+	}
+
+	writeConfig(`{"spots": [{"number": 1, "simulate": "250:10"}, {"number": 2, "simulate": "250:10"}]}`)
+	old, err := load(opts, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.url != "http://"+opts.url || len(old.cfg.Spots) != 2 {
+		t.Errorf("Unexpected settings: %+v", old)
+	}
+
+	writeConfig(`{"spots": [{"number": 0, "simulate": "250:10"}]}`)
+	if _, err = load(opts, ""); err == nil {
+		t.Error("Invalid configuration loaded")
+	}
+
+	writeConfig(`{"spots": [{"number": 2, "simulate": "250:10"}, {"number": 4, "simulate": "250:10"}]}`)
+	next, err := load(opts, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed := removedSpots(old, next); len(removed) != 1 || removed[0].Number != 1 {
+		t.Errorf("Unexpected removed spots: %+v", removed)
+	}
+
+	// Spots moved to another section are all removed from the former one
+	writeConfig(`{"url": "localhost:8000/v1/garages/0a1b2c3d/sections/B/actions", "spots": [{"number": 2, "simulate": "250:10"}]}`)
+	if next, err = load(opts, ""); err != nil {
+		t.Fatal(err)
+	}
+	if removed := removedSpots(old, next); len(removed) != 2 {
+		t.Errorf("Unexpected removed spots: %+v", removed)
+	}
+}
+
+func TestStop(t *testing.T) {
+	// The first update fails only once the workers are being stopped
+	requested := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		time.Sleep(2 * requestTimeout)
+	}))
+	defer srv.Close()
+	defer recordMode(mNormal)
+	setTuning(tuning{HeartbeatIntrvl: 900, DiscoveryIntrvl: 30, StateUpdateIntrvl: 3, TakenRatio: 0.8})
+
+	s := &settings{url: srv.URL, cfg: monitorConfig{Spots: []spotConfig{{Number: 1, Label: "A-1"}}}}
+	hw := &hardware{blue: &simLED{}, spots: []*spotHardware{simSpot(t, 1, "250:10")}}
+	w := start(s, hw, calibration{1: 250}, &updateQueue{}, tuning{})
+	select {
+	case <-requested:
+	case <-time.After(time.Second):
+		t.Fatal("Update not sent")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		w.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Workers not stopped")
+	}
+	drainStates()
+}
+
+func TestModeController(t *testing.T) {
+	blue := &simLED{}
+	hw := &hardware{blue: blue}
+	setTuning(tuning{HeartbeatIntrvl: 900, DiscoveryIntrvl: 30, StateUpdateIntrvl: 3, TakenRatio: 0.8})
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		modeController(quit, hw)
+		close(done)
+	}()
+
+	panicCh <- struct{}{}
+	if !eventually(func() bool { return !blue.isOn() }) {
+		t.Error("Blue LED not blinking in panic mode")
+	}
+	if !eventually(func() bool { return atomic.LoadInt32(&maxNoupdateIntrvl) == 30 }) {
+		t.Error("Update interval not set to discovery interval in panic mode")
+	}
+
+	nopanicCh <- struct{}{}
+	if !eventually(func() bool { return atomic.LoadInt32(&maxNoupdateIntrvl) == 900 }) {
+		t.Error("Update interval not set to heartbeat interval in normal mode")
+	}
+	if !blue.isOn() {
+		t.Error("Blue LED not on in normal mode")
+	}
+
+	setTuning(tuning{HeartbeatIntrvl: 600, DiscoveryIntrvl: 30, StateUpdateIntrvl: 3, TakenRatio: 0.8})
+	if !eventually(func() bool { return atomic.LoadInt32(&maxNoupdateIntrvl) == 600 }) {
+		t.Error("Update interval not retuned")
+	}
+
+	quit <- struct{}{}
+	<-done
+	if blue.isOn() {
+		t.Error("Blue LED left on")
+	}
+}
+
+func TestConfigPoller(t *testing.T) {
+	// The server's configuration, if set, changes the heartbeat interval and
+	// the taken ratio
+	config := int32(0)
+	polls := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&polls, 1)
+		if r.URL.Path != "/v1/devices/pi-1/config" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		c := atomic.LoadInt32(&config)
+		if c == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		tag := fmt.Sprintf(`"%d"`, c)
+		if r.Header.Get("If-None-Match") == tag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", tag)
+		fmt.Fprintf(w, `{"id": "pi-1", "heartbeat_interval": %d, "taken_ratio": 0.5}`, c)
+	}))
+	defer server.Close()
+
+	url := deviceConfigURL(server.URL+"/v1/garages/0123abcd/sections/A/actions", "pi-1")
+	local := tuning{HeartbeatIntrvl: 900, DiscoveryIntrvl: 30, StateUpdateIntrvl: 5, TakenRatio: 0.8}
+	setTuning(local)
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		configPoller(quit, url, local)
+		close(done)
+	}()
+
+	atomic.StoreInt32(&config, 60)
+	expected := tuning{HeartbeatIntrvl: 60, DiscoveryIntrvl: 30, StateUpdateIntrvl: 5, TakenRatio: 0.5}
+	if !eventually(func() bool { return getTuning() == expected }) {
+		t.Errorf("Unexpected tuning: %+v. Expected: %+v", getTuning(), expected)
+	}
+
+	t.Log("Removing the configuration from the server")
+	atomic.StoreInt32(&config, 0)
+	if !eventually(func() bool { return getTuning() == local }) {
+		t.Errorf("Unexpected tuning: %+v. Expected: %+v", getTuning(), local)
+	}
+
+	close(quit)
+	<-done
+	if atomic.LoadInt32(&polls) < 2 {
+		t.Error("Configuration not polled")
+	}
+}
+
+// expectMode waits for the HTTP runner to report the mode, or to report none
+// if the mode is unchanged
+func expectMode(t *testing.T, expected Mode, changed bool) {
+	timeout := time.Second
+	if !changed {
+		timeout = 100 * time.Millisecond
+	}
+	select {
+	case <-nopanicCh:
+		if !changed || expected != mNormal {
+			t.Error("Unexpected normal mode")
+		}
+	case <-panicCh:
+		if !changed || expected != mPanic {
+			t.Error("Unexpected panic mode")
+		}
+	case <-time.After(timeout):
+		if changed {
+			t.Error("Mode not reported")
+		}
+	}
+}
+
+func expectParams(t *testing.T, params []actionMsgParams, expected ...actionMsgParams) {
+	if len(params) != len(expected) {
+		t.Errorf("Unexpected number of params: %d. Expected: %d", len(params), len(expected))
+		return
+	}
+	for i, p := range params {
+		if p.Number != expected[i].Number || p.Label != expected[i].Label || p.Taken != expected[i].Taken || p.ObservedAt == nil {
+			t.Errorf("Unexpected params: %+v. Expected: %+v", p, expected[i])
+		}
+		if i > 0 && p.Sequence <= params[i-1].Sequence {
+			t.Errorf("Sequence %d not greater than previous sequence %d", p.Sequence, params[i-1].Sequence)
+		}
+	}
+}
+
+func expectReceived(t *testing.T, received chan actionMsg) actionMsg {
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(time.Second):
+		t.Error("Update not received")
+		return actionMsg{}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for failures, expected := range []time.Duration{0, backoffMin, 2 * backoffMin, 4 * backoffMin, backoffMax, backoffMax} {
+		if failures == 0 {
+			continue
+		}
+		if delay := backoff(failures, random); delay < expected/2 || delay > expected {
+			t.Errorf("Unexpected delay after %d failures: %v. Expected: [%v, %v]", failures, delay, expected/2, expected)
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "monitor.queue")
+
+	// Every state of a spot is queued, in order
+	now := time.Now()
+	lines := ""
+	for i, u := range []actionMsgParams{
+		{Number: 1, Taken: true, ObservedAt: &now, Sequence: 1},
+		{Number: 2, Taken: true, ObservedAt: &now, Sequence: 2},
+		{Number: 1, Taken: false, ObservedAt: &now, Sequence: 3},
+	} {
+		data, _ := json.Marshal(u)
+		lines += string(data) + "\n"
+		if i == 1 {
+			lines += "{\"number\": 3, \"ta\n"
+		}
+	}
+	if err = ioutil.WriteFile(path, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := openQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectParams(t, queue.peek(10), actionMsgParams{Number: 1, Taken: true}, actionMsgParams{Number: 2, Taken: true}, actionMsgParams{Number: 1})
+
+	later := now.Add(time.Second)
+	err = queue.push([]actionMsgParams{
+		// Unchanged, keeping the time the state was first observed
+		{Number: 2, Taken: true, ObservedAt: &later, Sequence: 4},
+		{Number: 3, Fault: true, ObservedAt: &later, Sequence: 5},
+		{Number: 1, Taken: true, ObservedAt: &later, Sequence: 6},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened, err := openQueue(path); err != nil {
+		t.Error(err)
+	} else if reopened.len() != 5 || !reopened.updates[1].ObservedAt.Equal(now) || !reopened.updates[3].Fault || !reopened.updates[4].Taken {
+		t.Errorf("Unexpected queued updates: %+v", reopened.updates)
+	}
+
+	if err = queue.pop(4); err != nil {
+		t.Fatal(err)
+	}
+	if reopened, err := openQueue(path); err != nil {
+		t.Error(err)
+	} else if reopened.len() != 1 || reopened.updates[0].Sequence != 6 {
+		t.Errorf("Unexpected queued updates: %+v", reopened.updates)
+	}
+
+	// The oldest updates are dropped to keep at most maxQueued
+	queue = &updateQueue{}
+	for i := 0; i <= maxQueued; i++ {
+		queue.push([]actionMsgParams{{Number: 1, Taken: i%2 == 0, ObservedAt: &now, Sequence: uint64(i)}})
+	}
+	if queue.len() != maxQueued || queue.updates[0].Sequence != 1 {
+		t.Errorf("Unexpected queued updates: %d, first sequence %d", queue.len(), queue.updates[0].Sequence)
+	}
+
+	// Updates of spots removed by a reload are dropped
+	path = filepath.Join(dir, "dropped.queue")
+	queue = &updateQueue{path: path}
+	queue.push([]actionMsgParams{{Number: 1, ObservedAt: &now}, {Number: 2, ObservedAt: &now}, {Number: 3, ObservedAt: &now}})
+	if err = queue.drop([]spotConfig{{Number: 1}, {Number: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if reopened, err := openQueue(path); err != nil {
+		t.Error(err)
+	} else if reopened.len() != 1 || reopened.updates[0].Number != 2 {
+		t.Errorf("Unexpected queued updates: %+v", reopened.updates)
+	}
+}
+
+func TestHTTPRunner(t *testing.T) {
+	// The server responds with the status, or hangs if it is 0
+	status := int32(http.StatusOK)
+	hangs := int32(0)
+	received := make(chan actionMsg, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := actionMsg{}
+		json.NewDecoder(r.Body).Decode(&msg)
+		s := int(atomic.LoadInt32(&status))
+		if s == 0 {
+			atomic.AddInt32(&hangs, 1)
+			time.Sleep(2 * requestTimeout)
+			return
+		}
+		if s < 500 {
+			received <- msg
+		}
+		w.WriteHeader(s)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queue, err := openQueue(filepath.Join(dir, "monitor.queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		httpRunner(quit, server.URL, []spotConfig{{Number: 7, Label: "A-7"}, {Number: 8, Label: "A-8"}}, queue)
+		close(done)
+	}()
+
+	// Updates within the batch window are sent together, with the latest
+	// state of each spot
+	now := time.Now()
+	httpReqCh <- spotUpdate{8, sFree, now}
+	httpReqCh <- spotUpdate{7, sFree, now}
+	httpReqCh <- spotUpdate{8, sTaken, now}
+	msg := expectReceived(t, received)
+	if msg.Action != "update" {
+		t.Errorf("Unexpected action: %s", msg.Action)
+	}
+	expectParams(t, msg.Params, actionMsgParams{Number: 7, Label: "A-7"}, actionMsgParams{Number: 8, Label: "A-8", Taken: true})
+	expectMode(t, mNormal, false)
+
+	t.Log("Sending an update rejected by the server")
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	httpReqCh <- spotUpdate{8, sFree, now}
+	expectReceived(t, received)
+	// Rejected updates are neither retried nor queued
+	expectMode(t, mNormal, false)
+	if reopened, err := openQueue(queue.path); err != nil {
+		t.Error(err)
+	} else if reopened.len() != 0 {
+		t.Errorf("Unexpected number of queued updates: %d. Expected: 0", reopened.len())
+	}
+
+	t.Log("Sending updates to a failing server")
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	httpReqCh <- spotUpdate{7, sTaken, now.Add(time.Second)}
+	expectMode(t, mPanic, true)
+
+	// Retries time out on a server which hangs, and newer updates are queued
+	// after the older states of their spot
+	atomic.StoreInt32(&status, 0)
+	httpReqCh <- spotUpdate{7, sFree, now.Add(2 * time.Second)}
+	expectMode(t, mPanic, false)
+	queued := func() bool {
+		reopened, err := openQueue(queue.path)
+		return err == nil && reopened.len() == 2 && reopened.updates[0].Taken && !reopened.updates[1].Taken
+	}
+	if !eventually(queued) {
+		t.Error("States not queued in order")
+	}
+	// The runner is retrying again only if the request timed out
+	if !eventually(func() bool { return atomic.LoadInt32(&hangs) >= 2 }) {
+		t.Error("Request to a hung server not timed out")
+	}
+
+	t.Log("Replaying updates once the server is back")
+	atomic.StoreInt32(&status, http.StatusOK)
+	expectMode(t, mNormal, true)
+	msg = expectReceived(t, received)
+	expectParams(t, msg.Params, actionMsgParams{Number: 7, Label: "A-7", Taken: true}, actionMsgParams{Number: 7, Label: "A-7"})
+	if queue.len() != 0 {
+		t.Errorf("Unexpected number of queued updates: %d. Expected: 0", queue.len())
+	}
+
+	quit <- struct{}{}
+	<-done
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// maxQueued is the number of updates kept while the server is not
+	// reachable; the oldest are dropped to keep more
+	maxQueued = 10000
+)
+
+// updateQueue holds the updates which could not be sent to the server yet,
+// in the order they were observed, every change of a spot's state, so that
+// sessions which start and end while the server is lost are not lost with it.
+// Unless its path is empty, it is kept in a file of JSON lines, so that it
+// survives restarts.
+type updateQueue struct {
+	path    string
+	updates []actionMsgParams
+}
+
+func openQueue(path string) (*updateQueue, error) {
+	q := &updateQueue{path: path}
+	if path == "" {
+		return q, nil
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open queue file %s: %v", path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		update := actionMsgParams{}
+		// A line cut short by a crash while writing is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &update); err != nil {
+			fmt.Fprintf(os.Stderr, "skipping invalid update in queue file %s: %v\n", path, err)
+			continue
+		}
+		q.updates = append(q.updates, update)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read queue file %s: %v", path, err)
+	}
+	if n := len(q.updates) - maxQueued; n > 0 {
+		q.updates = q.updates[n:]
+	}
+	return q, nil
+}
+
+func (q *updateQueue) len() int {
+	return len(q.updates)
+}
+
+// push queues the updates, leaving out those which do not change the queued
+// state of their spot, like heartbeats, which keeps the time the state was
+// first observed
+func (q *updateQueue) push(updates []actionMsgParams) error {
+	type state struct{ taken, fault bool }
+	latest := make(map[int]state)
+	for _, u := range q.updates {
+		latest[u.Number] = state{u.Taken, u.Fault}
+	}
+
+	pushed := []actionMsgParams{}
+	for _, u := range updates {
+		if s, queued := latest[u.Number]; queued && s == (state{u.Taken, u.Fault}) {
+			continue
+		}
+		latest[u.Number] = state{u.Taken, u.Fault}
+		pushed = append(pushed, u)
+	}
+	if len(pushed) == 0 {
+		return nil
+	}
+
+	q.updates = append(q.updates, pushed...)
+	if n := len(q.updates) - maxQueued; n > 0 {
+		q.updates = q.updates[n:]
+		return q.save()
+	}
+	return q.appendToFile(pushed)
+}
+
+// drop removes the updates of the spots, which are no longer sent to the
+// server the updates were queued for
+func (q *updateQueue) drop(spots []spotConfig) error {
+	dropped := make(map[int]bool)
+	for _, s := range spots {
+		dropped[s.Number] = true
+	}
+	kept := []actionMsgParams{}
+	for _, u := range q.updates {
+		if !dropped[u.Number] {
+			kept = append(kept, u)
+		}
+	}
+	if len(kept) == len(q.updates) {
+		return nil
+	}
+	q.updates = kept
+	return q.save()
+}
+
+// peek returns up to n of the oldest updates
+func (q *updateQueue) peek(n int) []actionMsgParams {
+	if n > len(q.updates) {
+		n = len(q.updates)
+	}
+	return q.updates[:n]
+}
+
+// pop removes the n oldest updates
+func (q *updateQueue) pop(n int) error {
+	q.updates = q.updates[n:]
+	return q.save()
+}
+
+func (q *updateQueue) appendToFile(updates []actionMsgParams) error {
+	if q.path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, u := range updates {
+		if err = encoder.Encode(u); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+// save replaces the queue file with the queued updates
+func (q *updateQueue) save() error {
+	if q.path == "" {
+		return nil
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(q.path), filepath.Base(q.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	encoder := json.NewEncoder(file)
+	for _, u := range q.updates {
+		if err = encoder.Encode(u); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), q.path)
+}
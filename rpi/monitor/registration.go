@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type (
+	// registration is the assignment of the monitor's spots on the server,
+	// with the secret its updates are authenticated with, kept in a JSON file
+	registration struct {
+		DeviceID    string         `json:"device_id"`
+		GarageID    string         `json:"garage_id"`
+		SectionID   string         `json:"section_id"`
+		SectionName string         `json:"section_name"`
+		Spots       []assignedSpot `json:"spots"`
+		Secret      string         `json:"secret,omitempty"`
+	}
+
+	// assignedSpot is a spot the monitor is registered for
+	assignedSpot struct {
+		Number int    `json:"number"`
+		Label  string `json:"label"`
+	}
+
+	registrationReq struct {
+		Token  string `json:"token"`
+		Secret string `json:"secret,omitempty"`
+		Spots  int    `json:"spots"`
+	}
+)
+
+// The credentials of the registered monitor, sent with its updates
+var (
+	deviceID     string
+	deviceSecret string
+)
+
+// authenticate adds the monitor's credentials to the request, if it is
+// registered
+func authenticate(req *http.Request) {
+	if deviceSecret != "" {
+		req.SetBasicAuth(deviceID, deviceSecret)
+	}
+}
+
+// readRegistration returns the stored registration, or nil if the monitor is
+// not registered
+func readRegistration(path string) (*registration, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read registration file %s: %v", path, err)
+	}
+	reg := &registration{}
+	if err = json.Unmarshal(data, reg); err != nil {
+		return nil, fmt.Errorf("registration file %s decoding error: %v", path, err)
+	}
+	return reg, nil
+}
+
+// save writes the registration readable only by the owner, as it holds the
+// secret
+func (reg *registration) save(path string) error {
+	data, err := json.MarshalIndent(reg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write registration file %s: %v", path, err)
+	}
+	return nil
+}
+
+// apiBase returns the server's URL without the API path
+func apiBase(url string) string {
+	if i := strings.Index(url, "/v1/"); i >= 0 {
+		return url[:i]
+	}
+	return strings.TrimSuffix(url, "/")
+}
+
+// actionsURL returns the URL of the actions of the section on the server,
+// which is addressed by ID so that renaming it does not break the monitor
+func (reg *registration) actionsURL(url string) string {
+	return apiBase(url) + "/v1/garages/" + reg.GarageID + "/sections/" + reg.SectionID + "/actions"
+}
+
+// apply numbers and labels the spots of the configuration as assigned, in
+// the order they are listed
+func (reg *registration) apply(cfg *monitorConfig) error {
+	if len(reg.Spots) != len(cfg.Spots) {
+		return fmt.Errorf("registered for %d spots, configured with %d; register again", len(reg.Spots), len(cfg.Spots))
+	}
+	for i, spot := range reg.Spots {
+		cfg.Spots[i].Number = spot.Number
+		cfg.Spots[i].Label = spot.Label
+	}
+	return nil
+}
+
+// register registers the monitor with the provisioning token for the number
+// of spots, getting the spots assigned to it. A monitor registered before
+// presents its secret, and is confirmed the same spots unless their number
+// changed.
+func register(httpclient *http.Client, url string, id string, token string, spots int, prev *registration) (*registration, error) {
+	req := registrationReq{Token: token, Spots: spots}
+	if prev != nil && prev.DeviceID == id {
+		req.Secret = prev.Secret
+	}
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpclient.Post(apiBase(url)+"/v1/devices/"+id+"/registration", "application/json", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &rejectedError{status: resp.Status, body: strings.TrimSpace(string(body))}
+	}
+	reg := &registration{}
+	if err = json.NewDecoder(resp.Body).Decode(reg); err != nil {
+		return nil, err
+	}
+	// The secret is only sent when it is generated
+	if reg.Secret == "" {
+		reg.Secret = req.Secret
+	}
+	return reg, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// profileStep is a distance measured for a number of samples in a row,
+	// or a sensor fault
+	profileStep struct {
+		distance float64
+		fault    bool
+		samples  int
+	}
+
+	// simSensor measures distances from a scripted profile, repeating the
+	// last distance once the profile is over
+	simSensor struct {
+		mu      sync.Mutex
+		profile []profileStep
+		step    int
+		sample  int
+	}
+
+	// simLED is a status light which prints its changes if it has a name
+	simLED struct {
+		mu   sync.Mutex
+		name string
+		lit  bool
+	}
+)
+
+// parseProfile parses a distance profile of comma separated steps, each a
+// distance [cm], or "fault", and the number of samples it is measured for,
+// e.g. "250:10,40:60,250:10" for a car parked for 60 samples
+func parseProfile(s string) ([]profileStep, error) {
+	profile := []profileStep{}
+	for _, field := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(field), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid profile step '%s', expected distance:samples", field)
+		}
+		step := profileStep{fault: parts[0] == "fault"}
+		if !step.fault {
+			distance, err := strconv.ParseFloat(parts[0], 64)
+			if err != nil || distance < 0 {
+				return nil, fmt.Errorf("invalid distance in profile step '%s'", field)
+			}
+			step.distance = distance
+		}
+		samples, err := strconv.Atoi(parts[1])
+		if err != nil || samples < 1 {
+			return nil, fmt.Errorf("invalid number of samples in profile step '%s'", field)
+		}
+		step.samples = samples
+		profile = append(profile, step)
+	}
+	return profile, nil
+}
+
+func newSimSensor(profile []profileStep) *simSensor {
+	return &simSensor{profile: profile}
+}
+
+func (s *simSensor) distance() (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	step := s.profile[s.step]
+	if s.sample++; s.sample >= step.samples && s.step < len(s.profile)-1 {
+		s.step++
+		s.sample = 0
+	}
+	if step.fault {
+		return 0, fmt.Errorf("simulated sensor fault")
+	}
+	return step.distance, nil
+}
+
+func (l *simLED) set(lit bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.lit != lit && l.name != "" {
+		state := "off"
+		if lit {
+			state = "on"
+		}
+		fmt.Printf("LED %s: %s\n", l.name, state)
+	}
+	l.lit = lit
+}
+
+func (l *simLED) on()  { l.set(true) }
+func (l *simLED) off() { l.set(false) }
+
+func (l *simLED) toggle() {
+	l.mu.Lock()
+	lit := l.lit
+	l.mu.Unlock()
+	l.set(!lit)
+}
+
+func (l *simLED) isOn() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lit
+}
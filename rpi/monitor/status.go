@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// spotStatus is the latest measurement of a spot, the state it gave,
+	// and the state reported to the server
+	spotStatus struct {
+		Number        int       `json:"number"`
+		Distance      float64   `json:"distance"`
+		SensorError   string    `json:"sensor_error,omitempty"`
+		MeasuredState string    `json:"measured_state"`
+		State         string    `json:"state"`
+		MeasuredAt    time.Time `json:"measured_at"`
+	}
+
+	// responseStatus is the latest response of the server, or the error of
+	// the latest request
+	responseStatus struct {
+		Time   time.Time `json:"time"`
+		Status string    `json:"status,omitempty"`
+		Error  string    `json:"error,omitempty"`
+	}
+
+	// monitorStatus is what the monitor is doing, served by the local
+	// diagnostics server
+	monitorStatus struct {
+		Mode         string          `json:"mode"`
+		Spots        []spotStatus    `json:"spots"`
+		LastResponse *responseStatus `json:"last_response,omitempty"`
+		Queued       int             `json:"queued"`
+		Tuning       tuning          `json:"tuning"`
+	}
+)
+
+var (
+	statusMu      sync.Mutex
+	currentMode   = mNormal
+	spotStatuses  = make(map[int]spotStatus)
+	lastResponse  *responseStatus
+	queuedUpdates int
+
+	// forcedHeartbeats is increased to make every state controller send
+	// a heartbeat
+	forcedHeartbeats uint32
+)
+
+func (s State) String() string {
+	switch s {
+	case sTaken:
+		return "taken"
+	case sFree:
+		return "free"
+	default:
+		return "fault"
+	}
+}
+
+func (m Mode) String() string {
+	if m == mPanic {
+		return "panic"
+	}
+	return "normal"
+}
+
+func recordMode(m Mode) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	currentMode = m
+}
+
+func recordMeasurement(number int, distance float64, err error, measured State, state State) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	s := spotStatus{
+		Number:        number,
+		Distance:      distance,
+		MeasuredState: measured.String(),
+		State:         state.String(),
+		MeasuredAt:    time.Now(),
+	}
+	if err != nil {
+		s.SensorError = err.Error()
+	}
+	spotStatuses[number] = s
+}
+
+func recordResponse(status string, err error) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	lastResponse = &responseStatus{Time: time.Now(), Status: status}
+	if err != nil {
+		lastResponse.Error = err.Error()
+	}
+}
+
+func recordQueued(n int) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	queuedUpdates = n
+}
+
+func currentStatus() monitorStatus {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	s := monitorStatus{
+		Mode:   currentMode.String(),
+		Spots:  []spotStatus{},
+		Queued: queuedUpdates,
+		Tuning: getTuning(),
+	}
+	for _, spot := range spotStatuses {
+		s.Spots = append(s.Spots, spot)
+	}
+	sort.Slice(s.Spots, func(i, j int) bool { return s.Spots[i].Number < s.Spots[j].Number })
+	if lastResponse != nil {
+		r := *lastResponse
+		s.LastResponse = &r
+	}
+	return s
+}
+
+// statusHandler serves the status of the monitor, and forces heartbeats
+func statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		resp, err := json.MarshalIndent(currentStatus(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp)
+	})
+	mux.HandleFunc("/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddUint32(&forcedHeartbeats, 1)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	return mux
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tuning is the part of the monitor's configuration which the server may
+// change while the monitor runs; intervals are in ticks
+type tuning struct {
+	HeartbeatIntrvl   int     `json:"heartbeat_interval,omitempty"`
+	DiscoveryIntrvl   int     `json:"discovery_interval,omitempty"`
+	StateUpdateIntrvl int     `json:"state_update_interval,omitempty"`
+	TakenRatio        float64 `json:"taken_ratio,omitempty"`
+}
+
+var (
+	// configPollIntrvl is the time between two polls for the configuration
+	// of the device
+	configPollIntrvl = 5 * time.Minute
+
+	tuningMu      sync.RWMutex
+	currentTuning = tuning{
+		HeartbeatIntrvl:   900,
+		DiscoveryIntrvl:   30,
+		StateUpdateIntrvl: 5,
+		TakenRatio:        defaultTakenRatio,
+	}
+
+	// retuneCh tells the mode controller that the intervals may have changed
+	retuneCh = make(chan struct{}, 1)
+)
+
+func getTuning() tuning {
+	tuningMu.RLock()
+	defer tuningMu.RUnlock()
+	return currentTuning
+}
+
+func setTuning(t tuning) {
+	tuningMu.Lock()
+	currentTuning = t
+	tuningMu.Unlock()
+
+	select {
+	case retuneCh <- struct{}{}:
+	default:
+	}
+}
+
+// merge returns the tuning with the values set in the other one
+func (t tuning) merge(other tuning) tuning {
+	if other.HeartbeatIntrvl > 0 {
+		t.HeartbeatIntrvl = other.HeartbeatIntrvl
+	}
+	if other.DiscoveryIntrvl > 0 {
+		t.DiscoveryIntrvl = other.DiscoveryIntrvl
+	}
+	if other.StateUpdateIntrvl > 0 {
+		t.StateUpdateIntrvl = other.StateUpdateIntrvl
+	}
+	if other.TakenRatio > 0 && other.TakenRatio < 1 {
+		t.TakenRatio = other.TakenRatio
+	}
+	return t
+}
+
+// deviceConfigURL returns the URL of the device's configuration on the server
+// of the spots' actions URL, or an empty string if it is not an API URL
+func deviceConfigURL(url string, id string) string {
+	i := strings.Index(url, "/v1/")
+	if i < 0 || id == "" {
+		return ""
+	}
+	return url[:i] + "/v1/devices/" + id + "/config"
+}
+
+// getDeviceConfig gets the device's configuration on the server unless its
+// ETag is unchanged, and reports whether it is set
+func getDeviceConfig(httpclient *http.Client, url string, etag string) (config tuning, newETag string, found bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := httpclient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(resp.Body).Decode(&config)
+		return config, resp.Header.Get("ETag"), true, err
+	case http.StatusNotModified:
+		return config, etag, true, nil
+	case http.StatusNotFound:
+		return config, "", false, nil
+	default:
+		err = fmt.Errorf("failed to get device configuration: %s", resp.Status)
+		return
+	}
+}
+
+// configPoller polls the server for the configuration of the device, and
+// applies it over the local one, to which the monitor returns once the
+// server's configuration is removed
+func configPoller(quit chan struct{}, url string, local tuning) {
+	httpclient := newHTTPClient()
+	etag := ""
+	for {
+		config, newETag, found, err := getDeviceConfig(httpclient, url, etag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		} else if newETag != etag || !found {
+			etag = newETag
+			t := local
+			if found {
+				t = local.merge(config)
+			}
+			if t != getTuning() {
+				fmt.Printf("configuration changed: %+v\n", t)
+				setTuning(t)
+			}
+		}
+
+		select {
+		case <-time.After(configPollIntrvl):
+		case <-quit:
+			return
+		}
+	}
+}
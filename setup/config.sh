@@ -5,10 +5,24 @@ cat > $CONFFILE <<- EOF
    "version": "$VERSION",
    "dev_addr": "$DEV_ADDR",
    "dev_port": $DEV_PORT,
+   "section_alias_grace_days": 30,
+   "deleted_retention_days": 30,
+   "alerts": {
+      "sinks": [{"type": "log"}],
+      "flapping_drops": 3,
+      "flapping_window_minutes": 360
+   },
    "db_config": {
       "conn_string": "mongodb://$DEV_ADDR:$MONGODB_PORT",
       "database": "spotdb",
-      "collection": "garages"
+      "collection": "garages",
+      "audit_collection": "audit",
+      "sessions_collection": "sessions",
+      "webhooks_collection": "webhooks",
+      "webhook_queue_collection": "webhook_queue",
+      "devices_collection": "devices",
+      "provisioning_collection": "provisioning",
+      "registrations_collection": "registrations"
    }
 }
 EOF
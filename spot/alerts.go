@@ -0,0 +1,333 @@
+package spot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/cicovic-andrija/spot/api"
+	"github.com/cicovic-andrija/spot/config"
+	"github.com/cicovic-andrija/spot/log"
+	"github.com/cicovic-andrija/spot/resources"
+)
+
+// Reasons a spot went offline
+const (
+	offlineDisconnected = "disconnected"
+	offlineTimedOut     = "timed_out"
+	offlineSensorFault  = "sensor_fault"
+)
+
+// Device alert types
+const (
+	alertDeviceOffline  = "device_offline"
+	alertDeviceOnline   = "device_online"
+	alertDeviceFlapping = "device_flapping"
+	alertSensorFault    = "sensor_fault"
+)
+
+// Alert sink types
+const (
+	sinkLog     = "log"
+	sinkWebhook = "webhook"
+)
+
+func flappingWindow() time.Duration {
+	return time.Duration(cfg.Alerts.FlappingWindowMinutes) * time.Minute
+}
+
+// recentDrops returns the drops within the flapping window
+func recentDrops(drops []time.Time, now time.Time) []time.Time {
+	recent := []time.Time{}
+	for _, t := range drops {
+		if now.Sub(t) <= flappingWindow() {
+			recent = append(recent, t)
+		}
+	}
+	return recent
+}
+
+func spotLabel(spot *resources.Spot) string {
+	if spot.Label != "" {
+		return spot.Label
+	}
+	return spot.LastLabel
+}
+
+func deviceAlert(alertType string, garage *resources.Garage, section *resources.Section, number int, now time.Time) resources.DeviceAlert {
+	// NOTE: This function is *not* thread-safe
+	spot := &section.Spots[number-1]
+	return resources.DeviceAlert{
+		Type:        alertType,
+		Timestamp:   now,
+		GarageID:    garage.ID,
+		GarageName:  garage.Name,
+		SectionID:   section.ID,
+		SectionName: section.Name,
+		Spot:        number,
+		Label:       spotLabel(spot),
+		LastSeen:    spot.LastSeen,
+		Drops:       len(recentDrops(spot.Drops, now)),
+	}
+}
+
+// alert sends the alerts to the alert sinks
+func (m *garageManager) alert(alerts []resources.DeviceAlert) {
+	if m.alerts != nil {
+		m.alerts.notify(alerts)
+	}
+}
+
+// offlineSpots returns the spots of the garage, or of all garages if no ID is
+// given, whose device is offline, or timed out since the given time. Spots
+// which were never seen are left out.
+func (m *garageManager) offlineSpots(garageID string, since time.Time) (respArray []resources.OfflineSpot, found bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	garages := m.garages
+	if garageID != "" {
+		garage, ok := m.garages[garageID]
+		if !ok {
+			return
+		}
+		garages = map[string]*resources.Garage{garageID: garage}
+	}
+
+	now := time.Now()
+	respArray = []resources.OfflineSpot{}
+	for _, g := range garages {
+		for i := range g.Sections {
+			for j := range g.Sections[i].Spots {
+				spot := &g.Sections[i].Spots[j]
+				drops := recentDrops(spot.Drops, now)
+
+				var lastDrop *time.Time
+				if n := len(drops); n > 0 {
+					lastDrop = &drops[n-1]
+				}
+				if spot.LastSeen.IsZero() || (spot.Online && (lastDrop == nil || lastDrop.Before(since))) {
+					continue
+				}
+
+				respObj := resources.OfflineSpot{
+					GarageID:      g.ID,
+					GarageName:    g.Name,
+					SectionID:     g.Sections[i].ID,
+					SectionName:   g.Sections[i].Name,
+					Spot:          j + 1,
+					Label:         spotLabel(spot),
+					Online:        spot.Online,
+					LastSeen:      spot.LastSeen,
+					OfflineReason: spot.OfflineReason,
+					Drops:         len(drops),
+					LastDrop:      lastDrop,
+					Flapping:      len(drops) >= cfg.Alerts.FlappingDrops,
+				}
+				if !spot.Online {
+					offlineSince := spot.OfflineSince
+					respObj.OfflineSince = &offlineSince
+				}
+				respArray = append(respArray, respObj)
+			}
+		}
+	}
+
+	sort.Slice(respArray, func(i, j int) bool {
+		a, b := respArray[i], respArray[j]
+		if a.GarageID != b.GarageID {
+			return a.GarageID < b.GarageID
+		}
+		if a.SectionName != b.SectionName {
+			return a.SectionName < b.SectionName
+		}
+		return a.Spot < b.Spot
+	})
+	return respArray, true
+}
+
+type alertSink interface {
+	send(alerts []resources.DeviceAlert) error
+}
+
+type logSink struct{}
+
+func (logSink) send(alerts []resources.DeviceAlert) error {
+	for _, a := range alerts {
+		log.Infof(
+			"Alert: %s: garage: '%s' (garage id %s); section: '%s'; spot #%d (label '%s'); last seen %s; recent drops: %d",
+			a.Type,
+			a.GarageName,
+			a.GarageID,
+			a.SectionName,
+			a.Spot,
+			a.Label,
+			a.LastSeen.Format(time.RFC3339),
+			a.Drops,
+		)
+	}
+	return nil
+}
+
+// webhookSink POSTs alerts as a JSON array, signed the same way as webhook
+// deliveries if it has a secret
+type webhookSink struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (s *webhookSink) send(alerts []resources.DeviceAlert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.secret != "" {
+		req.Header.Set(webhookSignatureHeader, webhookSignature(s.secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func newAlertSinks(sinks []config.AlertSink) ([]alertSink, error) {
+	alertSinks := []alertSink{}
+	for _, s := range sinks {
+		switch s.Type {
+		case sinkLog:
+			alertSinks = append(alertSinks, logSink{})
+		case sinkWebhook:
+			if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("alert sink URL '%s' must be an absolute http or https URL", s.URL)
+			}
+			alertSinks = append(alertSinks, &webhookSink{
+				url:    s.URL,
+				secret: s.Secret,
+				client: &http.Client{Timeout: 10 * time.Second},
+			})
+		default:
+			return nil, fmt.Errorf("unknown alert sink type '%s', use '%s' or '%s'", s.Type, sinkLog, sinkWebhook)
+		}
+	}
+	return alertSinks, nil
+}
+
+// alertRunner sends alerts to the sinks in the background, so that slow
+// sinks hold neither garages nor requests
+type alertRunner struct {
+	quit  chan struct{}
+	queue chan []resources.DeviceAlert
+	sinks []alertSink
+}
+
+func newAlertRunner(sinks []alertSink) *alertRunner {
+	return &alertRunner{
+		queue: make(chan []resources.DeviceAlert, 64),
+		sinks: sinks,
+	}
+}
+
+func (r *alertRunner) start() {
+	r.quit = make(chan struct{})
+	go r.run()
+}
+
+func (r *alertRunner) stop() {
+	r.quit <- struct{}{}
+}
+
+func (r *alertRunner) run() {
+	for {
+		select {
+		case alerts := <-r.queue:
+			for _, s := range r.sinks {
+				if err := s.send(alerts); err != nil {
+					log.Errorf("Failed to send %d device alerts: %v", len(alerts), err)
+				}
+			}
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+func (r *alertRunner) notify(alerts []resources.DeviceAlert) {
+	if len(alerts) == 0 {
+		return
+	}
+	select {
+	case r.queue <- alerts:
+	default:
+		log.Errorf("Dropping %d device alerts, too many alerts are waiting to be sent", len(alerts))
+	}
+}
+
+func (s *server) httpOfflineSpots(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.getOfflineSpots(w, r)
+	default:
+		errMsg := fmt.Sprintf("invalid request for '%s/%s'", api.Devices, api.Offline)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+	}
+}
+
+func (s *server) getOfflineSpots(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	garageID := query.Get("garage_id")
+
+	// Spots which timed out within a day are reported by default
+	since := time.Now().Add(-24 * time.Hour)
+	if v := query.Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			httpErrorResp(w, r, http.StatusBadRequest, "'since' must be an RFC 3339 timestamp")
+			return
+		}
+	}
+
+	respArray, found := s.garages.offlineSpots(garageID, since)
+	if !found {
+		errMsg := fmt.Sprintf("resource '%s/%s' not found", api.CollectionGarages, garageID)
+		httpErrorResp(w, r, http.StatusNotFound, errMsg)
+		return
+	}
+	if query.Get("flapping") == "true" {
+		flapping := []resources.OfflineSpot{}
+		for _, o := range respArray {
+			if o.Flapping {
+				flapping = append(flapping, o)
+			}
+		}
+		respArray = flapping
+	}
+
+	resp, err := json.Marshal(respArray)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -0,0 +1,166 @@
+package spot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/cicovic-andrija/spot/api"
+	"github.com/cicovic-andrija/spot/db"
+	"github.com/cicovic-andrija/spot/log"
+	"github.com/cicovic-andrija/spot/resources"
+)
+
+// Audit log actions
+const (
+	auditGarageCreate   = "garage.create"
+	auditGarageUpdate   = "garage.update"
+	auditGarageDelete   = "garage.delete"
+	auditSectionCreate  = "section.create"
+	auditSectionUpdate  = "section.update"
+	auditSectionDelete  = "section.delete"
+	auditGaragePurge    = "garage.purge"
+	auditGarageRestore  = "garage.restore"
+	auditSectionPurge   = "section.purge"
+	auditSectionRestore = "section.restore"
+	auditControl        = "control."
+
+	// auditRetention is the actor purging expired soft-deleted resources
+	auditRetention = "retention"
+)
+
+// requestActor identifies who made the request. There is no authentication,
+// so the name is taken from basic auth or the X-Actor header as given, and
+// falls back to the client address.
+func requestActor(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	if actor := r.Header.Get("X-Actor"); actor != "" {
+		return actor
+	}
+	return r.RemoteAddr
+}
+
+func garageState(g *resources.Garage) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        g.Name,
+		"city":        g.City,
+		"address":     g.Address,
+		"geolocation": g.Geolocation,
+		"hours":       g.Hours,
+		"tariff":      g.Tariff,
+	}
+}
+
+func sectionState(s *resources.Section) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        s.Name,
+		"level":       s.Level,
+		"description": s.Description,
+		"total_spots": s.TotalSpots,
+		"spot_types":  s.SpotTypes,
+	}
+}
+
+// diff leaves only the properties which differ between the two states
+func diff(before, after map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	for k, v := range before {
+		if reflect.DeepEqual(v, after[k]) {
+			delete(before, k)
+			delete(after, k)
+		}
+	}
+	return before, after
+}
+
+func garageTarget(garageID string) string {
+	return api.Path(api.V1, api.CollectionGarages, garageID)
+}
+
+func sectionTarget(garageID string, sectionID string) string {
+	return api.Path(api.V1, api.CollectionGarages, garageID, api.CollectionSections, sectionID)
+}
+
+func (m *garageManager) record(ctx context.Context, entry *resources.AuditEntry) {
+	entry.Timestamp = time.Now().UTC()
+
+	// The change has already been made at this point, so failing to record
+	// it is reported but not returned
+	if err := m.db.InsertAuditEntry(ctx, entry); err != nil {
+		log.Errorf("DB: failed to record '%s' of %s by %s: %v", entry.Action, entry.Target, entry.Actor, err)
+	}
+}
+
+func (m *garageManager) recordControl(actor string, action string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	m.record(ctx, &resources.AuditEntry{
+		Actor:  actor,
+		Action: auditControl + action,
+		Target: api.Path(api.V1, api.Control),
+	})
+}
+
+func (s *server) httpAudit(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.getAudit(w, r)
+	default:
+		errMsg := fmt.Sprintf("invalid request for resource '%s'", api.Audit)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+	}
+}
+
+func (s *server) getAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := db.AuditFilter{
+		Actor:     query.Get("actor"),
+		Action:    query.Get("action"),
+		GarageID:  query.Get("garage_id"),
+		SectionID: query.Get("section_id"),
+		Limit:     100,
+	}
+
+	var err error
+	if v := query.Get("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			httpErrorResp(w, r, http.StatusBadRequest, "'since' must be an RFC 3339 timestamp")
+			return
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			httpErrorResp(w, r, http.StatusBadRequest, "'until' must be an RFC 3339 timestamp")
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 {
+			httpErrorResp(w, r, http.StatusBadRequest, "'limit' must be a positive number")
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	entries, err := s.garages.db.FindAuditEntries(ctx, filter)
+	if err != nil {
+		err = errors.New("DB error: failed to get audit log: " + err.Error())
+		httpInternalError(w, r, err)
+		return
+	}
+
+	resp, err := json.Marshal(entries)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
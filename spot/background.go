@@ -33,3 +33,83 @@ func (r *invalidationRunner) run() {
 		}
 	}
 }
+
+type auditRunner struct {
+	quit    chan struct{}
+	garages *garageManager
+}
+
+func (r *auditRunner) start() {
+	r.quit = make(chan struct{})
+	go r.run()
+}
+
+func (r *auditRunner) stop() {
+	r.quit <- struct{}{}
+}
+
+func (r *auditRunner) run() {
+	for {
+		select {
+		case <-time.After(time.Hour):
+			r.garages.auditFreeSpots()
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// deliveryRunner delivers queued webhook events as soon as they are queued,
+// and retries failed deliveries when they are due
+type deliveryRunner struct {
+	quit     chan struct{}
+	webhooks *webhookManager
+}
+
+func (r *deliveryRunner) start() {
+	r.quit = make(chan struct{})
+	go r.run()
+}
+
+func (r *deliveryRunner) stop() {
+	r.quit <- struct{}{}
+}
+
+func (r *deliveryRunner) run() {
+	for {
+		select {
+		case <-time.After(10 * time.Second):
+			r.webhooks.deliverDue()
+		case <-r.webhooks.wake:
+			r.webhooks.deliverDue()
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+type purgeRunner struct {
+	quit      chan struct{}
+	garages   *garageManager
+	retention time.Duration
+}
+
+func (r *purgeRunner) start() {
+	r.quit = make(chan struct{})
+	go r.run()
+}
+
+func (r *purgeRunner) stop() {
+	r.quit <- struct{}{}
+}
+
+func (r *purgeRunner) run() {
+	for {
+		select {
+		case <-time.After(time.Hour):
+			r.garages.purgeDeleted(r.retention)
+		case <-r.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package spot
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cicovic-andrija/spot/api"
+)
+
+// Commands talk to a running server over its REST API
+var commands = map[string]func(args []string) int{
+	"export": exportCommand,
+	"import": importCommand,
+}
+
+const (
+	defaultServerURL = "http://localhost:8000"
+)
+
+var (
+	cliClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+func commandURL(server string, elem string, query url.Values) string {
+	u := strings.TrimRight(server, "/") + api.Path(api.V1, elem)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// commandResponse copies the response body to out and reports whether the
+// request succeeded
+func commandResponse(resp *http.Response, out io.Writer) bool {
+	defer resp.Body.Close()
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return false
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		fmt.Fprintf(os.Stderr, "Error: server responded with %s\n", resp.Status)
+		return false
+	}
+	return true
+}
+
+func exportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	server := flags.String("url", defaultServerURL, "server URL")
+	format := flags.String("format", api.FormatJSON, "export format, json or csv")
+	output := flags.String("o", "", "output file (default standard output)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	query := url.Values{api.QueryFormat: {*format}}
+	resp, err := cliClient.Get(commandURL(*server, api.Export, query))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if !commandResponse(resp, out) {
+		return 1
+	}
+	return 0
+}
+
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: spot import [flags] [file]")
+		flags.PrintDefaults()
+	}
+	server := flags.String("url", defaultServerURL, "server URL")
+	format := flags.String("format", "", "import format, json or csv (default by file extension, or json)")
+	dryRun := flags.Bool("dry-run", false, "report the changes without making them")
+	force := flags.Bool("force", false, "remove spots in use when shrinking sections")
+	actor := flags.String("actor", os.Getenv("USER"), "name recorded in the audit log")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	switch file := flags.Arg(0); file {
+	case "", "-":
+		data, err = ioutil.ReadAll(os.Stdin)
+	default:
+		data, err = ioutil.ReadFile(file)
+		if *format == "" && strings.EqualFold(filepath.Ext(file), ".csv") {
+			*format = api.FormatCSV
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if *format == "" {
+		*format = api.FormatJSON
+	}
+
+	query := url.Values{api.QueryFormat: {*format}}
+	if *dryRun {
+		query.Set(api.QueryDryRun, "true")
+	}
+	if *force {
+		query.Set(api.QueryForce, "true")
+	}
+	req, err := http.NewRequest(http.MethodPost, commandURL(*server, api.Import, query), bytes.NewReader(data))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if *actor != "" {
+		req.Header.Set("X-Actor", *actor)
+	}
+
+	resp, err := cliClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	ok := commandResponse(resp, os.Stdout)
+	fmt.Println()
+	if !ok {
+		return 1
+	}
+	return 0
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+
+	"github.com/cicovic-andrija/spot/api"
 )
 
 func (s *server) httpControl(w http.ResponseWriter, r *http.Request) {
@@ -28,9 +30,19 @@ func (s *server) httpControl(w http.ResponseWriter, r *http.Request) {
 	}
 
 	switch actionMsg.Action {
-	case "shutdown":
+	case api.ActionShutdown:
+		s.garages.recordControl(requestActor(r), actionMsg.Action)
 		s.shutdown()
 		w.WriteHeader(http.StatusOK)
+	case api.ActionAudit:
+		s.garages.recordControl(requestActor(r), actionMsg.Action)
+		resp, err := json.Marshal(s.garages.auditFreeSpots())
+		if err != nil {
+			httpInternalError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp)
 	default:
 		errMsg := fmt.Sprintf("action '%s' not supported", actionMsg.Action)
 		httpErrorResp(w, r, http.StatusNotFound, errMsg)
@@ -0,0 +1,233 @@
+package spot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cicovic-andrija/spot/api"
+	"github.com/cicovic-andrija/spot/db"
+	"github.com/cicovic-andrija/spot/resources"
+	"github.com/gorilla/mux"
+)
+
+// defaultDeviceID is the ID of the configuration of all the devices
+const defaultDeviceID = "default"
+
+type deviceManager struct {
+	db            *db.Client
+	rw            *sync.RWMutex
+	configs       map[string]*resources.DeviceConfig
+	tokens        map[string]*resources.ProvisioningToken
+	registrations map[string]*resources.DeviceRegistration
+}
+
+func newDeviceManager(db *db.Client) (*deviceManager, error) {
+	var err error
+
+	dm := &deviceManager{
+		db: db,
+		rw: &sync.RWMutex{},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dm.configs, err = db.FindAllDeviceConfigs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dm.tokens, err = db.FindAllProvisioningTokens(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dm.registrations, err = db.FindAllRegistrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return dm, nil
+}
+
+func validDeviceConfig(config *resources.DeviceConfig) error {
+	if config.HeartbeatInterval < 0 || config.DiscoveryInterval < 0 || config.StateUpdateInterval < 0 {
+		return errors.New("intervals must not be negative")
+	}
+	// Zero leaves the taken ratio unset, so that the default one applies
+	if config.TakenRatio < 0 || config.TakenRatio >= 1 {
+		return errors.New("taken ratio must be 0 (unset) or in range (0, 1)")
+	}
+	return nil
+}
+
+// getDeviceConfig returns the configuration of the device, with the values it
+// does not set taken from the default configuration, and reports whether
+// either of them is set
+func (m *deviceManager) getDeviceConfig(id string) (respObj resources.DeviceConfig, found bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	config, found := m.configs[id]
+	if found {
+		respObj = *config
+	}
+	def, defFound := m.configs[defaultDeviceID]
+	if !defFound {
+		return
+	}
+
+	respObj.ID = id
+	if respObj.HeartbeatInterval == 0 {
+		respObj.HeartbeatInterval = def.HeartbeatInterval
+	}
+	if respObj.DiscoveryInterval == 0 {
+		respObj.DiscoveryInterval = def.DiscoveryInterval
+	}
+	if respObj.StateUpdateInterval == 0 {
+		respObj.StateUpdateInterval = def.StateUpdateInterval
+	}
+	if respObj.TakenRatio == 0 {
+		respObj.TakenRatio = def.TakenRatio
+	}
+	if def.UpdatedAt.After(respObj.UpdatedAt) {
+		respObj.UpdatedAt = def.UpdatedAt
+	}
+	return respObj, true
+}
+
+// setDeviceConfig sets the configuration of the device, and reports whether
+// it was not set before
+func (m *deviceManager) setDeviceConfig(config *resources.DeviceConfig) (created bool, err error) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	_, found := m.configs[config.ID]
+	config.UpdatedAt = time.Now().UTC()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = m.db.ReplaceDeviceConfig(ctx, config); err != nil {
+		return
+	}
+
+	m.configs[config.ID] = config
+	return !found, nil
+}
+
+func (m *deviceManager) removeDeviceConfig(id string) (found bool, err error) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	if _, found = m.configs[id]; !found {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = m.db.DeleteDeviceConfig(ctx, id); err != nil {
+		return
+	}
+
+	delete(m.configs, id)
+	return
+}
+
+func (s *server) httpDeviceConfig(w http.ResponseWriter, r *http.Request) {
+	urlVars := mux.Vars(r)
+	id := urlVars["device-id"]
+	switch r.Method {
+	case http.MethodGet:
+		s.getDeviceConfig(w, r, id)
+	case http.MethodPut:
+		s.putDeviceConfig(w, r, id)
+	case http.MethodDelete:
+		s.deleteDeviceConfig(w, r, id)
+	default:
+		errMsg := fmt.Sprintf("invalid request for resource '%s/%s/%s'", api.Devices, id, api.Config)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+	}
+}
+
+// getDeviceConfig responds with an ETag, so that devices polling for their
+// configuration only get it when it changes
+func (s *server) getDeviceConfig(w http.ResponseWriter, r *http.Request, id string) {
+	respObj, found := s.devices.getDeviceConfig(id)
+	if !found {
+		errMsg := fmt.Sprintf("resource '%s/%s/%s' not found", api.Devices, id, api.Config)
+		httpErrorResp(w, r, http.StatusNotFound, errMsg)
+		return
+	}
+
+	resp, err := json.Marshal(respObj)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+
+	tag := bodyETag(resp)
+	if notModified(w, r, tag) {
+		return
+	}
+	w.Header().Set("ETag", tag)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+func (s *server) putDeviceConfig(w http.ResponseWriter, r *http.Request, id string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+
+	config := &resources.DeviceConfig{}
+	err = json.Unmarshal(body, config)
+	if err != nil {
+		errMsg := "failed to unmarshal JSON object: " + err.Error()
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+	config.ID = id
+
+	if err = validDeviceConfig(config); err != nil {
+		httpErrorResp(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	created, err := s.devices.setDeviceConfig(config)
+	if err != nil {
+		err = errors.New("DB error: failed to set device configuration: " + err.Error())
+		httpInternalError(w, r, err)
+		return
+	}
+
+	resp, err := json.Marshal(config)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(resp)
+}
+
+func (s *server) deleteDeviceConfig(w http.ResponseWriter, r *http.Request, id string) {
+	found, err := s.devices.removeDeviceConfig(id)
+	if !found {
+		errMsg := fmt.Sprintf("resource '%s/%s/%s' not found", api.Devices, id, api.Config)
+		httpErrorResp(w, r, http.StatusNotFound, errMsg)
+		return
+	}
+	if err != nil {
+		err = errors.New("DB error: failed to delete device configuration: " + err.Error())
+		httpInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -20,6 +20,21 @@ func (s *server) setupEndpoints() http.Handler {
 		s.httpGarage,
 	)
 
+	s.router.HandleFunc(
+		api.Path(api.V1, api.CollectionGarages, api.ObjectGarage, api.Restore),
+		s.httpGarageRestore,
+	)
+
+	s.router.HandleFunc(
+		api.Path(api.V1, api.CollectionGarages, api.ObjectGarage, api.Quote),
+		s.httpQuote,
+	)
+
+	s.router.HandleFunc(
+		api.Path(api.V1, api.CollectionGarages, api.ObjectGarage, api.CollectionSessions),
+		s.httpSessions,
+	)
+
 	s.router.HandleFunc(
 		api.Path(api.V1, api.CollectionGarages, api.ObjectGarage,
 			api.CollectionSections),
@@ -38,10 +53,66 @@ func (s *server) setupEndpoints() http.Handler {
 		s.httpSpots,
 	)
 
+	s.router.HandleFunc(
+		api.Path(api.V1, api.CollectionGarages, api.ObjectGarage,
+			api.CollectionSections, api.ObjectSection, api.Restore),
+		s.httpSectionRestore,
+	)
+
+	s.router.HandleFunc(
+		api.Path(api.V1, api.Devices, api.Offline),
+		s.httpOfflineSpots,
+	)
+
+	s.router.HandleFunc(
+		api.Path(api.V1, api.Devices, api.ObjectDevice, api.Config),
+		s.httpDeviceConfig,
+	)
+
+	s.router.HandleFunc(
+		api.Path(api.V1, api.Devices, api.ObjectDevice, api.Registration),
+		s.httpRegistration,
+	)
+
+	s.router.HandleFunc(
+		api.Path(api.V1, api.Devices, api.Tokens),
+		s.httpTokens,
+	)
+
+	s.router.HandleFunc(
+		api.Path(api.V1, api.Devices, api.Tokens, api.ObjectToken),
+		s.httpToken,
+	)
+
 	s.router.HandleFunc(
 		api.Path(api.V1, api.Control),
 		s.httpControl,
 	)
 
+	s.router.HandleFunc(
+		api.Path(api.V1, api.Audit),
+		s.httpAudit,
+	)
+
+	s.router.HandleFunc(
+		api.Path(api.V1, api.CollectionWebhooks),
+		s.httpWebhooks,
+	)
+
+	s.router.HandleFunc(
+		api.Path(api.V1, api.CollectionWebhooks, api.ObjectWebhook),
+		s.httpWebhook,
+	)
+
+	s.router.HandleFunc(
+		api.Path(api.V1, api.Export),
+		s.httpExport,
+	)
+
+	s.router.HandleFunc(
+		api.Path(api.V1, api.Import),
+		s.httpImport,
+	)
+
 	return s.router
 }
@@ -0,0 +1,111 @@
+package spot
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/cicovic-andrija/spot/resources"
+)
+
+// Garages and sections carry a version which is incremented whenever their
+// properties change. Their ETag combines the version with the number of free
+// spots, in total and by type, so polling clients notice occupancy changes,
+// while If-Match only guards against concurrent changes of the properties
+// themselves.
+
+// etag hashes the free spots by type, as a spot of one type can be taken
+// while one of another is freed, leaving the total unchanged
+func etag(version int, freeSpots int, freeSpotsByType map[string]int) string {
+	types := make([]string, 0, len(freeSpotsByType))
+	for t := range freeSpotsByType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	h := fnv.New32a()
+	for _, t := range types {
+		fmt.Fprintf(h, "%s=%d;", t, freeSpotsByType[t])
+	}
+	return fmt.Sprintf(`"%d-%d-%x"`, version, freeSpots, h.Sum32())
+}
+
+// garageETag also changes when the garage opens or closes. The suffixes are
+// ignored by If-Match, like the number of free spots.
+func garageETag(g resources.GarageRespObj) string {
+	tag := etag(g.Version, g.FreeSpots, g.FreeSpotsByType)
+	if g.Open {
+		return tag
+	}
+	return strings.TrimSuffix(tag, `"`) + `-closed"`
+}
+
+func bodyETag(body []byte) string {
+	h := fnv.New64a()
+	h.Write(body)
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+type precondition struct {
+	present  bool
+	any      bool
+	versions []int
+}
+
+func ifMatch(r *http.Request) (p precondition) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return
+	}
+
+	p.present = true
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			p.any = true
+			continue
+		}
+
+		// If-Match uses strong comparison, so weak tags never match
+		var version, freeSpots int
+		if n, _ := fmt.Sscanf(tag, `"%d-%d"`, &version, &freeSpots); n == 2 {
+			p.versions = append(p.versions, version)
+		}
+	}
+	return
+}
+
+func (p precondition) holds(version int) bool {
+	if !p.present || p.any {
+		return true
+	}
+	for _, v := range p.versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func notModified(w http.ResponseWriter, r *http.Request, tag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == tag {
+			w.Header().Set("ETag", tag)
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+func httpPreconditionFailed(w http.ResponseWriter, r *http.Request) {
+	httpErrorResp(w, r, http.StatusPreconditionFailed, "resource has been modified, fetch it and retry")
+}
@@ -6,12 +6,21 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/cicovic-andrija/spot/api"
 	"github.com/cicovic-andrija/spot/resources"
 	"github.com/gorilla/mux"
 )
 
+const (
+	invalidGeolocationMsg = "illegal geolocation, longitude must be in range [-180, 180] and latitude in range [-90, 90]"
+)
+
+func validGeolocation(g resources.Geolocation) bool {
+	return g.Longitude >= -180 && g.Longitude <= 180 && g.Latitude >= -90 && g.Latitude <= 90
+}
+
 func (s *server) httpGarages(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
@@ -40,13 +49,51 @@ func (s *server) httpGarage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *server) httpGarageRestore(w http.ResponseWriter, r *http.Request) {
+	urlVars := mux.Vars(r)
+	id := urlVars["garage-id"]
+	switch r.Method {
+	case http.MethodPost:
+		s.restoreGarage(w, r, id)
+	default:
+		errMsg := fmt.Sprintf("invalid request for '%s'", api.Restore)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+	}
+}
+
 func (s *server) getGarages(w http.ResponseWriter, r *http.Request) {
-	respArray := s.garages.getGarages()
+	var respArray []resources.GarageRespObj
+	if r.URL.Query().Get(api.QueryDeleted) == "true" {
+		respArray = s.garages.getDeletedGarages()
+	} else {
+		respArray = s.garages.getGarages()
+	}
+
+	filter, err := parseSpotFilter(r)
+	if err != nil {
+		httpErrorResp(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Closed garages are left out on request
+	openOnly := r.URL.Query().Get(api.QueryOpen) == "true"
+	filtered := []resources.GarageRespObj{}
+	for _, g := range respArray {
+		if (g.Open || !openOnly) && filter.matches(g.FreeSpots, g.FreeSpotsByType) {
+			filtered = append(filtered, g)
+		}
+	}
+	respArray = filtered
 	resp, err := json.Marshal(respArray)
 	if err != nil {
 		httpInternalError(w, r, err)
 		return
 	}
+	tag := bodyETag(resp)
+	if notModified(w, r, tag) {
+		return
+	}
+	w.Header().Set("ETag", tag)
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Write(resp)
@@ -67,26 +114,48 @@ func (s *server) postGarages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.garages.addGarage(garage)
+	if !validGeolocation(garage.Geolocation) {
+		httpErrorResp(w, r, http.StatusBadRequest, invalidGeolocationMsg)
+		return
+	}
+
+	if err = validOpeningHours(garage.Hours); err != nil {
+		errMsg := "illegal opening hours: " + err.Error()
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+
+	if err = validTariff(garage.Tariff); err != nil {
+		errMsg := "illegal tariff: " + err.Error()
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+
+	err = s.garages.addGarage(requestActor(r), garage)
 	if err != nil {
 		err = errors.New("DB error: failed to insert garage: " + err.Error())
 		httpInternalError(w, r, err)
 		return
 	}
 
-	resp, err := json.Marshal(
-		resources.GarageRespObj{
-			ID:          garage.ID,
-			Name:        garage.Name,
-			City:        garage.City,
-			Address:     garage.Address,
-			Geolocation: garage.Geolocation,
-		},
-	)
+	respObj := resources.GarageRespObj{
+		ID:              garage.ID,
+		Name:            garage.Name,
+		City:            garage.City,
+		Address:         garage.Address,
+		Geolocation:     garage.Geolocation,
+		Hours:           garage.Hours,
+		Tariff:          garage.Tariff,
+		Open:            garageOpen(garage, time.Now()),
+		Version:         garage.Version,
+		FreeSpotsByType: garageFreeSpotsByType(garage),
+	}
+	resp, err := json.Marshal(respObj)
 	if err != nil {
 		httpInternalError(w, r, err)
 		return
 	}
+	w.Header().Set("ETag", garageETag(respObj))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	w.Write(resp)
@@ -100,11 +169,17 @@ func (s *server) getGarage(w http.ResponseWriter, r *http.Request, id string) {
 		return
 	}
 
+	tag := garageETag(respObj)
+	if notModified(w, r, tag) {
+		return
+	}
+
 	resp, err := json.Marshal(respObj)
 	if err != nil {
 		httpInternalError(w, r, err)
 		return
 	}
+	w.Header().Set("ETag", tag)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(resp)
 }
@@ -124,12 +199,51 @@ func (s *server) putGarage(w http.ResponseWriter, r *http.Request, id string) {
 		return
 	}
 
-	found, respObj, err := s.garages.updateGarage(id, update)
+	// PUT replaces all properties, PATCH only those present in the merge patch
+	var fields []string
+	if r.Method == http.MethodPatch {
+		fields, err = mergePatchFields(body, garageProperties)
+		if err != nil {
+			errMsg := "invalid merge patch: " + err.Error()
+			httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+			return
+		}
+	}
+
+	if (hasField(fields, "geolocation.longitude") || hasField(fields, "geolocation.latitude")) &&
+		!validGeolocation(update.Geolocation) {
+		httpErrorResp(w, r, http.StatusBadRequest, invalidGeolocationMsg)
+		return
+	}
+
+	// Properties of the opening hours and the tariff are valid on their own,
+	// so those in the merge patch are valid merged with the others
+	if hasObject(fields, "hours") {
+		if err = validOpeningHours(update.Hours); err != nil {
+			errMsg := "illegal opening hours: " + err.Error()
+			httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+			return
+		}
+	}
+
+	if hasObject(fields, "tariff") {
+		if err = validTariff(update.Tariff); err != nil {
+			errMsg := "illegal tariff: " + err.Error()
+			httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+			return
+		}
+	}
+
+	found, conflict, respObj, err := s.garages.updateGarage(requestActor(r), id, update, fields, ifMatch(r))
 	if !found {
 		errMsg := fmt.Sprintf("resource '%s/%s' not found", api.CollectionGarages, id)
 		httpErrorResp(w, r, http.StatusNotFound, errMsg)
 		return
 	}
+	if conflict {
+		httpPreconditionFailed(w, r)
+		return
+	}
 	if err != nil {
 		err = errors.New("DB error: failed to update garage: " + err.Error())
 		httpInternalError(w, r, err)
@@ -141,17 +255,23 @@ func (s *server) putGarage(w http.ResponseWriter, r *http.Request, id string) {
 		httpInternalError(w, r, err)
 		return
 	}
+	w.Header().Set("ETag", garageETag(respObj))
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(resp)
 }
 
 func (s *server) deleteGarage(w http.ResponseWriter, r *http.Request, id string) {
-	found, err := s.garages.removeGarage(id)
+	hard := r.URL.Query().Get(api.QueryHard) == "true"
+	found, conflict, err := s.garages.removeGarage(requestActor(r), id, hard, ifMatch(r))
 	if !found {
 		errMsg := fmt.Sprintf("resource '%s/%s' not found", api.CollectionGarages, id)
 		httpErrorResp(w, r, http.StatusNotFound, errMsg)
 		return
 	}
+	if conflict {
+		httpPreconditionFailed(w, r)
+		return
+	}
 	if err != nil {
 		err = errors.New("DB error: failed to delete garage: " + err.Error())
 		httpInternalError(w, r, err)
@@ -160,3 +280,26 @@ func (s *server) deleteGarage(w http.ResponseWriter, r *http.Request, id string)
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func (s *server) restoreGarage(w http.ResponseWriter, r *http.Request, id string) {
+	found, respObj, err := s.garages.restoreGarage(requestActor(r), id)
+	if !found {
+		errMsg := fmt.Sprintf("deleted resource '%s/%s' not found", api.CollectionGarages, id)
+		httpErrorResp(w, r, http.StatusNotFound, errMsg)
+		return
+	}
+	if err != nil {
+		err = errors.New("DB error: failed to restore garage: " + err.Error())
+		httpInternalError(w, r, err)
+		return
+	}
+
+	resp, err := json.Marshal(respObj)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", garageETag(respObj))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -13,17 +13,22 @@ import (
 )
 
 type garageManager struct {
-	db      *db.Client
-	rw      *sync.RWMutex
-	garages map[string]*resources.Garage
+	db       *db.Client
+	rw       *sync.RWMutex
+	garages  map[string]*resources.Garage
+	deleted  map[string]*resources.Garage
+	webhooks *webhookManager
+	alerts   *alertRunner
 }
 
-func newGarageManager(db *db.Client) (*garageManager, error) {
+func newGarageManager(db *db.Client, webhooks *webhookManager) (*garageManager, error) {
 	var err error
 
 	gm := &garageManager{
-		db: db,
-		rw: &sync.RWMutex{},
+		db:       db,
+		rw:       &sync.RWMutex{},
+		deleted:  make(map[string]*resources.Garage),
+		webhooks: webhooks,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -33,17 +38,53 @@ func newGarageManager(db *db.Client) (*garageManager, error) {
 		return nil, err
 	}
 
+	for id, g := range gm.garages {
+		if g.DeletedAt != nil {
+			gm.deleted[id] = g
+			delete(gm.garages, id)
+		}
+	}
+
 	for _, g := range gm.garages {
 		for i := range g.Sections {
 			g.Sections[i].Spots = make([]resources.Spot, g.Sections[i].TotalSpots)
+			if g.Sections[i].ID == "" {
+				if err = gm.assignSectionID(ctx, g, i); err != nil {
+					return nil, err
+				}
+			}
 		}
 	}
 
+	// Sessions ongoing when the server stopped go on
+	sessions, err := db.FindOngoingSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gm.storeSessions(gm.restoreSessions(sessions, time.Now()))
+
 	return gm, nil
 }
 
+func (m *garageManager) assignSectionID(ctx context.Context, garage *resources.Garage, i int) error {
+	// Sections created before section IDs were introduced get one on startup
+	id := m.uniqueSectionID()
+	if err := m.db.SetSectionID(ctx, garage.ID, garage.Sections[i].Name, id); err != nil {
+		return err
+	}
+	garage.Sections[i].ID = id
+	log.Infof("Section '%s' (garage id %s) assigned id %s", garage.Sections[i].Name, garage.ID, id)
+	return nil
+}
+
 func (m *garageManager) uniqueID() string {
 	m.rw.RLock()
+	defer m.rw.RUnlock()
+	return m.newGarageID()
+}
+
+func (m *garageManager) newGarageID() string {
+	// NOTE: This function is *not* thread-safe
 	for {
 		id, err := util.NewRandomID()
 		if err != nil {
@@ -51,8 +92,7 @@ func (m *garageManager) uniqueID() string {
 			continue
 		}
 
-		if _, exists := m.garages[id]; !exists {
-			m.rw.RUnlock()
+		if !m.garageIDTaken(id) {
 			return id
 		}
 
@@ -60,8 +100,49 @@ func (m *garageManager) uniqueID() string {
 	}
 }
 
+func (m *garageManager) garageIDTaken(id string) bool {
+	// NOTE: This function is *not* thread-safe
+	_, exists := m.garages[id]
+	_, deleted := m.deleted[id]
+	return exists || deleted
+}
+
+func (m *garageManager) uniqueSectionID() string {
+	// NOTE: This function is *not* thread-safe
+	for {
+		id, err := util.NewRandomID()
+		if err != nil {
+			log.Errorf("Failed to obtain a section ID: %v", err)
+			continue
+		}
+
+		if !m.sectionIDTaken(id) {
+			return id
+		}
+
+		log.Infof("Section ID collision prevented. ID: '%s'", id)
+	}
+}
+
+func (m *garageManager) sectionIDTaken(id string) bool {
+	// NOTE: This function is *not* thread-safe
+	for _, garages := range []map[string]*resources.Garage{m.garages, m.deleted} {
+		for _, g := range garages {
+			for _, sections := range [][]resources.Section{g.Sections, g.DeletedSections} {
+				for _, s := range sections {
+					if s.ID == id {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
 func (m *garageManager) getGarages() []resources.GarageRespObj {
 	m.rw.RLock()
+	now := time.Now()
 	respArray := []resources.GarageRespObj{}
 	for _, v := range m.garages {
 		respObj := resources.GarageRespObj{
@@ -70,10 +151,15 @@ func (m *garageManager) getGarages() []resources.GarageRespObj {
 			City:        v.City,
 			Address:     v.Address,
 			Geolocation: v.Geolocation,
+			Hours:       v.Hours,
+			Tariff:      v.Tariff,
+			Open:        garageOpen(v, now),
+			Version:     v.Version,
 		}
 		for _, s := range v.Sections {
 			respObj.FreeSpots += s.FreeSpots
 		}
+		respObj.FreeSpotsByType = garageFreeSpotsByType(v)
 		respArray = append(respArray, respObj)
 	}
 	m.rw.RUnlock()
@@ -93,31 +179,57 @@ func (m *garageManager) getGarage(id string) (g resources.GarageRespObj, ok bool
 	g.City = garage.City
 	g.Address = garage.Address
 	g.Geolocation = garage.Geolocation
+	g.Hours = garage.Hours
+	g.Tariff = garage.Tariff
+	g.Open = garageOpen(garage, time.Now())
+	g.Version = garage.Version
 	for _, s := range garage.Sections {
 		g.FreeSpots += s.FreeSpots
 	}
+	g.FreeSpotsByType = garageFreeSpotsByType(garage)
 	return
 }
 
-func (m *garageManager) addGarage(garage *resources.Garage) error {
-	garage.ID = m.uniqueID()
-	garage.Sections = []resources.Section{}
-
+func (m *garageManager) addGarage(actor string, garage *resources.Garage) error {
 	m.rw.Lock()
 	defer m.rw.Unlock()
 
+	garage.ID = m.newGarageID()
+	garage.Sections = []resources.Section{}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	return m.insertGarage(ctx, actor, garage)
+}
+
+func (m *garageManager) insertGarage(ctx context.Context, actor string, garage *resources.Garage) error {
+	// NOTE: This function is *not* thread-safe
+	garage.Version = 1
+	for i := range garage.Sections {
+		garage.Sections[i].Version = 1
+	}
 	if err := m.db.InsertGarage(ctx, garage); err != nil {
 		return err
 	}
+	for i := range garage.Sections {
+		garage.Sections[i].Spots = make([]resources.Spot, garage.Sections[i].TotalSpots)
+	}
 	m.garages[garage.ID] = garage
+
+	m.record(ctx, &resources.AuditEntry{
+		Actor:    actor,
+		Action:   auditGarageCreate,
+		Target:   garageTarget(garage.ID),
+		GarageID: garage.ID,
+		After:    garageState(garage),
+	})
+	for i := range garage.Sections {
+		m.recordSectionCreate(ctx, actor, garage.ID, &garage.Sections[i])
+	}
 	return nil
 }
 
-func (m *garageManager) updateGarage(id string, update *resources.Garage) (found bool, respObj resources.GarageRespObj, err error) {
-	// Note: Changing geolocation is not enabled
-
+func (m *garageManager) updateGarage(actor string, id string, update *resources.Garage, fields []string, precond precondition) (found bool, conflict bool, respObj resources.GarageRespObj, err error) {
 	m.rw.Lock()
 	defer m.rw.Unlock()
 
@@ -125,62 +237,279 @@ func (m *garageManager) updateGarage(id string, update *resources.Garage) (found
 	if !found {
 		return
 	}
+	if conflict = !precond.holds(garage.Version); conflict {
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	if err = m.db.UpdateGarage(ctx, id, update.Name, update.City, update.Address); err != nil {
+	merged := mergeGarage(*garage, update, fields)
+	if err = m.commitGarageUpdate(ctx, actor, garage, &merged, fields); err != nil {
 		return
 	}
 
-	if update.Name != "" {
-		garage.Name = update.Name
-	}
-	if update.City != "" {
-		garage.City = update.City
-	}
-	if update.Address != "" {
-		garage.Address = update.Address
-	}
-
 	respObj.ID = id
 	respObj.Name = garage.Name
 	respObj.City = garage.City
 	respObj.Address = garage.Address
 	respObj.Geolocation = garage.Geolocation
+	respObj.Hours = garage.Hours
+	respObj.Tariff = garage.Tariff
+	respObj.Open = garageOpen(garage, time.Now())
+	respObj.Version = garage.Version
+	for _, s := range garage.Sections {
+		respObj.FreeSpots += s.FreeSpots
+	}
+	respObj.FreeSpotsByType = garageFreeSpotsByType(garage)
 	return
 }
 
-func (m *garageManager) removeGarage(id string) (found bool, err error) {
+func (m *garageManager) commitGarageUpdate(ctx context.Context, actor string, garage *resources.Garage, merged *resources.Garage, fields []string) error {
+	// NOTE: This function is *not* thread-safe
+	merged.Version = garage.Version + 1
+	if err := m.db.UpdateGarage(ctx, garage.ID, merged, fields); err != nil {
+		return err
+	}
+
+	before, after := diff(garageState(garage), garageState(merged))
+	m.record(ctx, &resources.AuditEntry{
+		Actor:    actor,
+		Action:   auditGarageUpdate,
+		Target:   garageTarget(garage.ID),
+		GarageID: garage.ID,
+		Before:   before,
+		After:    after,
+	})
+
+	garage.Name = merged.Name
+	garage.City = merged.City
+	garage.Address = merged.Address
+	garage.Geolocation = merged.Geolocation
+	garage.Hours = merged.Hours
+	garage.Tariff = merged.Tariff
+	garage.Version = merged.Version
+	return nil
+}
+
+func (m *garageManager) removeGarage(actor string, id string, hard bool, precond precondition) (found bool, conflict bool, err error) {
+	var ended []*endedSession
+
+	// Sessions ended with the garage are stored once the lock is released
+	defer func() { m.storeSessions(ended) }()
 	m.rw.Lock()
 	defer m.rw.Unlock()
 
-	if _, found = m.garages[id]; !found {
+	// Soft-deleted garages can only be deleted permanently
+	garage, found := m.garages[id]
+	if !found && hard {
+		garage, found = m.deleted[id]
+	}
+	if !found {
+		return
+	}
+	if conflict = !precond.holds(garage.Version); conflict {
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	if err = m.db.DeleteGarage(ctx, id); err != nil {
+	if hard {
+		if err = m.purgeGarage(ctx, actor, garage); err == nil {
+			ended = endGarageSessions(garage, time.Now())
+		}
+		return
+	}
+
+	deletedAt := time.Now().UTC()
+	if err = m.db.SoftDeleteGarage(ctx, id, deletedAt); err != nil {
 		return
 	}
+	ended = endGarageSessions(garage, time.Now())
+	garage.DeletedAt = &deletedAt
 	delete(m.garages, id)
+	m.deleted[id] = garage
+
+	m.record(ctx, &resources.AuditEntry{
+		Actor:    actor,
+		Action:   auditGarageDelete,
+		Target:   garageTarget(id),
+		GarageID: id,
+		Before:   garageState(garage),
+	})
+	return
+}
+
+// endGarageSessions ends the ongoing sessions of all the spots of the garage
+func endGarageSessions(garage *resources.Garage, now time.Time) []*endedSession {
+	// NOTE: This function is *not* thread-safe
+	ended := []*endedSession{}
+	for i := range garage.Sections {
+		ended = append(ended, endSessions(garage, &garage.Sections[i], now, sessionRemoved)...)
+	}
+	return ended
+}
+
+func (m *garageManager) purgeGarage(ctx context.Context, actor string, garage *resources.Garage) error {
+	// NOTE: This function is *not* thread-safe
+	if err := m.db.DeleteGarage(ctx, garage.ID); err != nil {
+		return err
+	}
+	delete(m.garages, garage.ID)
+	delete(m.deleted, garage.ID)
+
+	m.record(ctx, &resources.AuditEntry{
+		Actor:    actor,
+		Action:   auditGaragePurge,
+		Target:   garageTarget(garage.ID),
+		GarageID: garage.ID,
+		Before:   garageState(garage),
+	})
+	return nil
+}
+
+func (m *garageManager) restoreGarage(actor string, id string) (found bool, respObj resources.GarageRespObj, err error) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	garage, found := m.deleted[id]
+	if !found {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = m.db.RestoreGarage(ctx, id); err != nil {
+		return
+	}
+
+	// Devices could not report while the garage was deleted, so all spots
+	// start offline
+	garage.DeletedAt = nil
+	for i := range garage.Sections {
+		garage.Sections[i].Spots = make([]resources.Spot, garage.Sections[i].TotalSpots)
+		garage.Sections[i].FreeSpots = 0
+	}
+	delete(m.deleted, id)
+	m.garages[id] = garage
+
+	m.record(ctx, &resources.AuditEntry{
+		Actor:    actor,
+		Action:   auditGarageRestore,
+		Target:   garageTarget(id),
+		GarageID: id,
+		After:    garageState(garage),
+	})
+
+	respObj = garageRespObj(garage)
 	return
 }
 
+func (m *garageManager) getDeletedGarages() []resources.GarageRespObj {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	respArray := []resources.GarageRespObj{}
+	for _, g := range m.deleted {
+		respArray = append(respArray, garageRespObj(g))
+	}
+	return respArray
+}
+
+func garageRespObj(garage *resources.Garage) resources.GarageRespObj {
+	respObj := resources.GarageRespObj{
+		ID:          garage.ID,
+		Name:        garage.Name,
+		City:        garage.City,
+		Address:     garage.Address,
+		Geolocation: garage.Geolocation,
+		Hours:       garage.Hours,
+		Tariff:      garage.Tariff,
+		Open:        garageOpen(garage, time.Now()),
+		Version:     garage.Version,
+		DeletedAt:   garage.DeletedAt,
+	}
+	for _, s := range garage.Sections {
+		respObj.FreeSpots += s.FreeSpots
+	}
+	respObj.FreeSpotsByType = garageFreeSpotsByType(garage)
+	return respObj
+}
+
 func (m *garageManager) sectionExists(garageID string, sectionName string) (bool, *resources.Garage, int) {
 	// NOTE: This function is *not* thread-safe
 	garage, ok := m.garages[garageID]
 	if !ok {
 		return false, nil, -1
 	}
+	// Current names take precedence over IDs, and IDs over former names
 	for i, s := range garage.Sections {
 		if s.Name == sectionName {
 			return true, garage, i
 		}
 	}
+	for i, s := range garage.Sections {
+		if s.ID == sectionName {
+			return true, garage, i
+		}
+	}
+	now := time.Now()
+	for i, s := range garage.Sections {
+		for _, a := range s.Aliases {
+			if a.Name == sectionName && now.Before(a.Expires) {
+				return true, garage, i
+			}
+		}
+	}
 	return false, nil, -1
 }
 
+// sectionOnline returns the ID and the name of the section, and which of its
+// spots have a device online
+func (m *garageManager) sectionOnline(garageID string, sectionName string) (id string, name string, online []bool, found bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	found, garage, i := m.sectionExists(garageID, sectionName)
+	if !found {
+		return
+	}
+	section := &garage.Sections[i]
+	online = make([]bool, len(section.Spots))
+	for j, spot := range section.Spots {
+		online[j] = spot.Online
+	}
+	return section.ID, section.Name, online, true
+}
+
+func sectionNameTaken(garage *resources.Garage, name string, except int) bool {
+	now := time.Now()
+	for i, s := range garage.Sections {
+		if i == except {
+			continue
+		}
+		if s.Name == name {
+			return true
+		}
+		for _, a := range s.Aliases {
+			if a.Name == name && now.Before(a.Expires) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func renameAliases(section *resources.Section, newName string, gracePeriod time.Duration) []resources.SectionAlias {
+	now := time.Now()
+	aliases := []resources.SectionAlias{}
+	for _, a := range section.Aliases {
+		if a.Name != newName && now.Before(a.Expires) {
+			aliases = append(aliases, a)
+		}
+	}
+	return append(aliases, resources.SectionAlias{Name: section.Name, Expires: now.Add(gracePeriod)})
+}
+
 func (m *garageManager) getSections(garageID string) (respArray []resources.SectionRespObj, found bool) {
 	m.rw.RLock()
 	defer m.rw.RUnlock()
@@ -191,15 +520,20 @@ func (m *garageManager) getSections(garageID string) (respArray []resources.Sect
 	}
 
 	respArray = []resources.SectionRespObj{}
-	for _, s := range garage.Sections {
+	for i := range garage.Sections {
+		s := &garage.Sections[i]
 		respArray = append(
 			respArray,
 			resources.SectionRespObj{
-				Name:        s.Name,
-				Level:       s.Level,
-				Description: s.Description,
-				TotalSpots:  s.TotalSpots,
-				FreeSpots:   s.FreeSpots,
+				ID:              s.ID,
+				Name:            s.Name,
+				Level:           s.Level,
+				Description:     s.Description,
+				TotalSpots:      s.TotalSpots,
+				SpotTypes:       s.SpotTypes,
+				FreeSpots:       s.FreeSpots,
+				FreeSpotsByType: sectionFreeSpotsByType(s),
+				Version:         s.Version,
 			},
 		)
 	}
@@ -215,15 +549,19 @@ func (m *garageManager) getSection(garageID string, sectionName string) (respObj
 		return
 	}
 
+	respObj.ID = garage.Sections[i].ID
 	respObj.Name = garage.Sections[i].Name
 	respObj.Level = garage.Sections[i].Level
 	respObj.Description = garage.Sections[i].Description
 	respObj.TotalSpots = garage.Sections[i].TotalSpots
+	respObj.SpotTypes = garage.Sections[i].SpotTypes
 	respObj.FreeSpots = garage.Sections[i].FreeSpots
+	respObj.FreeSpotsByType = sectionFreeSpotsByType(&garage.Sections[i])
+	respObj.Version = garage.Sections[i].Version
 	return
 }
 
-func (m *garageManager) addSection(garageID string, section *resources.Section) (garageFound bool, sectionExists bool, err error) {
+func (m *garageManager) addSection(actor string, garageID string, section *resources.Section) (garageFound bool, sectionExists bool, err error) {
 	m.rw.Lock()
 	defer m.rw.Unlock()
 
@@ -232,25 +570,52 @@ func (m *garageManager) addSection(garageID string, section *resources.Section)
 		return
 	}
 
-	for _, s := range garage.Sections {
-		if s.Name == section.Name {
-			sectionExists = true
-			return
-		}
+	if sectionExists = sectionNameTaken(garage, section.Name, -1); sectionExists {
+		return
 	}
 
+	section.ID = m.uniqueSectionID()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	if err = m.db.InsertSection(ctx, garageID, section); err != nil {
-		return
+	err = m.insertSection(ctx, actor, garage, section)
+	return
+}
+
+func (m *garageManager) insertSection(ctx context.Context, actor string, garage *resources.Garage, section *resources.Section) error {
+	// NOTE: This function is *not* thread-safe
+	section.Aliases = nil
+	section.Version = 1
+	if err := m.db.InsertSection(ctx, garage.ID, section); err != nil {
+		return err
 	}
 
 	section.Spots = make([]resources.Spot, section.TotalSpots)
 	garage.Sections = append(garage.Sections, *section)
-	return
+	m.recordSectionCreate(ctx, actor, garage.ID, section)
+	return nil
+}
+
+func (m *garageManager) recordSectionCreate(ctx context.Context, actor string, garageID string, section *resources.Section) {
+	m.record(ctx, &resources.AuditEntry{
+		Actor:     actor,
+		Action:    auditSectionCreate,
+		Target:    sectionTarget(garageID, section.ID),
+		GarageID:  garageID,
+		SectionID: section.ID,
+		After:     sectionState(section),
+	})
 }
 
-func (m *garageManager) updateSection(garageID, sectionName string, update *resources.Section) (found bool, respObj resources.SectionRespObj, err error) {
+func (m *garageManager) updateSection(actor string, garageID, sectionName string, update *resources.Section, fields []string, force bool, precond precondition) (found bool, conflict bool, nameTaken bool, inUse []int, respObj resources.SectionRespObj, err error) {
+	var (
+		ended   []*endedSession
+		changes []occupancyChange
+	)
+
+	// Sessions of removed spots are stored, and webhooks notified, once the
+	// lock is released
+	defer func() { m.storeSessions(ended); m.notify(changes) }()
 	m.rw.Lock()
 	defer m.rw.Unlock()
 
@@ -258,103 +623,468 @@ func (m *garageManager) updateSection(garageID, sectionName string, update *reso
 	if !found {
 		return
 	}
+	if conflict = !precond.holds(garage.Sections[i].Version); conflict {
+		return
+	}
+
+	section := &garage.Sections[i]
+	merged := mergeSection(*section, update, fields)
+	if nameTaken, inUse = checkSectionUpdate(garage, i, &merged, force); nameTaken || len(inUse) > 0 {
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	err = m.db.UpdateSection(
-		ctx,
-		garageID,
-		sectionName,
-		update.Name,
-		update.Level,
-		update.Description,
-		update.TotalSpots,
-	)
+	removed, ended, changes, err := m.commitSectionUpdate(ctx, actor, garage, i, &merged, fields)
 	if err != nil {
 		return
 	}
 
+	respObj = sectionRespObj(section)
+	respObj.RemovedSpots = removed
+	return
+}
+
+// checkSectionUpdate reports whether the update would rename the section to
+// a name in use, or remove spots in use, and records the former name as an
+// alias when renaming
+func checkSectionUpdate(garage *resources.Garage, i int, merged *resources.Section, force bool) (nameTaken bool, inUse []int) {
 	section := &garage.Sections[i]
-	if update.Name != "" {
-		section.Name = update.Name
+	if merged.Name != section.Name {
+		if nameTaken = sectionNameTaken(garage, merged.Name, i); nameTaken {
+			return
+		}
+		gracePeriod := time.Duration(cfg.SectionAliasGraceDays) * 24 * time.Hour
+		merged.Aliases = renameAliases(section, merged.Name, gracePeriod)
 	}
-	if update.Level != "" {
-		section.Level = update.Level
+
+	// Spots beyond the new total are dropped when shrinking; refuse to drop
+	// spots with a connected device unless the caller insists
+	if merged.TotalSpots < section.TotalSpots && !force {
+		for j, spot := range section.Spots[merged.TotalSpots:] {
+			if spot.Online || spot.Taken {
+				inUse = append(inUse, merged.TotalSpots+j+1)
+			}
+		}
 	}
-	if update.Description != "" {
-		section.Description = update.Description
+	return
+}
+
+// commitSectionUpdate stores and applies the update, and returns the removed
+// spots with the sessions ended and the occupancy changed by removing them
+func (m *garageManager) commitSectionUpdate(ctx context.Context, actor string, garage *resources.Garage, i int, merged *resources.Section, fields []string) (removed []int, ended []*endedSession, changes []occupancyChange, err error) {
+	// NOTE: This function is *not* thread-safe
+	section := &garage.Sections[i]
+	merged.Version = section.Version + 1
+	if err = m.db.UpdateSection(ctx, garage.ID, section.ID, merged, fields); err != nil {
+		return
 	}
-	if update.TotalSpots > 0 {
-		section.Spots = make([]resources.Spot, update.TotalSpots)
-		section.TotalSpots = update.TotalSpots
-		section.FreeSpots = 0
+
+	before, after := diff(sectionState(section), sectionState(merged))
+	m.record(ctx, &resources.AuditEntry{
+		Actor:     actor,
+		Action:    auditSectionUpdate,
+		Target:    sectionTarget(garage.ID, section.ID),
+		GarageID:  garage.ID,
+		SectionID: section.ID,
+		Before:    before,
+		After:     after,
+	})
+
+	section.Name = merged.Name
+	section.Aliases = merged.Aliases
+	section.Level = merged.Level
+	section.Description = merged.Description
+	section.SpotTypes = merged.SpotTypes
+	section.Version = merged.Version
+	if merged.TotalSpots != section.TotalSpots {
+		// Sessions of removed spots end with them
+		for number := merged.TotalSpots + 1; number <= section.TotalSpots; number++ {
+			if session := endSession(garage, section, number, time.Now(), sessionRemoved); session != nil {
+				ended = append(ended, session)
+			}
+		}
+
+		// Spots removed with a connected device count as going offline
+		freeBefore, offline := section.FreeSpots, 0
+		for number := merged.TotalSpots + 1; number <= section.TotalSpots; number++ {
+			if section.Spots[number-1].Online {
+				offline++
+			}
+		}
+		removed = resizeSection(section, merged.TotalSpots)
+		if change, changed := newOccupancyChange(garage, section, freeBefore, offline, time.Now()); changed {
+			changes = append(changes, change)
+		}
+		for _, number := range removed {
+			log.Infof(
+				"Update: garage: '%s' (garage id %s); section: '%s'; spot #%d removed",
+				garage.Name,
+				garage.ID,
+				section.Name,
+				number,
+			)
+		}
 	}
+	return
+}
 
-	respObj.Name = section.Name
-	respObj.Level = section.Level
-	respObj.Description = section.Description
-	respObj.TotalSpots = section.TotalSpots
-	respObj.FreeSpots = section.FreeSpots
+func resizeSection(section *resources.Section, totalSpots int) (removed []int) {
+	if totalSpots > len(section.Spots) {
+		section.Spots = append(section.Spots, make([]resources.Spot, totalSpots-len(section.Spots))...)
+	} else {
+		for number := totalSpots + 1; number <= len(section.Spots); number++ {
+			removed = append(removed, number)
+		}
+		section.Spots = section.Spots[:totalSpots:totalSpots]
+	}
+	section.TotalSpots = totalSpots
+	section.FreeSpots = countFreeSpots(section)
 	return
 }
 
-func (m *garageManager) deleteSection(garageID string, sectionName string) (found bool, err error) {
+func (m *garageManager) deleteSection(actor string, garageID string, sectionName string, hard bool, precond precondition) (found bool, conflict bool, err error) {
+	var ended []*endedSession
+
+	// Sessions ended with the section are stored once the lock is released
+	defer func() { m.storeSessions(ended) }()
 	m.rw.Lock()
 	defer m.rw.Unlock()
 
 	found, garage, i := m.sectionExists(garageID, sectionName)
 	if !found {
+		// Soft-deleted sections can only be deleted permanently
+		if found, garage, i = m.deletedSectionExists(garageID, sectionName); found && hard {
+			if conflict = !precond.holds(garage.DeletedSections[i].Version); conflict {
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err = m.purgeSection(ctx, actor, garage, i)
+		}
+		found = found && hard
+		return
+	}
+	if conflict = !precond.holds(garage.Sections[i].Version); conflict {
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	err = m.db.DeleteSection(ctx, garageID, sectionName)
-	if err != nil {
+	section := garage.Sections[i]
+	if hard {
+		if err = m.db.DeleteSection(ctx, garageID, section.ID); err != nil {
+			return
+		}
+		ended = endSessions(garage, &garage.Sections[i], time.Now(), sessionRemoved)
+		garage.Sections = append(garage.Sections[:i], garage.Sections[i+1:]...)
+		m.recordSectionPurge(ctx, actor, garageID, &section)
+		return
+	}
+
+	deletedAt := time.Now().UTC()
+	section.DeletedAt = &deletedAt
+	if err = m.db.SoftDeleteSection(ctx, garageID, &section); err != nil {
 		return
 	}
+	ended = endSessions(garage, &garage.Sections[i], time.Now(), sessionRemoved)
+	section.Spots, section.FreeSpots = nil, 0
 	garage.Sections = append(garage.Sections[:i], garage.Sections[i+1:]...)
+	garage.DeletedSections = append(garage.DeletedSections, section)
+
+	m.record(ctx, &resources.AuditEntry{
+		Actor:     actor,
+		Action:    auditSectionDelete,
+		Target:    sectionTarget(garageID, section.ID),
+		GarageID:  garageID,
+		SectionID: section.ID,
+		Before:    sectionState(&section),
+	})
 	return
 }
 
-func (m *garageManager) actionUpdate(garageID string, sectionName string, params []Params) error {
-	var err error
+func (m *garageManager) deletedSectionExists(garageID string, sectionName string) (bool, *resources.Garage, int) {
+	// NOTE: This function is *not* thread-safe
+	garage, ok := m.garages[garageID]
+	if !ok {
+		return false, nil, -1
+	}
+
+	// IDs take precedence over names, and the most recently deleted section
+	// is picked among those with the same name
+	for i, s := range garage.DeletedSections {
+		if s.ID == sectionName {
+			return true, garage, i
+		}
+	}
+	for i := len(garage.DeletedSections) - 1; i >= 0; i-- {
+		if garage.DeletedSections[i].Name == sectionName {
+			return true, garage, i
+		}
+	}
+	return false, nil, -1
+}
+
+func (m *garageManager) purgeSection(ctx context.Context, actor string, garage *resources.Garage, i int) error {
+	// NOTE: This function is *not* thread-safe
+	section := garage.DeletedSections[i]
+	if err := m.db.DeleteSection(ctx, garage.ID, section.ID); err != nil {
+		return err
+	}
+	garage.DeletedSections = append(garage.DeletedSections[:i], garage.DeletedSections[i+1:]...)
+	m.recordSectionPurge(ctx, actor, garage.ID, &section)
+	return nil
+}
+
+func (m *garageManager) recordSectionPurge(ctx context.Context, actor string, garageID string, section *resources.Section) {
+	m.record(ctx, &resources.AuditEntry{
+		Actor:     actor,
+		Action:    auditSectionPurge,
+		Target:    sectionTarget(garageID, section.ID),
+		GarageID:  garageID,
+		SectionID: section.ID,
+		Before:    sectionState(section),
+	})
+}
+
+func (m *garageManager) restoreSection(actor string, garageID string, sectionName string) (found bool, nameTaken bool, respObj resources.SectionRespObj, err error) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	found, garage, i := m.deletedSectionExists(garageID, sectionName)
+	if !found {
+		return
+	}
+
+	section := garage.DeletedSections[i]
+	if nameTaken = sectionNameTaken(garage, section.Name, -1); nameTaken {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	section.DeletedAt = nil
+	if err = m.db.RestoreSection(ctx, garageID, &section); err != nil {
+		return
+	}
+	section.Spots = make([]resources.Spot, section.TotalSpots)
+	garage.DeletedSections = append(garage.DeletedSections[:i], garage.DeletedSections[i+1:]...)
+	garage.Sections = append(garage.Sections, section)
+
+	m.record(ctx, &resources.AuditEntry{
+		Actor:     actor,
+		Action:    auditSectionRestore,
+		Target:    sectionTarget(garageID, section.ID),
+		GarageID:  garageID,
+		SectionID: section.ID,
+		After:     sectionState(&section),
+	})
+
+	respObj = sectionRespObj(&section)
+	return
+}
+
+func (m *garageManager) getDeletedSections(garageID string) (respArray []resources.SectionRespObj, found bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	garage, found := m.garages[garageID]
+	if !found {
+		return
+	}
+
+	respArray = []resources.SectionRespObj{}
+	for i := range garage.DeletedSections {
+		respArray = append(respArray, sectionRespObj(&garage.DeletedSections[i]))
+	}
+	return
+}
+
+func sectionRespObj(section *resources.Section) resources.SectionRespObj {
+	return resources.SectionRespObj{
+		ID:              section.ID,
+		Name:            section.Name,
+		Level:           section.Level,
+		Description:     section.Description,
+		TotalSpots:      section.TotalSpots,
+		SpotTypes:       section.SpotTypes,
+		FreeSpots:       section.FreeSpots,
+		FreeSpotsByType: sectionFreeSpotsByType(section),
+		Version:         section.Version,
+		DeletedAt:       section.DeletedAt,
+	}
+}
+
+// purgeDeleted permanently deletes garages and sections which have been
+// soft-deleted for longer than the retention period
+func (m *garageManager) purgeDeleted(retention time.Duration) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	expired := time.Now().Add(-retention)
+	for _, g := range m.deleted {
+		if g.DeletedAt.Before(expired) {
+			if err := m.purgeGarage(ctx, auditRetention, g); err != nil {
+				log.Errorf("DB: failed to purge garage id %s: %v", g.ID, err)
+			}
+		}
+	}
+
+	for _, garages := range []map[string]*resources.Garage{m.garages, m.deleted} {
+		for _, g := range garages {
+			for i := len(g.DeletedSections) - 1; i >= 0; i-- {
+				if g.DeletedSections[i].DeletedAt.Before(expired) {
+					if err := m.purgeSection(ctx, auditRetention, g, i); err != nil {
+						log.Errorf("DB: failed to purge section id %s (garage id %s): %v", g.DeletedSections[i].ID, g.ID, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// actionUpdate applies the updates of the section's spots, and reports
+// whether the section exists and what became of each update
+func (m *garageManager) actionUpdate(garageID string, sectionName string, params []Params) (bool, []resources.UpdateResult) {
+	var (
+		results []resources.UpdateResult
+		started []resources.Session
+		ended   []*endedSession
+		changes []occupancyChange
+		alerts  []resources.DeviceAlert
+	)
 
+	// Started and ended sessions are stored, and webhooks and alert sinks
+	// notified, once the lock is released
+	defer func() {
+		m.storeOngoingSessions(started)
+		m.storeSessions(ended)
+		m.notify(changes)
+		m.alert(alerts)
+	}()
 	m.rw.Lock()
 	defer m.rw.Unlock()
 
 	exists, garage, i := m.sectionExists(garageID, sectionName)
 	if !exists {
-		return fmt.Errorf("section '%s', garage id %s not found", sectionName, garageID)
+		return false, nil
 	}
+	freeBefore, offline := garage.Sections[i].FreeSpots, 0
 
 	for _, param := range params {
+		result := resources.UpdateResult{Number: param.Number, Result: updateApplied}
 		if param.Number < 1 || param.Number > garage.Sections[i].TotalSpots {
-			if err == nil {
-				err = fmt.Errorf(
-					"%d is not a valid spot number for section '%s', garage '%s' (garage id %s)",
-					param.Number,
-					sectionName,
-					garage.Name,
-					garageID,
-				)
-			} else {
-				err = fmt.Errorf(
-					"%v\n%d is not a valid spot number for section '%s', garage '%s' (garage id %s)",
-					err,
-					param.Number,
-					sectionName,
-					garage.Name,
-					garageID,
-				)
-			}
+			result.Result = updateRejected
+			result.Reason = fmt.Sprintf(
+				"%d is not a valid spot number for section '%s', garage '%s' (garage id %s)",
+				param.Number,
+				garage.Sections[i].Name,
+				garage.Name,
+				garageID,
+			)
+			results = append(results, result)
 			continue
 		}
 
+		now := time.Now()
 		spot := &garage.Sections[i].Spots[param.Number-1]
-		if !param.Taken {
+
+		// An observed time slightly ahead of the server's clock is taken as
+		// now, one further ahead is a broken device clock
+		observed := now
+		if param.ObservedAt != nil {
+			if param.ObservedAt.After(now.Add(maxClockSkew)) {
+				result.Result = updateRejected
+				result.Reason = fmt.Sprintf("observed at %s, in the future", param.ObservedAt.Format(time.RFC3339))
+				results = append(results, result)
+				continue
+			}
+			if param.ObservedAt.Before(now) {
+				observed = *param.ObservedAt
+			}
+		}
+
+		// Delayed updates older than the spot's state are ignored, as are
+		// retried ones, which the sequence tells apart when the observed
+		// times do not
+		if observed.Before(spot.ObservedAt) {
+			result.Result = updateIgnored
+			result.Reason = fmt.Sprintf(
+				"state observed at %s, newer state observed at %s",
+				observed.Format(time.RFC3339),
+				spot.ObservedAt.Format(time.RFC3339),
+			)
+		} else if param.Sequence != nil && spot.Sequence != 0 && *param.Sequence <= spot.Sequence &&
+			(param.ObservedAt == nil || !observed.After(spot.ObservedAt)) {
+			result.Result = updateIgnored
+			result.Reason = fmt.Sprintf("sequence %d, newer sequence %d", *param.Sequence, spot.Sequence)
+		}
+		results = append(results, result)
+
+		if result.Result == updateIgnored {
+			// Ignored updates still show that the device is alive
+			if spot.Online {
+				spot.LastUpdate, spot.LastSeen = now, now
+			}
+			log.Infof(
+				"Update: garage: '%s' (garage id %s); section: '%s'; spot #%d; update ignored: %s",
+				garage.Name,
+				garageID,
+				garage.Sections[i].Name,
+				param.Number,
+				result.Reason,
+			)
+			continue
+		}
+
+		// A device whose sensor fails is alive, but the state of its spot is
+		// unknown, so the spot is offline until the sensor recovers
+		if param.Fault {
+			if param.Label != "" {
+				spot.Label = param.Label
+			}
+			spot.LastSeen, spot.LastLabel = now, spotLabel(spot)
+			spot.ObservedAt, spot.Sequence = observed, 0
+			if param.Sequence != nil {
+				spot.Sequence = *param.Sequence
+			}
+			if spot.OfflineReason == offlineSensorFault {
+				continue
+			}
+
+			// Sessions restored on startup end although the spot is not
+			// online yet
+			if session := endSession(garage, &garage.Sections[i], param.Number, observed, sessionSensorFault); session != nil {
+				ended = append(ended, session)
+			}
+			if spot.Online {
+				if !spot.Taken {
+					garage.Sections[i].FreeSpots--
+				}
+				offline++
+			}
+			spot.OfflineSince, spot.OfflineReason = observed, offlineSensorFault
+			spot.Label, spot.Taken, spot.Online, spot.LastUpdate = "", false, false, time.Time{}
+			alerts = append(alerts, deviceAlert(alertSensorFault, garage, &garage.Sections[i], param.Number, now))
+
+			log.Infof(
+				"Update: garage: '%s' (garage id %s); section: '%s'; spot #%d (label '%s') sensor fault",
+				garage.Name,
+				garageID,
+				garage.Sections[i].Name,
+				param.Number,
+				spot.LastLabel,
+			)
+			continue
+		}
+
+		wasFree := spot.Online && !spot.Taken
+		if !wasFree && !param.Taken {
 			garage.Sections[i].FreeSpots++
-		} else if spot.Online {
+		} else if wasFree && param.Taken {
 			garage.Sections[i].FreeSpots--
 		}
 
@@ -362,27 +1092,63 @@ func (m *garageManager) actionUpdate(garageID string, sectionName string, params
 			spot.Label = param.Label
 		}
 
+		wasTaken := spot.Online && spot.Taken
+		wasOnline := spot.Online
 		spot.Online = true
 		spot.Taken = param.Taken
-		spot.LastUpdate = time.Now()
+		spot.LastUpdate = now
+		spot.LastSeen = now
+		spot.ObservedAt = observed
+		spot.Sequence = 0
+		if param.Sequence != nil {
+			spot.Sequence = *param.Sequence
+		}
+
+		// A device which timed out, or whose sensor failed, is back
+		if !wasOnline && (spot.OfflineReason == offlineTimedOut || spot.OfflineReason == offlineSensorFault) {
+			alerts = append(alerts, deviceAlert(alertDeviceOnline, garage, &garage.Sections[i], param.Number, now))
+		}
+		spot.OfflineSince, spot.OfflineReason = time.Time{}, ""
+
+		// Sessions start and end when the device saw the spot change. A
+		// session restored on startup goes on if the spot is still taken.
+		if !wasTaken && param.Taken {
+			if session := startSession(garage, &garage.Sections[i], param.Number, observed); session != nil {
+				started = append(started, *session)
+			}
+		} else if !param.Taken {
+			if session := endSession(garage, &garage.Sections[i], param.Number, observed, sessionFreed); session != nil {
+				ended = append(ended, session)
+			}
+		}
 
 		log.Infof(
 			"Update: garage: '%s' (garage id %s); section: '%s'; spot #%d (label '%s'); taken: %v",
 			garage.Name,
 			garageID,
-			sectionName,
+			garage.Sections[i].Name,
 			param.Number,
 			spot.Label,
 			param.Taken,
 		)
 	}
 
-	return err
+	if change, changed := newOccupancyChange(garage, &garage.Sections[i], freeBefore, offline, time.Now()); changed {
+		changes = append(changes, change)
+	}
+	return true, results
 }
 
 func (m *garageManager) actionDisconnect(garageID string, sectionName string, params []Params) error {
-	var err error
+	var (
+		err     error
+		ended   []*endedSession
+		changes []occupancyChange
+	)
 
+	// Ended sessions are stored, and webhooks notified, once the lock is
+	// released
+	defer func() { m.storeSessions(ended); m.notify(changes) }()
 	m.rw.Lock()
 	defer m.rw.Unlock()
 
@@ -390,6 +1156,7 @@ func (m *garageManager) actionDisconnect(garageID string, sectionName string, pa
 	if !exists {
 		return fmt.Errorf("section '%s', garage id %s not found", sectionName, garageID)
 	}
+	freeBefore, offline := garage.Sections[i].FreeSpots, 0
 
 	for _, param := range params {
 
@@ -398,7 +1165,7 @@ func (m *garageManager) actionDisconnect(garageID string, sectionName string, pa
 				err = fmt.Errorf(
 					"%d is not a valid spot number for section '%s', garage '%s' (garage id %s)",
 					param.Number,
-					sectionName,
+					garage.Sections[i].Name,
 					garage.Name,
 					garageID,
 				)
@@ -407,7 +1174,7 @@ func (m *garageManager) actionDisconnect(garageID string, sectionName string, pa
 					"%v\n%d is not a valid spot number for section '%s', garage '%s' (garage id %s)",
 					err,
 					param.Number,
-					sectionName,
+					garage.Sections[i].Name,
 					garage.Name,
 					garageID,
 				)
@@ -415,27 +1182,47 @@ func (m *garageManager) actionDisconnect(garageID string, sectionName string, pa
 			continue
 		}
 
+		// Sessions restored on startup end although the spot is not online yet
+		if session := endSession(garage, &garage.Sections[i], param.Number, time.Now(), sessionDisconnected); session != nil {
+			ended = append(ended, session)
+		}
 		if spot := &garage.Sections[i].Spots[param.Number-1]; spot.Online {
 			if !spot.Taken {
 				garage.Sections[i].FreeSpots--
 			}
+			spot.LastSeen, spot.LastLabel = time.Now(), spotLabel(spot)
+			spot.OfflineSince, spot.OfflineReason = spot.LastSeen, offlineDisconnected
+			spot.ObservedAt, spot.Sequence = spot.LastSeen, 0
 			spot.Label, spot.Taken, spot.Online, spot.LastUpdate = "", false, false, time.Time{}
+			offline++
 
 			log.Infof(
 				"Update: garage: '%s' (garage id %s); section: '%s'; spot #%d (label '%s') disconnected",
 				garage.Name,
 				garageID,
-				sectionName,
+				garage.Sections[i].Name,
 				param.Number,
 				spot.Label,
 			)
 		}
 	}
 
+	if change, changed := newOccupancyChange(garage, &garage.Sections[i], freeBefore, offline, time.Now()); changed {
+		changes = append(changes, change)
+	}
 	return err
 }
 
 func (m *garageManager) invalidateOldUpdates() {
+	var (
+		ended   []*endedSession
+		changes []occupancyChange
+		alerts  []resources.DeviceAlert
+	)
+
+	// Ended sessions are stored, and webhooks and alert sinks notified, once
+	// the lock is released
+	defer func() { m.storeSessions(ended); m.notify(changes); m.alert(alerts) }()
 	m.rw.Lock()
 	defer m.rw.Unlock()
 
@@ -443,6 +1230,7 @@ func (m *garageManager) invalidateOldUpdates() {
 
 	for _, g := range m.garages {
 		for i := range g.Sections {
+			freeBefore, offline := g.Sections[i].FreeSpots, 0
 			for j := range g.Sections[i].Spots {
 				spot := &g.Sections[i].Spots[j]
 				if spot.Online {
@@ -450,13 +1238,99 @@ func (m *garageManager) invalidateOldUpdates() {
 						if !spot.Taken {
 							g.Sections[i].FreeSpots--
 						}
+						if session := endSession(g, &g.Sections[i], j+1, now, sessionTimedOut); session != nil {
+							ended = append(ended, session)
+						}
+						spot.LastSeen, spot.LastLabel = spot.LastUpdate, spotLabel(spot)
+						spot.OfflineSince, spot.OfflineReason = now, offlineTimedOut
+						spot.Drops = append(recentDrops(spot.Drops, now), now)
+						alerts = append(alerts, deviceAlert(alertDeviceOffline, g, &g.Sections[i], j+1, now))
+						if len(spot.Drops) == cfg.Alerts.FlappingDrops {
+							alerts = append(alerts, deviceAlert(alertDeviceFlapping, g, &g.Sections[i], j+1, now))
+						}
+
+						log.Infof(
+							"Update: garage: '%s' (garage id %s); section: '%s'; spot #%d (label '%s') timed out, last seen %s",
+							g.Name,
+							g.ID,
+							g.Sections[i].Name,
+							j+1,
+							spot.LastLabel,
+							spot.LastSeen.Format(time.RFC3339),
+						)
+
 						spot.Label = ""
 						spot.Taken = false
 						spot.Online = false
 						spot.LastUpdate = time.Time{}
+						offline++
+					}
+				} else if spot.Session != nil && now.Sub(spot.LastUpdate) > 20*time.Minute {
+					// The device of a spot with a session restored on
+					// startup did not update it
+					if session := endSession(g, &g.Sections[i], j+1, now, sessionTimedOut); session != nil {
+						ended = append(ended, session)
 					}
+					spot.LastUpdate = time.Time{}
 				}
 			}
+			if change, changed := newOccupancyChange(g, &g.Sections[i], freeBefore, offline, now); changed {
+				changes = append(changes, change)
+			}
+		}
+	}
+}
+
+// notify queues webhook events of the changes
+func (m *garageManager) notify(changes []occupancyChange) {
+	if m.webhooks != nil {
+		m.webhooks.notify(changes)
+	}
+}
+
+func countFreeSpots(section *resources.Section) int {
+	free := 0
+	for _, spot := range section.Spots {
+		if spot.Online && !spot.Taken {
+			free++
+		}
+	}
+	return free
+}
+
+func (m *garageManager) auditFreeSpots() []resources.FreeSpotsDiscrepancy {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	discrepancies := []resources.FreeSpotsDiscrepancy{}
+	for _, g := range m.garages {
+		for i := range g.Sections {
+			section := &g.Sections[i]
+			free := countFreeSpots(section)
+			if free == section.FreeSpots {
+				continue
+			}
+
+			log.Errorf(
+				"Audit: garage: '%s' (garage id %s); section: '%s'; free spots recorded: %d, counted: %d",
+				g.Name,
+				g.ID,
+				section.Name,
+				section.FreeSpots,
+				free,
+			)
+
+			discrepancies = append(
+				discrepancies,
+				resources.FreeSpotsDiscrepancy{
+					GarageID:      g.ID,
+					SectionName:   section.Name,
+					RecordedCount: section.FreeSpots,
+					ActualCount:   free,
+				},
+			)
+			section.FreeSpots = free
 		}
 	}
+	return discrepancies
 }
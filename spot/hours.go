@@ -0,0 +1,135 @@
+package spot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cicovic-andrija/spot/resources"
+)
+
+const (
+	clockLayout = "15:04"
+	dateLayout  = "2006-01-02"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// clockMinutes returns the number of minutes since midnight, "24:00" being
+// the end of the day
+func clockMinutes(clock string) (int, error) {
+	if clock == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse(clockLayout, clock)
+	if err != nil {
+		return 0, fmt.Errorf("illegal time '%s', use format HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func validOpeningHours(hours *resources.OpeningHours) error {
+	if hours == nil {
+		return nil
+	}
+	if _, err := time.LoadLocation(hours.Timezone); err != nil {
+		return fmt.Errorf("unknown time zone '%s'", hours.Timezone)
+	}
+
+	for _, p := range hours.Weekly {
+		if _, ok := weekdays[strings.ToLower(p.Day)]; !ok {
+			return fmt.Errorf("illegal day '%s', use the name of a day of the week", p.Day)
+		}
+		if _, err := clockMinutes(p.Open); err != nil {
+			return err
+		}
+		if _, err := clockMinutes(p.Close); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range hours.Exceptions {
+		if _, err := time.Parse(dateLayout, p.Date); err != nil {
+			return fmt.Errorf("illegal date '%s', use format YYYY-MM-DD", p.Date)
+		}
+		if p.Open == "" && p.Close == "" {
+			continue
+		}
+		if _, err := clockMinutes(p.Open); err != nil {
+			return err
+		}
+		if _, err := clockMinutes(p.Close); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// periodsOn returns the opening periods of the given day, which are those of
+// its exceptions if there are any
+func periodsOn(hours *resources.OpeningHours, day time.Time) []resources.OpeningPeriod {
+	date := day.Format(dateLayout)
+	periods := []resources.OpeningPeriod{}
+	excepted := false
+	for _, p := range hours.Exceptions {
+		if p.Date != date {
+			continue
+		}
+		excepted = true
+		if p.Open != "" || p.Close != "" {
+			periods = append(periods, p)
+		}
+	}
+	if excepted {
+		return periods
+	}
+
+	for _, p := range hours.Weekly {
+		if weekdays[strings.ToLower(p.Day)] == day.Weekday() {
+			periods = append(periods, p)
+		}
+	}
+	return periods
+}
+
+// garageOpen reports whether the garage is open at the given time
+func garageOpen(garage *resources.Garage, now time.Time) bool {
+	hours := garage.Hours
+	if hours == nil {
+		return true
+	}
+
+	// Opening hours are validated when set, so errors are not expected here
+	loc, err := time.LoadLocation(hours.Timezone)
+	if err != nil {
+		return true
+	}
+	now = now.In(loc)
+	minute := now.Hour()*60 + now.Minute()
+
+	for _, p := range periodsOn(hours, now) {
+		opening, _ := clockMinutes(p.Open)
+		closing, _ := clockMinutes(p.Close)
+		if minute >= opening && (closing <= opening || minute < closing) {
+			return true
+		}
+	}
+
+	// Periods closing after midnight carry over to the next day
+	for _, p := range periodsOn(hours, now.AddDate(0, 0, -1)) {
+		opening, _ := clockMinutes(p.Open)
+		closing, _ := clockMinutes(p.Close)
+		if closing <= opening && minute < closing {
+			return true
+		}
+	}
+	return false
+}
@@ -32,6 +32,54 @@ func readconfig() {
 		fmt.Fprintf(os.Stderr, "Error: %v", err)
 		os.Exit(1)
 	}
+
+	if cfg.SectionAliasGraceDays <= 0 {
+		cfg.SectionAliasGraceDays = 30
+	}
+
+	if cfg.DeletedRetentionDays <= 0 {
+		cfg.DeletedRetentionDays = 30
+	}
+
+	if len(cfg.Alerts.Sinks) == 0 {
+		cfg.Alerts.Sinks = []config.AlertSink{{Type: "log"}}
+	}
+
+	if cfg.Alerts.FlappingDrops <= 0 {
+		cfg.Alerts.FlappingDrops = 3
+	}
+
+	if cfg.Alerts.FlappingWindowMinutes <= 0 {
+		cfg.Alerts.FlappingWindowMinutes = 6 * 60
+	}
+
+	if cfg.DBConfig.AuditCollection == "" {
+		cfg.DBConfig.AuditCollection = "audit"
+	}
+
+	if cfg.DBConfig.SessionsCollection == "" {
+		cfg.DBConfig.SessionsCollection = "sessions"
+	}
+
+	if cfg.DBConfig.WebhooksCollection == "" {
+		cfg.DBConfig.WebhooksCollection = "webhooks"
+	}
+
+	if cfg.DBConfig.WebhookQueueCollection == "" {
+		cfg.DBConfig.WebhookQueueCollection = "webhook_queue"
+	}
+
+	if cfg.DBConfig.DevicesCollection == "" {
+		cfg.DBConfig.DevicesCollection = "devices"
+	}
+
+	if cfg.DBConfig.ProvisioningCollection == "" {
+		cfg.DBConfig.ProvisioningCollection = "provisioning"
+	}
+
+	if cfg.DBConfig.RegistrationsCollection == "" {
+		cfg.DBConfig.RegistrationsCollection = "registrations"
+	}
 }
 
 func init() {
@@ -46,8 +94,15 @@ func systemsetup() *server {
 	}
 }
 
-// Run initialies and runs the service
+// Run initialies and runs the service, or runs the command named by the
+// first argument
 func Run() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	srvr := systemsetup()
 	srvr.run()
 }
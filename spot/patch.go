@@ -0,0 +1,203 @@
+package spot
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/cicovic-andrija/spot/resources"
+)
+
+// PUT replaces all properties of a resource, while PATCH applies a JSON Merge
+// Patch (RFC 7396): only the members present in the patch are changed, and a
+// member set to null clears the property. Both are carried out as a list of
+// changed properties, where a nil list stands for all of them. Properties of
+// nested objects are listed as "object.property".
+
+var (
+	garageProperties = []string{
+		"name", "city", "address", "geolocation.longitude", "geolocation.latitude",
+		"hours.timezone", "hours.weekly", "hours.exceptions",
+		"tariff.currency", "tariff.timezone", "tariff.hourly_rate", "tariff.daily_cap", "tariff.bands", "tariff.surcharges",
+	}
+	sectionProperties = []string{"name", "level", "description", "total_spots", "spot_types"}
+)
+
+func mergePatchFields(body []byte, properties []string) ([]string, error) {
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return nil, err
+	}
+	if patch == nil {
+		return nil, errors.New("merge patch must be a JSON object")
+	}
+
+	fields := []string{}
+	for _, p := range properties {
+		name, nested := p, ""
+		if i := strings.Index(p, "."); i >= 0 {
+			name, nested = p[:i], p[i+1:]
+		}
+
+		value, ok := patch[name]
+		if !ok {
+			continue
+		}
+
+		// A null object clears all of its properties
+		if nested != "" && string(value) != "null" {
+			var object map[string]json.RawMessage
+			if err := json.Unmarshal(value, &object); err != nil {
+				return nil, err
+			}
+			if _, ok = object[nested]; !ok {
+				continue
+			}
+		}
+		fields = append(fields, p)
+	}
+	return fields, nil
+}
+
+func hasField(fields []string, field string) bool {
+	if fields == nil {
+		return true
+	}
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// hasObject reports whether any of the object's properties is listed
+func hasObject(fields []string, object string) bool {
+	if fields == nil {
+		return true
+	}
+	for _, f := range fields {
+		if strings.HasPrefix(f, object+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeGarage(garage resources.Garage, update *resources.Garage, fields []string) resources.Garage {
+	if hasField(fields, "name") {
+		garage.Name = update.Name
+	}
+	if hasField(fields, "city") {
+		garage.City = update.City
+	}
+	if hasField(fields, "address") {
+		garage.Address = update.Address
+	}
+	if hasField(fields, "geolocation.longitude") {
+		garage.Geolocation.Longitude = update.Geolocation.Longitude
+	}
+	if hasField(fields, "geolocation.latitude") {
+		garage.Geolocation.Latitude = update.Geolocation.Latitude
+	}
+	garage.Hours = mergeHours(garage.Hours, update.Hours, fields)
+	garage.Tariff = mergeTariff(garage.Tariff, update.Tariff, fields)
+	return garage
+}
+
+// mergeHours returns new opening hours with the listed properties merged, as
+// opening hours are replaced rather than changed. Null hours, which list all
+// of their properties, are cleared.
+func mergeHours(hours *resources.OpeningHours, update *resources.OpeningHours, fields []string) *resources.OpeningHours {
+	if !hasObject(fields, "hours") {
+		return hours
+	}
+	if fields == nil || update == nil {
+		return update
+	}
+
+	merged := resources.OpeningHours{}
+	if hours != nil {
+		merged = *hours
+	}
+	if hasField(fields, "hours.timezone") {
+		merged.Timezone = update.Timezone
+	}
+	if hasField(fields, "hours.weekly") {
+		merged.Weekly = update.Weekly
+	}
+	if hasField(fields, "hours.exceptions") {
+		merged.Exceptions = update.Exceptions
+	}
+	return &merged
+}
+
+// mergeTariff returns a new tariff with the listed properties merged, as
+// tariffs are replaced rather than changed. Surcharges are merged by spot
+// type, a null surcharge removing it. A null tariff, which lists all of its
+// properties, is cleared.
+func mergeTariff(tariff *resources.Tariff, update *resources.Tariff, fields []string) *resources.Tariff {
+	if !hasObject(fields, "tariff") {
+		return tariff
+	}
+	if fields == nil || update == nil {
+		return update
+	}
+
+	merged := resources.Tariff{}
+	if tariff != nil {
+		merged = *tariff
+	}
+	if hasField(fields, "tariff.currency") {
+		merged.Currency = update.Currency
+	}
+	if hasField(fields, "tariff.timezone") {
+		merged.Timezone = update.Timezone
+	}
+	if hasField(fields, "tariff.hourly_rate") {
+		merged.HourlyRate = update.HourlyRate
+	}
+	if hasField(fields, "tariff.daily_cap") {
+		merged.DailyCap = update.DailyCap
+	}
+	if hasField(fields, "tariff.bands") {
+		merged.Bands = update.Bands
+	}
+	if hasField(fields, "tariff.surcharges") {
+		// Null surcharges are decoded as zero, which is no surcharge
+		surcharges := make(map[string]float64)
+		if update.Surcharges != nil {
+			for t, s := range merged.Surcharges {
+				surcharges[t] = s
+			}
+		}
+		for t, s := range update.Surcharges {
+			if s == 0 {
+				delete(surcharges, t)
+			} else {
+				surcharges[t] = s
+			}
+		}
+		merged.Surcharges = surcharges
+	}
+	return &merged
+}
+
+func mergeSection(section resources.Section, update *resources.Section, fields []string) resources.Section {
+	if hasField(fields, "name") {
+		section.Name = update.Name
+	}
+	if hasField(fields, "level") {
+		section.Level = update.Level
+	}
+	if hasField(fields, "description") {
+		section.Description = update.Description
+	}
+	if hasField(fields, "total_spots") {
+		section.TotalSpots = update.TotalSpots
+	}
+	if hasField(fields, "spot_types") {
+		section.SpotTypes = update.SpotTypes
+	}
+	return section
+}
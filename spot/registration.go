@@ -0,0 +1,498 @@
+package spot
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cicovic-andrija/spot/api"
+	"github.com/cicovic-andrija/spot/resources"
+	"github.com/cicovic-andrija/spot/util"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultTokenValidity is how long a provisioning token is valid unless
+	// it is given an expiry time
+	defaultTokenValidity = 7 * 24 * time.Hour
+
+	// maxRegisteredSpots is the most spots a device can register for
+	maxRegisteredSpots = 64
+)
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func validSecret(reg *resources.DeviceRegistration, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(reg.SecretHash)) == 1
+}
+
+func (m *deviceManager) findToken(token string, now time.Time) *resources.ProvisioningToken {
+	// NOTE: This function is *not* thread-safe
+	for _, t := range m.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 && now.Before(t.ExpiresAt) {
+			return t
+		}
+	}
+	return nil
+}
+
+func (m *deviceManager) getTokens() []resources.ProvisioningToken {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	respArray := []resources.ProvisioningToken{}
+	for _, t := range m.tokens {
+		respObj := *t
+		respObj.Token = ""
+		respArray = append(respArray, respObj)
+	}
+	sort.Slice(respArray, func(i, j int) bool { return respArray[i].CreatedAt.Before(respArray[j].CreatedAt) })
+	return respArray
+}
+
+// addToken creates the provisioning token for the section of the garage,
+// valid for a week unless it is given an expiry time
+func (m *deviceManager) addToken(garages *garageManager, token *resources.ProvisioningToken) (found bool, err error) {
+	sectionID, _, _, found := garages.sectionOnline(token.GarageID, token.Section)
+	if !found {
+		return
+	}
+
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	for token.ID == "" || m.tokens[token.ID] != nil {
+		if token.ID, err = util.NewRandomID(); err != nil {
+			return
+		}
+	}
+	if token.Token, err = randomHex(16); err != nil {
+		return
+	}
+	token.SectionID = sectionID
+	token.Section = ""
+	token.CreatedAt = time.Now().UTC()
+	if token.ExpiresAt.IsZero() {
+		token.ExpiresAt = token.CreatedAt.Add(defaultTokenValidity)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = m.db.InsertProvisioningToken(ctx, token); err != nil {
+		return
+	}
+
+	m.tokens[token.ID] = token
+	return
+}
+
+func (m *deviceManager) removeToken(id string) (found bool, err error) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	if _, found = m.tokens[id]; !found {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = m.db.DeleteProvisioningToken(ctx, id); err != nil {
+		return
+	}
+
+	delete(m.tokens, id)
+	return
+}
+
+func (m *deviceManager) getRegistration(garages *garageManager, id string) (respObj resources.DeviceRegistration, found bool) {
+	m.rw.RLock()
+	reg, found := m.registrations[id]
+	if found {
+		respObj = *reg
+	}
+	m.rw.RUnlock()
+
+	if found {
+		_, respObj.SectionName, _, _ = garages.sectionOnline(respObj.GarageID, respObj.SectionID)
+	}
+	return
+}
+
+// register confirms the spots the device is registered for, or assigns it
+// the lowest numbered spots of the token's section which are neither assigned
+// to another device nor online. A device is assigned spots anew when its
+// section is gone, or it registers for a different number of spots, keeping
+// its secret. The secret of a device registering for the first time is
+// generated and returned.
+func (m *deviceManager) register(garages *garageManager, id string, req *resources.RegistrationReq) (respObj resources.DeviceRegistration, created bool, authorized bool, found bool, full bool, err error) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	token := m.findToken(req.Token, time.Now())
+	reg, registered := m.registrations[id]
+	if token == nil || registered && !validSecret(reg, req.Secret) {
+		return
+	}
+	authorized = true
+
+	if registered && len(reg.Spots) == req.Spots {
+		if _, name, online, ok := garages.sectionOnline(reg.GarageID, reg.SectionID); ok && reg.Spots[len(reg.Spots)-1].Number <= len(online) {
+			respObj = *reg
+			respObj.SectionName = name
+			found = true
+			return
+		}
+	}
+
+	sectionID, name, online, found := garages.sectionOnline(token.GarageID, token.SectionID)
+	if !found {
+		return
+	}
+
+	// Spots assigned to the device before are free for it, even though its
+	// updates keep them online
+	own := make(map[int]bool)
+	assigned := make(map[int]bool)
+	for _, r := range m.registrations {
+		if r.GarageID != token.GarageID || r.SectionID != sectionID {
+			continue
+		}
+		for _, spot := range r.Spots {
+			if r.DeviceID == id {
+				own[spot.Number] = true
+			} else {
+				assigned[spot.Number] = true
+			}
+		}
+	}
+	spots := []resources.AssignedSpot{}
+	for number := 1; number <= len(online) && len(spots) < req.Spots; number++ {
+		if assigned[number] || online[number-1] && !own[number] {
+			continue
+		}
+		spots = append(spots, resources.AssignedSpot{
+			Number: number,
+			Label:  fmt.Sprintf("%s-%d", name, number),
+		})
+	}
+	if len(spots) < req.Spots {
+		full = true
+		return
+	}
+
+	newReg := &resources.DeviceRegistration{
+		DeviceID:     id,
+		GarageID:     token.GarageID,
+		SectionID:    sectionID,
+		Spots:        spots,
+		RegisteredAt: time.Now().UTC(),
+	}
+	if registered {
+		newReg.SecretHash = reg.SecretHash
+	} else {
+		if newReg.Secret, err = randomHex(32); err != nil {
+			return
+		}
+		newReg.SecretHash = hashSecret(newReg.Secret)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = m.db.ReplaceRegistration(ctx, newReg); err != nil {
+		return
+	}
+
+	respObj = *newReg
+	respObj.SectionName = name
+	newReg.Secret = ""
+	m.registrations[id] = newReg
+	created = !registered
+	return
+}
+
+func (m *deviceManager) removeRegistration(id string) (found bool, err error) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	if _, found = m.registrations[id]; !found {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = m.db.DeleteRegistration(ctx, id); err != nil {
+		return
+	}
+
+	delete(m.registrations, id)
+	return
+}
+
+// spotOwners returns the devices registered for the spots of the section,
+// by spot number
+func (m *deviceManager) spotOwners(garageID string, sectionID string) map[int]string {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	owners := make(map[int]string)
+	for _, reg := range m.registrations {
+		if reg.GarageID != garageID || reg.SectionID != sectionID {
+			continue
+		}
+		for _, spot := range reg.Spots {
+			owners[spot.Number] = reg.DeviceID
+		}
+	}
+	return owners
+}
+
+// validCredentials reports whether the device is registered with the secret
+func (m *deviceManager) validCredentials(id string, secret string) bool {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	reg, found := m.registrations[id]
+	return found && validSecret(reg, secret)
+}
+
+// authorizeSpots checks that spots registered by a device are only updated
+// with its credentials, given with basic auth. Spots of no device can be
+// updated by anyone. It responds with an error and returns false otherwise.
+func (s *server) authorizeSpots(w http.ResponseWriter, r *http.Request, garageID string, sectionName string, params []Params) bool {
+	sectionID, _, _, found := s.garages.sectionOnline(garageID, sectionName)
+	if !found {
+		return true
+	}
+	owners := s.devices.spotOwners(garageID, sectionID)
+	if len(owners) == 0 {
+		return true
+	}
+
+	deviceID, secret, hasAuth := r.BasicAuth()
+	credentials := hasAuth && s.devices.validCredentials(deviceID, secret)
+	for _, param := range params {
+		owner, registered := owners[param.Number]
+		if !registered || credentials && owner == deviceID {
+			continue
+		}
+		if !credentials {
+			errMsg := fmt.Sprintf("spot %d is registered by device '%s', whose credentials are required", param.Number, owner)
+			httpErrorResp(w, r, http.StatusUnauthorized, errMsg)
+		} else {
+			errMsg := fmt.Sprintf("spot %d is registered by device '%s', not '%s'", param.Number, owner, deviceID)
+			httpErrorResp(w, r, http.StatusForbidden, errMsg)
+		}
+		return false
+	}
+	return true
+}
+
+func (s *server) httpRegistration(w http.ResponseWriter, r *http.Request) {
+	urlVars := mux.Vars(r)
+	id := urlVars["device-id"]
+	switch r.Method {
+	case http.MethodGet:
+		s.getRegistration(w, r, id)
+	case http.MethodPost:
+		s.postRegistration(w, r, id)
+	case http.MethodDelete:
+		s.deleteRegistration(w, r, id)
+	default:
+		errMsg := fmt.Sprintf("invalid request for resource '%s/%s/%s'", api.Devices, id, api.Registration)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+	}
+}
+
+func (s *server) getRegistration(w http.ResponseWriter, r *http.Request, id string) {
+	respObj, found := s.devices.getRegistration(s.garages, id)
+	if !found {
+		errMsg := fmt.Sprintf("resource '%s/%s/%s' not found", api.Devices, id, api.Registration)
+		httpErrorResp(w, r, http.StatusNotFound, errMsg)
+		return
+	}
+
+	resp, err := json.Marshal(respObj)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+func (s *server) postRegistration(w http.ResponseWriter, r *http.Request, id string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+
+	req := &resources.RegistrationReq{}
+	err = json.Unmarshal(body, req)
+	if err != nil {
+		errMsg := "failed to unmarshal JSON object: " + err.Error()
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+	if req.Spots == 0 {
+		req.Spots = 1
+	}
+	if req.Spots < 0 || req.Spots > maxRegisteredSpots {
+		errMsg := fmt.Sprintf("number of spots must be in range [1, %d]", maxRegisteredSpots)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+
+	respObj, created, authorized, found, full, err := s.devices.register(s.garages, id, req)
+	if err != nil {
+		err = errors.New("DB error: failed to register device: " + err.Error())
+		httpInternalError(w, r, err)
+		return
+	}
+	if !authorized {
+		httpErrorResp(w, r, http.StatusUnauthorized, "invalid provisioning token or device secret")
+		return
+	}
+	if !found {
+		httpErrorResp(w, r, http.StatusNotFound, "section of the provisioning token not found")
+		return
+	}
+	if full {
+		errMsg := fmt.Sprintf("not enough free spots for %d", req.Spots)
+		httpErrorResp(w, r, http.StatusConflict, errMsg)
+		return
+	}
+
+	// The secret is only ever returned here, when it is generated
+	resp, err := json.Marshal(respObj)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(resp)
+}
+
+func (s *server) deleteRegistration(w http.ResponseWriter, r *http.Request, id string) {
+	found, err := s.devices.removeRegistration(id)
+	if !found {
+		errMsg := fmt.Sprintf("resource '%s/%s/%s' not found", api.Devices, id, api.Registration)
+		httpErrorResp(w, r, http.StatusNotFound, errMsg)
+		return
+	}
+	if err != nil {
+		err = errors.New("DB error: failed to delete device registration: " + err.Error())
+		httpInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) httpTokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.getTokens(w, r)
+	case http.MethodPost:
+		s.postTokens(w, r)
+	default:
+		errMsg := fmt.Sprintf("invalid request for resource '%s/%s'", api.Devices, api.Tokens)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+	}
+}
+
+func (s *server) httpToken(w http.ResponseWriter, r *http.Request) {
+	urlVars := mux.Vars(r)
+	id := urlVars["token-id"]
+	switch r.Method {
+	case http.MethodDelete:
+		s.deleteToken(w, r, id)
+	default:
+		errMsg := fmt.Sprintf("invalid request for resource '%s/%s/%s'", api.Devices, api.Tokens, id)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+	}
+}
+
+func (s *server) getTokens(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.Marshal(s.devices.getTokens())
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+func (s *server) postTokens(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+
+	token := &resources.ProvisioningToken{}
+	err = json.Unmarshal(body, token)
+	if err != nil {
+		errMsg := "failed to unmarshal JSON object: " + err.Error()
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+	token.ID = ""
+	if token.Section == "" {
+		token.Section = token.SectionID
+	}
+	if !token.ExpiresAt.IsZero() && !token.ExpiresAt.After(time.Now()) {
+		httpErrorResp(w, r, http.StatusBadRequest, "expiry time must be in the future")
+		return
+	}
+
+	found, err := s.devices.addToken(s.garages, token)
+	if !found {
+		errMsg := fmt.Sprintf("section '%s' of garage '%s' not found", token.Section, token.GarageID)
+		httpErrorResp(w, r, http.StatusNotFound, errMsg)
+		return
+	}
+	if err != nil {
+		err = errors.New("DB error: failed to insert provisioning token: " + err.Error())
+		httpInternalError(w, r, err)
+		return
+	}
+
+	// The token is only ever returned here
+	resp, err := json.Marshal(token)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resp)
+}
+
+func (s *server) deleteToken(w http.ResponseWriter, r *http.Request, id string) {
+	found, err := s.devices.removeToken(id)
+	if !found {
+		errMsg := fmt.Sprintf("resource '%s/%s/%s' not found", api.Devices, api.Tokens, id)
+		httpErrorResp(w, r, http.StatusNotFound, errMsg)
+		return
+	}
+	if err != nil {
+		err = errors.New("DB error: failed to delete provisioning token: " + err.Error())
+		httpInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
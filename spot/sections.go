@@ -54,19 +54,59 @@ func (s *server) httpSection(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *server) httpSectionRestore(w http.ResponseWriter, r *http.Request) {
+	urlVars := mux.Vars(r)
+	garageID := urlVars["garage-id"]
+	sectionName := urlVars["section-name"]
+
+	switch r.Method {
+	case http.MethodPost:
+		s.restoreSection(w, r, garageID, sectionName)
+	default:
+		errMsg := fmt.Sprintf("invalid request for '%s'", api.Restore)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+	}
+}
+
 func (s *server) getSections(w http.ResponseWriter, r *http.Request, garageID string) {
-	respArray, found := s.garages.getSections(garageID)
+	var (
+		respArray []resources.SectionRespObj
+		found     bool
+	)
+	if r.URL.Query().Get(api.QueryDeleted) == "true" {
+		respArray, found = s.garages.getDeletedSections(garageID)
+	} else {
+		respArray, found = s.garages.getSections(garageID)
+	}
 	if !found {
 		errMsg := fmt.Sprintf("resource '%s/%s' not found", api.CollectionGarages, garageID)
 		httpErrorResp(w, r, http.StatusNotFound, errMsg)
 		return
 	}
 
+	filter, err := parseSpotFilter(r)
+	if err != nil {
+		httpErrorResp(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	filtered := []resources.SectionRespObj{}
+	for _, s := range respArray {
+		if filter.matches(s.FreeSpots, s.FreeSpotsByType) {
+			filtered = append(filtered, s)
+		}
+	}
+	respArray = filtered
+
 	resp, err := json.Marshal(respArray)
 	if err != nil {
 		httpInternalError(w, r, err)
 		return
 	}
+	tag := bodyETag(resp)
+	if notModified(w, r, tag) {
+		return
+	}
+	w.Header().Set("ETag", tag)
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Write(resp)
@@ -99,7 +139,12 @@ func (s *server) postSections(w http.ResponseWriter, r *http.Request, garageID s
 		return
 	}
 
-	garageFound, sectionExists, err := s.garages.addSection(garageID, section)
+	if err = validSpotTypes(section.SpotTypes); err != nil {
+		httpErrorResp(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	garageFound, sectionExists, err := s.garages.addSection(requestActor(r), garageID, section)
 	if !garageFound {
 		errMsg := fmt.Sprintf("resource '%s/%s' not found", api.CollectionGarages, garageID)
 		httpErrorResp(w, r, http.StatusNotFound, errMsg)
@@ -116,18 +161,24 @@ func (s *server) postSections(w http.ResponseWriter, r *http.Request, garageID s
 		return
 	}
 
+	freeSpotsByType := sectionFreeSpotsByType(section)
 	resp, err := json.Marshal(
 		resources.SectionRespObj{
-			Name:        section.Name,
-			Level:       section.Level,
-			Description: section.Description,
-			TotalSpots:  section.TotalSpots,
+			ID:              section.ID,
+			Name:            section.Name,
+			Level:           section.Level,
+			Description:     section.Description,
+			TotalSpots:      section.TotalSpots,
+			SpotTypes:       section.SpotTypes,
+			FreeSpotsByType: freeSpotsByType,
+			Version:         section.Version,
 		},
 	)
 	if err != nil {
 		httpInternalError(w, r, err)
 		return
 	}
+	w.Header().Set("ETag", etag(section.Version, 0, freeSpotsByType))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	w.Write(resp)
@@ -147,11 +198,17 @@ func (s *server) getSection(w http.ResponseWriter, r *http.Request, garageID str
 		return
 	}
 
+	tag := etag(respObj.Version, respObj.FreeSpots, respObj.FreeSpotsByType)
+	if notModified(w, r, tag) {
+		return
+	}
+
 	resp, err := json.Marshal(respObj)
 	if err != nil {
 		httpInternalError(w, r, err)
 		return
 	}
+	w.Header().Set("ETag", tag)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(resp)
 }
@@ -171,20 +228,38 @@ func (s *server) putSection(w http.ResponseWriter, r *http.Request, garageID str
 		return
 	}
 
-	if update.Name != "" && !nameRegex.MatchString(update.Name) {
+	// PUT replaces all properties, PATCH only those present in the merge patch
+	var fields []string
+	if r.Method == http.MethodPatch {
+		fields, err = mergePatchFields(body, sectionProperties)
+		if err != nil {
+			errMsg := "invalid merge patch: " + err.Error()
+			httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+			return
+		}
+	}
+
+	if hasField(fields, "name") && !nameRegex.MatchString(update.Name) {
 		errMsg := "section name in wrong format, use pattern: " + sectionNamePattern
 		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
 		return
 	}
 
-	// 0 is ignored while updating section information (it is 0 if not provided in request)
-	if update.TotalSpots < 0 {
+	if hasField(fields, "total_spots") && update.TotalSpots < 1 {
 		errMsg := "illegal value for total number of spots, must be at least 1"
 		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
 		return
 	}
 
-	found, respObj, err := s.garages.updateSection(garageID, sectionName, update)
+	if hasField(fields, "spot_types") {
+		if err = validSpotTypes(update.SpotTypes); err != nil {
+			httpErrorResp(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	force := r.URL.Query().Get(api.QueryForce) == "true"
+	found, conflict, nameTaken, inUse, respObj, err := s.garages.updateSection(requestActor(r), garageID, sectionName, update, fields, force, ifMatch(r))
 	if !found {
 		errMsg := fmt.Sprintf(
 			"resource '%s/%s/%s/%s' not found",
@@ -196,6 +271,24 @@ func (s *server) putSection(w http.ResponseWriter, r *http.Request, garageID str
 		httpErrorResp(w, r, http.StatusNotFound, errMsg)
 		return
 	}
+	if conflict {
+		httpPreconditionFailed(w, r)
+		return
+	}
+	if nameTaken {
+		errMsg := "section name already in use"
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+	if len(inUse) > 0 {
+		errMsg := fmt.Sprintf(
+			"spots %v are in use and would be removed, use '?%s=true' to remove them anyway",
+			inUse,
+			api.QueryForce,
+		)
+		httpErrorResp(w, r, http.StatusConflict, errMsg)
+		return
+	}
 	if err != nil {
 		err = errors.New("DB error: failed to update section: " + err.Error())
 		httpInternalError(w, r, err)
@@ -207,12 +300,14 @@ func (s *server) putSection(w http.ResponseWriter, r *http.Request, garageID str
 		httpInternalError(w, r, err)
 		return
 	}
+	w.Header().Set("ETag", etag(respObj.Version, respObj.FreeSpots, respObj.FreeSpotsByType))
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(resp)
 }
 
 func (s *server) deleteSection(w http.ResponseWriter, r *http.Request, garageID string, sectionName string) {
-	found, err := s.garages.deleteSection(garageID, sectionName)
+	hard := r.URL.Query().Get(api.QueryHard) == "true"
+	found, conflict, err := s.garages.deleteSection(requestActor(r), garageID, sectionName, hard, ifMatch(r))
 	if !found {
 		errMsg := fmt.Sprintf(
 			"resource '%s/%s/%s/%s' not found",
@@ -224,6 +319,10 @@ func (s *server) deleteSection(w http.ResponseWriter, r *http.Request, garageID
 		httpErrorResp(w, r, http.StatusNotFound, errMsg)
 		return
 	}
+	if conflict {
+		httpPreconditionFailed(w, r)
+		return
+	}
 	if err != nil {
 		err = errors.New("DB error: failed to delete section: " + err.Error())
 		httpInternalError(w, r, err)
@@ -232,3 +331,37 @@ func (s *server) deleteSection(w http.ResponseWriter, r *http.Request, garageID
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func (s *server) restoreSection(w http.ResponseWriter, r *http.Request, garageID string, sectionName string) {
+	found, nameTaken, respObj, err := s.garages.restoreSection(requestActor(r), garageID, sectionName)
+	if !found {
+		errMsg := fmt.Sprintf(
+			"deleted resource '%s/%s/%s/%s' not found",
+			api.CollectionGarages,
+			garageID,
+			api.CollectionSections,
+			sectionName,
+		)
+		httpErrorResp(w, r, http.StatusNotFound, errMsg)
+		return
+	}
+	if nameTaken {
+		errMsg := "section name already in use, rename the other section first"
+		httpErrorResp(w, r, http.StatusConflict, errMsg)
+		return
+	}
+	if err != nil {
+		err = errors.New("DB error: failed to restore section: " + err.Error())
+		httpInternalError(w, r, err)
+		return
+	}
+
+	resp, err := json.Marshal(respObj)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", etag(respObj.Version, respObj.FreeSpots, respObj.FreeSpotsByType))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -16,11 +16,28 @@ type server struct {
 	router     *mux.Router
 	addr       string
 	garages    *garageManager
+	webhooks   *webhookManager
+	devices    *deviceManager
 	runners    []backgroundRunner
 }
 
 func (s *server) startRunners(garages *garageManager) {
-	s.runners = []backgroundRunner{&invalidationRunner{garages: garages}}
+	sinks, err := newAlertSinks(cfg.Alerts.Sinks)
+	if err != nil {
+		log.Fatalf("Alerts: %s", err.Error())
+	}
+	garages.alerts = newAlertRunner(sinks)
+
+	s.runners = []backgroundRunner{
+		garages.alerts,
+		&invalidationRunner{garages: garages},
+		&auditRunner{garages: garages},
+		&purgeRunner{
+			garages:   garages,
+			retention: time.Duration(cfg.DeletedRetentionDays) * 24 * time.Hour,
+		},
+		&deliveryRunner{webhooks: garages.webhooks},
+	}
 	for _, r := range s.runners {
 		r.start()
 	}
@@ -33,16 +50,26 @@ func (s *server) stopRunners() {
 }
 
 func (s *server) run() {
-	db, err := db.NewClient(cfg.DBConfig.ConnString, cfg.DBConfig.Database, cfg.DBConfig.Collection)
+	db, err := db.NewClient(cfg.DBConfig)
 	if err != nil {
 		log.Fatalf("DB: failed to connect to database: %s", err.Error())
 	}
 
-	s.garages, err = newGarageManager(db)
+	s.webhooks, err = newWebhookManager(db)
+	if err != nil {
+		log.Fatalf("DB: failed to get webhooks: %s", err.Error())
+	}
+
+	s.garages, err = newGarageManager(db, s.webhooks)
 	if err != nil {
 		log.Fatalf("DB: failed to get garages: %s", err.Error())
 	}
 
+	s.devices, err = newDeviceManager(db)
+	if err != nil {
+		log.Fatalf("DB: failed to get device configurations: %s", err.Error())
+	}
+
 	s.startRunners(s.garages)
 
 	handler := s.setupEndpoints()
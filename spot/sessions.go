@@ -0,0 +1,362 @@
+package spot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cicovic-andrija/spot/api"
+	"github.com/cicovic-andrija/spot/db"
+	"github.com/cicovic-andrija/spot/log"
+	"github.com/cicovic-andrija/spot/resources"
+	"github.com/cicovic-andrija/spot/util"
+	"github.com/gorilla/mux"
+)
+
+// Session end reasons
+const (
+	sessionFreed        = "freed"
+	sessionDisconnected = "disconnected"
+	sessionTimedOut     = "timed_out"
+	sessionSensorFault  = "sensor_fault"
+	sessionRemoved      = "removed"
+)
+
+// endedSession is a session ended while the garages are locked, charged by
+// the garage's tariff at the time only when it is stored
+type endedSession struct {
+	*resources.Session
+	tariff *resources.Tariff
+}
+
+// spotTypesOf returns the types of the spot with the given number
+func spotTypesOf(section *resources.Section, number int) []string {
+	types := []string{}
+	for _, r := range section.SpotTypes {
+		if number >= r.From && number <= r.To {
+			types = append(types, r.Type)
+		}
+	}
+	if len(types) == 0 {
+		types = append(types, spotStandard)
+	}
+	return types
+}
+
+// tariffSurcharge returns the highest surcharge for any of the spot types
+func tariffSurcharge(tariff *resources.Tariff, spotTypes []string) float64 {
+	surcharge := 0.0
+	for _, t := range spotTypes {
+		if tariff.Surcharges[t] > surcharge {
+			surcharge = tariff.Surcharges[t]
+		}
+	}
+	return surcharge
+}
+
+// startSession starts a session of the spot, unless the session restored on
+// startup goes on, and returns it to be stored
+func startSession(garage *resources.Garage, section *resources.Section, number int, now time.Time) *resources.Session {
+	// NOTE: This function is *not* thread-safe
+	spot := &section.Spots[number-1]
+	if spot.Session != nil {
+		return nil
+	}
+
+	id, err := util.NewRandomID()
+	if err != nil {
+		log.Errorf("Failed to obtain a session ID: %v", err)
+	}
+
+	spot.Session = &resources.Session{
+		ID:        id,
+		GarageID:  garage.ID,
+		SectionID: section.ID,
+		Spot:      number,
+		Label:     spot.Label,
+		SpotTypes: spotTypesOf(section, number),
+		Start:     now,
+	}
+	return spot.Session
+}
+
+// endSession ends the ongoing session of the spot, if there is one, and
+// returns it to be stored
+func endSession(garage *resources.Garage, section *resources.Section, number int, now time.Time, reason string) *endedSession {
+	// NOTE: This function is *not* thread-safe
+	spot := &section.Spots[number-1]
+	session := spot.Session
+	if session == nil {
+		return nil
+	}
+	spot.Session = nil
+
+	session.End = &now
+	session.EndReason = reason
+	return &endedSession{Session: session, tariff: garage.Tariff}
+}
+
+// endSessions ends the ongoing sessions of all the spots of the section
+func endSessions(garage *resources.Garage, section *resources.Section, now time.Time, reason string) []*endedSession {
+	// NOTE: This function is *not* thread-safe
+	ended := []*endedSession{}
+	for number := 1; number <= len(section.Spots); number++ {
+		if session := endSession(garage, section, number, now, reason); session != nil {
+			ended = append(ended, session)
+		}
+	}
+	return ended
+}
+
+// chargeSession sets the duration and the fee of the session up to the given
+// time
+func chargeSession(session *resources.Session, tariff *resources.Tariff, until time.Time) {
+	session.Duration = int(until.Sub(session.Start).Seconds())
+	if tariff == nil {
+		return
+	}
+	fee, _ := parkingPrice(tariff, tariffSurcharge(tariff, session.SpotTypes), session.Start, until)
+	session.Fee = &fee
+	session.Currency = tariff.Currency
+}
+
+// storeOngoingSessions stores started sessions, so that they survive a
+// restart. Failing to store them is reported but not returned, as the spots
+// have already been updated.
+func (m *garageManager) storeOngoingSessions(sessions []resources.Session) {
+	if len(sessions) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := range sessions {
+		s := &sessions[i]
+		if err := m.db.InsertSession(ctx, s); err != nil {
+			log.Errorf(
+				"DB: failed to store ongoing session %s of spot #%d, section id %s, garage id %s: %v",
+				s.ID,
+				s.Spot,
+				s.SectionID,
+				s.GarageID,
+				err,
+			)
+		}
+	}
+}
+
+// storeSessions charges and stores ended sessions. Failing to store them is
+// reported but not returned, as the spots have already been updated.
+// NOTE: This function must be called without holding the lock, as pricing
+// long sessions takes a while
+func (m *garageManager) storeSessions(sessions []*endedSession) {
+	if len(sessions) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, s := range sessions {
+		chargeSession(s.Session, s.tariff, *s.End)
+		if err := m.db.ReplaceSession(ctx, s.Session); err != nil {
+			log.Errorf(
+				"DB: failed to store session %s of spot #%d, section id %s, garage id %s: %v",
+				s.ID,
+				s.Spot,
+				s.SectionID,
+				s.GarageID,
+				err,
+			)
+		}
+	}
+}
+
+// restoreSessions puts the sessions which were ongoing when the server
+// stopped back on their spots, where they go on until the device updates the
+// spot, or end if it does not in time. Sessions of spots which are gone end,
+// and are returned to be stored.
+func (m *garageManager) restoreSessions(sessions []resources.Session, now time.Time) []*endedSession {
+	// NOTE: This function is *not* thread-safe
+	ended := []*endedSession{}
+	for i := range sessions {
+		session := &sessions[i]
+		garage := m.garages[session.GarageID]
+		if spot := sessionSpot(garage, session); spot != nil {
+			// The spot is offline until its device updates it, and the time
+			// of the restore is what the timeout counts from
+			spot.Session, spot.LastUpdate = session, now
+			continue
+		}
+
+		var tariff *resources.Tariff
+		if garage != nil {
+			tariff = garage.Tariff
+		}
+		session.End, session.EndReason = &now, sessionRemoved
+		ended = append(ended, &endedSession{Session: session, tariff: tariff})
+	}
+	return ended
+}
+
+// sessionSpot returns the spot of the session, unless the spot is gone or
+// already has a session
+func sessionSpot(garage *resources.Garage, session *resources.Session) *resources.Spot {
+	if garage == nil {
+		return nil
+	}
+	for i := range garage.Sections {
+		section := &garage.Sections[i]
+		if section.ID != session.SectionID || session.Spot < 1 || session.Spot > len(section.Spots) {
+			continue
+		}
+		if spot := &section.Spots[session.Spot-1]; spot.Session == nil {
+			return spot
+		}
+	}
+	return nil
+}
+
+// ongoingSessions returns the ongoing sessions of the garage, or of one of its
+// sections, charged up to now
+func (m *garageManager) ongoingSessions(garageID string, sectionName string) (sessions []resources.Session, sectionID string, found bool) {
+	var tariff *resources.Tariff
+	sessions, tariff, sectionID, found = m.copySessions(garageID, sectionName)
+
+	// Sessions are priced outside of the lock, as it takes a while for long ones
+	now := time.Now()
+	for i := range sessions {
+		chargeSession(&sessions[i], tariff, now)
+	}
+	return
+}
+
+// copySessions returns copies of the ongoing sessions of the garage, or of one
+// of its sections, with the garage's tariff
+func (m *garageManager) copySessions(garageID string, sectionName string) (sessions []resources.Session, tariff *resources.Tariff, sectionID string, found bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	garage, found := m.garages[garageID]
+	if !found {
+		return
+	}
+	i := -1
+	if sectionName != "" {
+		if found, _, i = m.sectionExists(garageID, sectionName); !found {
+			return
+		}
+		sectionID = garage.Sections[i].ID
+	}
+
+	// Tariffs are replaced rather than changed, so the tariff can be used
+	// after the lock is released
+	tariff = garage.Tariff
+	sessions = []resources.Session{}
+	for j := range garage.Sections {
+		if i >= 0 && i != j {
+			continue
+		}
+		for _, spot := range garage.Sections[j].Spots {
+			if spot.Session == nil {
+				continue
+			}
+			sessions = append(sessions, *spot.Session)
+		}
+	}
+	return
+}
+
+func (s *server) httpSessions(w http.ResponseWriter, r *http.Request) {
+	urlVars := mux.Vars(r)
+	garageID := urlVars["garage-id"]
+
+	switch r.Method {
+	case http.MethodGet:
+		s.getSessions(w, r, garageID)
+	default:
+		errMsg := fmt.Sprintf("invalid request for resource '%s'", api.CollectionSessions)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+	}
+}
+
+func (s *server) getSessions(w http.ResponseWriter, r *http.Request, garageID string) {
+	query := r.URL.Query()
+	filter := db.SessionFilter{
+		GarageID: garageID,
+		Limit:    100,
+	}
+
+	var err error
+	if v := query.Get("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			httpErrorResp(w, r, http.StatusBadRequest, "'since' must be an RFC 3339 timestamp")
+			return
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			httpErrorResp(w, r, http.StatusBadRequest, "'until' must be an RFC 3339 timestamp")
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 {
+			httpErrorResp(w, r, http.StatusBadRequest, "'limit' must be a positive number")
+			return
+		}
+	}
+
+	sectionName := query.Get("section")
+	ongoing, sectionID, found := s.garages.ongoingSessions(garageID, sectionName)
+	if !found {
+		errMsg := fmt.Sprintf("resource '%s/%s' not found", api.CollectionGarages, garageID)
+		if sectionName != "" {
+			errMsg = fmt.Sprintf(
+				"resource '%s/%s/%s/%s' not found",
+				api.CollectionGarages,
+				garageID,
+				api.CollectionSections,
+				sectionName,
+			)
+		}
+		httpErrorResp(w, r, http.StatusNotFound, errMsg)
+		return
+	}
+	filter.SectionID = sectionID
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	sessions, err := s.garages.db.FindSessions(ctx, filter)
+	if err != nil {
+		err = errors.New("DB error: failed to get sessions: " + err.Error())
+		httpInternalError(w, r, err)
+		return
+	}
+
+	// Ongoing sessions come first, newest first like the stored ones
+	sort.Slice(ongoing, func(i, j int) bool { return ongoing[i].Start.After(ongoing[j].Start) })
+	respArray := []resources.Session{}
+	for _, session := range ongoing {
+		if (filter.Since.IsZero() || !session.Start.Before(filter.Since)) &&
+			(filter.Until.IsZero() || session.Start.Before(filter.Until)) {
+			respArray = append(respArray, session)
+		}
+	}
+	respArray = append(respArray, sessions...)
+	if len(respArray) > filter.Limit {
+		respArray = respArray[:filter.Limit]
+	}
+
+	resp, err := json.Marshal(respArray)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -5,18 +5,37 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/cicovic-andrija/spot/api"
+	"github.com/cicovic-andrija/spot/resources"
 	"github.com/gorilla/mux"
 )
 
-// Params struct represents action parameters
+// Params struct represents action parameters. ObservedAt is when the device
+// observed the state, if it is sent later, e.g. from the device's queue, and
+// Sequence is a number the device increases with every update it sends. Fault
+// is set instead of Taken when the device's sensor fails.
 type Params struct {
-	Number int    `json:"number"`
-	Label  string `json:"label"`
-	Taken  bool   `json:"taken"`
+	Number     int        `json:"number"`
+	Label      string     `json:"label"`
+	Taken      bool       `json:"taken"`
+	Fault      bool       `json:"fault,omitempty"`
+	ObservedAt *time.Time `json:"observed_at,omitempty"`
+	Sequence   *uint64    `json:"sequence,omitempty"`
 }
 
+// Update results
+const (
+	updateApplied  = "applied"
+	updateIgnored  = "ignored"
+	updateRejected = "rejected"
+)
+
+// maxClockSkew is how far in the future an observed time may be, which is
+// then taken as the time of the update
+const maxClockSkew = time.Minute
+
 // ActionMsg struct represents POST request data
 type ActionMsg struct {
 	Action string   `json:"action"`
@@ -52,9 +71,14 @@ func (s *server) postAction(w http.ResponseWriter, r *http.Request, garageID str
 		return
 	}
 
+	if !s.authorizeSpots(w, r, garageID, sectionName, actionMsg.Params) {
+		return
+	}
+
 	switch actionMsg.Action {
 	case api.ActionUpdate:
-		err = s.garages.actionUpdate(garageID, sectionName, actionMsg.Params)
+		s.postUpdate(w, r, garageID, sectionName, actionMsg.Params)
+		return
 	case api.ActionDisconnect:
 		err = s.garages.actionDisconnect(garageID, sectionName, actionMsg.Params)
 	default:
@@ -69,3 +93,30 @@ func (s *server) postAction(w http.ResponseWriter, r *http.Request, garageID str
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// postUpdate responds with the result of each update, and fails if any was
+// rejected. Rejected updates do not stop the others from being applied.
+func (s *server) postUpdate(w http.ResponseWriter, r *http.Request, garageID string, sectionName string, params []Params) {
+	found, results := s.garages.actionUpdate(garageID, sectionName, params)
+	if !found {
+		errMsg := fmt.Sprintf("section '%s', garage id %s not found", sectionName, garageID)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Result == updateRejected {
+			status = http.StatusBadRequest
+		}
+	}
+
+	resp, err := json.Marshal(resources.UpdateRespObj{Results: results})
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
@@ -0,0 +1,113 @@
+package spot
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/cicovic-andrija/spot/api"
+	"github.com/cicovic-andrija/spot/resources"
+)
+
+// Spot types
+const (
+	spotStandard   = "standard"
+	spotEV         = "ev"
+	spotAccessible = "accessible"
+	spotCompact    = "compact"
+	spotMotorcycle = "motorcycle"
+	spotPermit     = "permit"
+)
+
+var spotTypes = []string{spotEV, spotAccessible, spotCompact, spotMotorcycle, spotPermit}
+
+func validSpotType(spotType string) error {
+	for _, t := range spotTypes {
+		if spotType == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown spot type '%s', use one of %v", spotType, spotTypes)
+}
+
+func validSpotTypes(ranges []resources.SpotRange) error {
+	for _, r := range ranges {
+		if err := validSpotType(r.Type); err != nil {
+			return err
+		}
+		if r.From < 1 || r.To < r.From {
+			return fmt.Errorf("illegal range of '%s' spots [%d, %d]", r.Type, r.From, r.To)
+		}
+	}
+	return nil
+}
+
+// freeSpotsByType adds the number of free spots of each type in the section
+// to free, with every type of the section's spots present even if none is
+// free. Ranges past the last spot of the section are ignored.
+func freeSpotsByType(section *resources.Section, free map[string]int) {
+	for j, spot := range section.Spots {
+		number := j + 1
+		isFree := 0
+		if spot.Online && !spot.Taken {
+			isFree = 1
+		}
+
+		typed := false
+		for _, r := range section.SpotTypes {
+			if number >= r.From && number <= r.To {
+				typed = true
+				free[r.Type] += isFree
+			}
+		}
+		if !typed {
+			free[spotStandard] += isFree
+		}
+	}
+}
+
+func sectionFreeSpotsByType(section *resources.Section) map[string]int {
+	free := make(map[string]int)
+	freeSpotsByType(section, free)
+	return free
+}
+
+func garageFreeSpotsByType(garage *resources.Garage) map[string]int {
+	free := make(map[string]int)
+	for i := range garage.Sections {
+		freeSpotsByType(&garage.Sections[i], free)
+	}
+	return free
+}
+
+// spotFilter selects garages and sections with a type of spots, and with at
+// least the given number of free spots of that type, or of any type if the
+// type is not given
+type spotFilter struct {
+	spotType string
+	minFree  int
+}
+
+func parseSpotFilter(r *http.Request) (f spotFilter, err error) {
+	query := r.URL.Query()
+	f.spotType = query.Get(api.QuerySpotType)
+	if f.spotType != "" && f.spotType != spotStandard {
+		if err = validSpotType(f.spotType); err != nil {
+			return
+		}
+	}
+	if v := query.Get(api.QueryMinFree); v != "" {
+		if f.minFree, err = strconv.Atoi(v); err != nil || f.minFree < 0 {
+			err = fmt.Errorf("'%s' must be a non-negative number", api.QueryMinFree)
+		}
+	}
+	return
+}
+
+func (f spotFilter) matches(freeSpots int, freeSpotsByType map[string]int) bool {
+	if f.spotType == "" {
+		return freeSpots >= f.minFree
+	}
+	free, ok := freeSpotsByType[f.spotType]
+	return ok && free >= f.minFree
+}
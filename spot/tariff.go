@@ -0,0 +1,230 @@
+package spot
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/cicovic-andrija/spot/api"
+	"github.com/cicovic-andrija/spot/resources"
+	"github.com/gorilla/mux"
+)
+
+func validTariff(tariff *resources.Tariff) error {
+	if tariff == nil {
+		return nil
+	}
+	if _, err := time.LoadLocation(tariff.Timezone); err != nil {
+		return fmt.Errorf("unknown time zone '%s'", tariff.Timezone)
+	}
+	if tariff.HourlyRate < 0 || tariff.DailyCap < 0 {
+		return fmt.Errorf("rates and caps must not be negative")
+	}
+
+	for _, b := range tariff.Bands {
+		if _, err := clockMinutes(b.From); err != nil {
+			return err
+		}
+		if _, err := clockMinutes(b.To); err != nil {
+			return err
+		}
+		if b.HourlyRate < 0 {
+			return fmt.Errorf("rates and caps must not be negative")
+		}
+	}
+
+	for spotType, surcharge := range tariff.Surcharges {
+		if err := validSpotType(spotType); err != nil {
+			return err
+		}
+		if surcharge < 0 {
+			return fmt.Errorf("surcharges must not be negative")
+		}
+	}
+	return nil
+}
+
+// maxQuoteDuration is the longest stay a price is quoted for
+const maxQuoteDuration = 366 * 24 * time.Hour
+
+// rateBand is a tariff band with its times of day in minutes since midnight
+type rateBand struct {
+	from int
+	to   int
+	rate float64
+}
+
+func parseBands(tariff *resources.Tariff) []rateBand {
+	bands := make([]rateBand, 0, len(tariff.Bands))
+	for _, b := range tariff.Bands {
+		from, _ := clockMinutes(b.From)
+		to, _ := clockMinutes(b.To)
+		bands = append(bands, rateBand{from: from, to: to, rate: b.HourlyRate})
+	}
+	return bands
+}
+
+// hourlyRate returns the rate for the given minute of the day
+func hourlyRate(tariff *resources.Tariff, bands []rateBand, minute int) float64 {
+	for _, b := range bands {
+		if (b.from < b.to && minute >= b.from && minute < b.to) || (b.to <= b.from && (minute >= b.from || minute < b.to)) {
+			return b.rate
+		}
+	}
+	return tariff.HourlyRate
+}
+
+// nextRateChange returns the number of minutes from the given minute of the
+// day until a band starts or ends, at most a day
+func nextRateChange(bands []rateBand, minute int) int {
+	next := 24 * 60
+	for _, b := range bands {
+		for _, edge := range []int{b.from, b.to} {
+			if d := (edge - minute + 2*24*60) % (24 * 60); d > 0 && d < next {
+				next = d
+			}
+		}
+	}
+	return next
+}
+
+// parkingPrice returns the price of parking from arrival to departure with
+// the given hourly surcharge, and the number of minutes charged, each minute
+// started being charged in full. The stay is priced by the stretches of time
+// within which the rate does not change, and capped by the day.
+func parkingPrice(tariff *resources.Tariff, surcharge float64, arrival time.Time, departure time.Time) (price float64, minutes int) {
+	loc, err := time.LoadLocation(tariff.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	minutes = int(math.Ceil(departure.Sub(arrival).Minutes()))
+	bands := parseBands(tariff)
+
+	t := arrival.In(loc)
+	// The daily cap applies to every 24 hours from arrival
+	for start := 0; start < minutes; start += 24 * 60 {
+		end := start + 24*60
+		if end > minutes {
+			end = minutes
+		}
+		day := 0.0
+		for m := start; m < end; {
+			clock := t.Hour()*60 + t.Minute()
+			n := nextRateChange(bands, clock)
+			if n > end-m {
+				n = end - m
+			}
+			// The clock moves when the time zone's offset changes, e.g. for
+			// daylight saving time, so the stretch ends before that
+			_, offset := t.Zone()
+			for n > 1 {
+				if _, o := t.Add(time.Duration(n-1) * time.Minute).Zone(); o == offset {
+					break
+				}
+				n /= 2
+			}
+			day += float64(n) * (hourlyRate(tariff, bands, clock) + surcharge) / 60
+			t = t.Add(time.Duration(n) * time.Minute)
+			m += n
+		}
+		if tariff.DailyCap > 0 && day > tariff.DailyCap {
+			day = tariff.DailyCap
+		}
+		price += day
+	}
+
+	return math.Round(price*100) / 100, minutes
+}
+
+func (m *garageManager) getTariff(garageID string) (tariff *resources.Tariff, found bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	garage, found := m.garages[garageID]
+	if !found {
+		return
+	}
+	// Tariffs are replaced rather than changed, so the tariff can be used
+	// after the lock is released
+	return garage.Tariff, true
+}
+
+func (s *server) httpQuote(w http.ResponseWriter, r *http.Request) {
+	urlVars := mux.Vars(r)
+	garageID := urlVars["garage-id"]
+
+	switch r.Method {
+	case http.MethodGet:
+		s.getQuote(w, r, garageID)
+	default:
+		errMsg := fmt.Sprintf("invalid request for '%s'", api.Quote)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+	}
+}
+
+func (s *server) getQuote(w http.ResponseWriter, r *http.Request, garageID string) {
+	query := r.URL.Query()
+	arrival, err := time.Parse(time.RFC3339, query.Get(api.QueryArrival))
+	if err != nil {
+		errMsg := fmt.Sprintf("'%s' must be an RFC 3339 timestamp", api.QueryArrival)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+	departure, err := time.Parse(time.RFC3339, query.Get(api.QueryDeparture))
+	if err != nil {
+		errMsg := fmt.Sprintf("'%s' must be an RFC 3339 timestamp", api.QueryDeparture)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+	if departure.Before(arrival) {
+		errMsg := fmt.Sprintf("'%s' must not be before '%s'", api.QueryDeparture, api.QueryArrival)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+	if departure.Sub(arrival) > maxQuoteDuration {
+		errMsg := fmt.Sprintf("stays longer than %d days are not quoted", maxQuoteDuration/(24*time.Hour))
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+
+	spotType := query.Get(api.QuerySpotType)
+	if spotType == "" {
+		spotType = spotStandard
+	} else if spotType != spotStandard {
+		if err = validSpotType(spotType); err != nil {
+			httpErrorResp(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	tariff, found := s.garages.getTariff(garageID)
+	if !found {
+		errMsg := fmt.Sprintf("resource '%s/%s' not found", api.CollectionGarages, garageID)
+		httpErrorResp(w, r, http.StatusNotFound, errMsg)
+		return
+	}
+	if tariff == nil {
+		errMsg := fmt.Sprintf("garage '%s' has no tariff", garageID)
+		httpErrorResp(w, r, http.StatusNotFound, errMsg)
+		return
+	}
+
+	respObj := resources.QuoteRespObj{
+		GarageID:  garageID,
+		SpotType:  spotType,
+		Arrival:   arrival,
+		Departure: departure,
+		Currency:  tariff.Currency,
+	}
+	respObj.Price, respObj.Minutes = parkingPrice(tariff, tariff.Surcharges[spotType], arrival, departure)
+
+	resp, err := json.Marshal(respObj)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
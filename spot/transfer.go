@@ -0,0 +1,624 @@
+package spot
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cicovic-andrija/spot/api"
+	"github.com/cicovic-andrija/spot/resources"
+)
+
+// Garages are exported and imported together with their sections. Imported
+// garages are matched by ID: unknown or missing IDs create a garage, and
+// known ones replace all of its properties. Sections are matched by ID, then
+// by name, and sections missing from the import are left as they are. The
+// whole import is checked before anything is changed, so an import with
+// errors changes nothing.
+
+// Import change actions
+const (
+	importCreate    = "create"
+	importUpdate    = "update"
+	importUnchanged = "unchanged"
+	importError     = "error"
+)
+
+const (
+	idPattern = `^[0-9a-f]{8}$`
+)
+
+var (
+	idRegex = regexp.MustCompile(idPattern)
+
+	// Opening hours, tariffs and spot types do not fit in a CSV row, so a CSV
+	// import leaves them as they are
+	csvGarageProperties  = []string{"name", "city", "address", "geolocation.longitude", "geolocation.latitude"}
+	csvSectionProperties = []string{"name", "level", "description", "total_spots"}
+
+	csvColumns = []string{
+		"garage_id",
+		"garage_name",
+		"city",
+		"address",
+		"longitude",
+		"latitude",
+		"section_id",
+		"section_name",
+		"level",
+		"description",
+		"total_spots",
+	}
+)
+
+// garageImport is the plan for importing a single garage
+type garageImport struct {
+	input         *resources.Garage
+	garage        *resources.Garage // nil if the garage is to be created
+	fields        []string
+	sectionFields []string
+	merged        resources.Garage
+	sections      []sectionImport
+	changes       []resources.ImportChange
+}
+
+type sectionImport struct {
+	input  *resources.Section
+	index  int // of the matching section, -1 if it is to be created
+	merged resources.Section
+}
+
+func (p *garageImport) failed() bool {
+	for _, c := range p.changes {
+		if c.Action == importError {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *garageManager) exportGarages() []resources.Garage {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	garages := []resources.Garage{}
+	for _, g := range m.garages {
+		export := resources.Garage{
+			ID:          g.ID,
+			Name:        g.Name,
+			City:        g.City,
+			Address:     g.Address,
+			Geolocation: g.Geolocation,
+			Hours:       g.Hours,
+			Tariff:      g.Tariff,
+			Sections:    []resources.Section{},
+		}
+		for _, s := range g.Sections {
+			export.Sections = append(
+				export.Sections,
+				resources.Section{
+					ID:          s.ID,
+					Name:        s.Name,
+					Level:       s.Level,
+					Description: s.Description,
+					TotalSpots:  s.TotalSpots,
+					SpotTypes:   s.SpotTypes,
+				},
+			)
+		}
+		garages = append(garages, export)
+	}
+	sort.Slice(garages, func(i, j int) bool { return garages[i].ID < garages[j].ID })
+	return garages
+}
+
+// importGarages imports garages, replacing the given properties of existing
+// garages and sections, or all of them if the lists are nil
+func (m *garageManager) importGarages(actor string, garages []resources.Garage, fields []string, sectionFields []string, dryRun bool, force bool) (report resources.ImportReport, err error) {
+	var (
+		ended   []*endedSession
+		changes []occupancyChange
+	)
+
+	// Sessions of removed spots are stored, and webhooks notified, once the
+	// lock is released
+	defer func() { m.storeSessions(ended); m.notify(changes) }()
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	report.DryRun = dryRun
+	report.Changes = []resources.ImportChange{}
+
+	// IDs given in the import are reserved, so none of them is generated
+	// for a garage created by the same import
+	reserved := make(map[string]bool)
+	for _, g := range garages {
+		reserved[g.ID] = true
+	}
+
+	plans := []*garageImport{}
+	failed := false
+	seen := make(map[string]bool)
+	for i := range garages {
+		plan := m.planGarageImport(&garages[i], fields, sectionFields, force, seen)
+		failed = failed || plan.failed()
+		plans = append(plans, plan)
+	}
+
+	if !failed && !dryRun {
+		for _, plan := range plans {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			e, c, applyErr := m.applyGarageImport(ctx, actor, plan, reserved)
+			cancel()
+			ended, changes = append(ended, e...), append(changes, c...)
+			if err = applyErr; err != nil {
+				return
+			}
+		}
+		report.Applied = true
+	}
+
+	for _, plan := range plans {
+		report.Changes = append(report.Changes, plan.changes...)
+	}
+	return
+}
+
+func (m *garageManager) planGarageImport(input *resources.Garage, fields []string, sectionFields []string, force bool, seen map[string]bool) *garageImport {
+	// NOTE: This function is *not* thread-safe
+	plan := &garageImport{input: input, fields: fields, sectionFields: sectionFields}
+	change := resources.ImportChange{GarageID: input.ID, Name: input.Name}
+
+	switch {
+	case input.ID != "" && !idRegex.MatchString(input.ID):
+		change.Error = "garage ID in wrong format, use pattern: " + idPattern
+	case input.ID != "" && seen[input.ID]:
+		change.Error = "garage ID appears more than once"
+	case !validGeolocation(input.Geolocation):
+		change.Error = invalidGeolocationMsg
+	}
+	if err := validOpeningHours(input.Hours); err != nil && change.Error == "" {
+		change.Error = "illegal opening hours: " + err.Error()
+	}
+	if err := validTariff(input.Tariff); err != nil && change.Error == "" {
+		change.Error = "illegal tariff: " + err.Error()
+	}
+	if input.ID != "" {
+		seen[input.ID] = true
+	}
+	if _, deleted := m.deleted[input.ID]; deleted && change.Error == "" {
+		change.Error = "garage is deleted, restore it first"
+	}
+
+	garage, exists := m.garages[input.ID]
+	if exists {
+		plan.garage = garage
+	}
+	if change.Error != "" {
+		change.Action = importError
+	} else if !exists {
+		change.Action = importCreate
+		change.After = garageState(input)
+	} else {
+		plan.merged = mergeGarage(*garage, input, fields)
+		change.Before, change.After = diff(garageState(garage), garageState(&plan.merged))
+		change.Action = importUnchanged
+		if len(change.After) > 0 {
+			change.Action = importUpdate
+		}
+	}
+	plan.changes = append(plan.changes, change)
+
+	names := make(map[string]bool)
+	ids := make(map[string]bool)
+	matched := make(map[int]bool)
+	for i := range input.Sections {
+		s := &input.Sections[i]
+		step := sectionImport{input: s, index: -1}
+		change := resources.ImportChange{GarageID: input.ID, SectionID: s.ID, Name: s.Name}
+
+		switch {
+		case !nameRegex.MatchString(s.Name):
+			change.Error = "section name in wrong format, use pattern: " + sectionNamePattern
+		case s.TotalSpots < 1:
+			change.Error = "illegal value for total number of spots, must be at least 1"
+		case s.ID != "" && !idRegex.MatchString(s.ID):
+			change.Error = "section ID in wrong format, use pattern: " + idPattern
+		case names[s.Name]:
+			change.Error = "section name appears more than once"
+		case s.ID != "" && ids[s.ID]:
+			change.Error = "section ID appears more than once"
+		}
+		if err := validSpotTypes(s.SpotTypes); err != nil && change.Error == "" {
+			change.Error = err.Error()
+		}
+		names[s.Name] = true
+		if s.ID != "" {
+			ids[s.ID] = true
+		}
+
+		if plan.garage != nil {
+			step.index = importSectionIndex(plan.garage, s)
+		}
+
+		switch {
+		case change.Error != "":
+		case step.index < 0:
+			if s.ID != "" && m.sectionIDTaken(s.ID) {
+				change.Error = "section ID is taken by another section"
+			} else if plan.garage != nil && sectionNameTaken(plan.garage, s.Name, -1) {
+				change.Error = "section name is taken by another section"
+			} else {
+				change.Action = importCreate
+				change.After = sectionState(s)
+			}
+		case matched[step.index]:
+			change.Error = "section matches the same section as another one"
+		default:
+			matched[step.index] = true
+			section := &plan.garage.Sections[step.index]
+			change.SectionID = section.ID
+			step.merged = mergeSection(*section, s, sectionFields)
+			nameTaken, inUse := checkSectionUpdate(plan.garage, step.index, &step.merged, force)
+			if nameTaken {
+				change.Error = "section name is taken by another section"
+			} else if len(inUse) > 0 {
+				change.Error = fmt.Sprintf("spots %v are in use, import with force to remove them", inUse)
+			} else {
+				change.Before, change.After = diff(sectionState(section), sectionState(&step.merged))
+				change.Action = importUnchanged
+				if len(change.After) > 0 {
+					change.Action = importUpdate
+				}
+			}
+		}
+		if change.Error != "" {
+			change.Action = importError
+		}
+
+		plan.sections = append(plan.sections, step)
+		plan.changes = append(plan.changes, change)
+	}
+	return plan
+}
+
+// importSectionIndex returns the index of the garage's section matching the
+// imported one, or -1 if there is none
+func importSectionIndex(garage *resources.Garage, section *resources.Section) int {
+	if section.ID != "" {
+		for i, s := range garage.Sections {
+			if s.ID == section.ID {
+				return i
+			}
+		}
+		return -1
+	}
+	for i, s := range garage.Sections {
+		if s.Name == section.Name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *garageManager) applyGarageImport(ctx context.Context, actor string, plan *garageImport, reserved map[string]bool) (ended []*endedSession, changes []occupancyChange, err error) {
+	// NOTE: This function is *not* thread-safe
+	if plan.garage == nil {
+		garage := &resources.Garage{
+			ID:          plan.input.ID,
+			Name:        plan.input.Name,
+			City:        plan.input.City,
+			Address:     plan.input.Address,
+			Geolocation: plan.input.Geolocation,
+			Hours:       plan.input.Hours,
+			Tariff:      plan.input.Tariff,
+			Sections:    []resources.Section{},
+		}
+		if garage.ID == "" {
+			for garage.ID = m.newGarageID(); reserved[garage.ID]; garage.ID = m.newGarageID() {
+			}
+		}
+		for _, step := range plan.sections {
+			section := *step.input
+			if section.ID == "" {
+				section.ID = m.importSectionID(plan.input)
+			}
+			garage.Sections = append(garage.Sections, section)
+		}
+
+		if err = m.insertGarage(ctx, actor, garage); err != nil {
+			return
+		}
+		for i := range plan.changes {
+			plan.changes[i].GarageID = garage.ID
+			if i > 0 {
+				plan.changes[i].SectionID = garage.Sections[i-1].ID
+			}
+		}
+		return
+	}
+
+	garage := plan.garage
+	if plan.changes[0].Action == importUpdate {
+		if err = m.commitGarageUpdate(ctx, actor, garage, &plan.merged, plan.fields); err != nil {
+			return
+		}
+	}
+	for i, step := range plan.sections {
+		change := &plan.changes[i+1]
+		switch {
+		case step.index < 0:
+			section := *step.input
+			if section.ID == "" {
+				section.ID = m.importSectionID(plan.input)
+			}
+			if err = m.insertSection(ctx, actor, garage, &section); err != nil {
+				return
+			}
+			change.SectionID = section.ID
+		case change.Action == importUpdate:
+			merged := step.merged
+			_, e, c, commitErr := m.commitSectionUpdate(ctx, actor, garage, step.index, &merged, plan.sectionFields)
+			ended, changes = append(ended, e...), append(changes, c...)
+			if err = commitErr; err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// importSectionID returns a new section ID which is not used by any of the
+// imported garage's sections either
+func (m *garageManager) importSectionID(input *resources.Garage) string {
+	// NOTE: This function is *not* thread-safe
+	for {
+		id := m.uniqueSectionID()
+		taken := false
+		for _, s := range input.Sections {
+			taken = taken || s.ID == id
+		}
+		if !taken {
+			return id
+		}
+	}
+}
+
+// transferFormat returns the format requested by the format query parameter,
+// or by the given header
+func transferFormat(r *http.Request, header string) string {
+	if format := r.URL.Query().Get(api.QueryFormat); format != "" {
+		return format
+	}
+	if strings.Contains(r.Header.Get(header), "text/csv") {
+		return api.FormatCSV
+	}
+	return api.FormatJSON
+}
+
+func garagesToCSV(garages []resources.Garage) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	w.Write(csvColumns)
+
+	for _, g := range garages {
+		row := []string{
+			g.ID,
+			g.Name,
+			g.City,
+			g.Address,
+			strconv.FormatFloat(g.Geolocation.Longitude, 'f', -1, 64),
+			strconv.FormatFloat(g.Geolocation.Latitude, 'f', -1, 64),
+		}
+
+		// A garage without sections still takes a row
+		if len(g.Sections) == 0 {
+			w.Write(append(row, "", "", "", "", ""))
+		}
+		for _, s := range g.Sections {
+			w.Write(append(row[:6:6], s.ID, s.Name, s.Level, s.Description, strconv.Itoa(s.TotalSpots)))
+		}
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// garagesFromCSV reads garages from rows with the columns of csvColumns, in
+// any order and with any of them left out. Rows of the same garage are
+// grouped by garage ID, or by name, city and address if the ID is missing.
+func garagesFromCSV(data []byte) ([]resources.Garage, error) {
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("CSV header missing")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		known := false
+		for _, c := range csvColumns {
+			known = known || c == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown CSV column '%s'", name)
+		}
+		columns[name] = i
+	}
+	value := func(row []string, name string) string {
+		if i, ok := columns[name]; ok {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	number := func(row []string, name string, line int) (float64, error) {
+		v := value(row, name)
+		if v == "" {
+			return 0, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: illegal value for '%s': %s", line, name, v)
+		}
+		return f, nil
+	}
+
+	garages := []resources.Garage{}
+	index := make(map[string]int)
+	for n, row := range rows[1:] {
+		line := n + 2
+
+		key := value(row, "garage_id")
+		if key == "" {
+			key = "\x00" + value(row, "garage_name") + "\x00" + value(row, "city") + "\x00" + value(row, "address")
+		}
+		i, ok := index[key]
+		if !ok {
+			g := resources.Garage{
+				ID:       value(row, "garage_id"),
+				Name:     value(row, "garage_name"),
+				City:     value(row, "city"),
+				Address:  value(row, "address"),
+				Sections: []resources.Section{},
+			}
+			if g.Geolocation.Longitude, err = number(row, "longitude", line); err != nil {
+				return nil, err
+			}
+			if g.Geolocation.Latitude, err = number(row, "latitude", line); err != nil {
+				return nil, err
+			}
+			i = len(garages)
+			index[key] = i
+			garages = append(garages, g)
+		}
+
+		if value(row, "section_id") == "" && value(row, "section_name") == "" {
+			continue
+		}
+		s := resources.Section{
+			ID:          value(row, "section_id"),
+			Name:        value(row, "section_name"),
+			Level:       value(row, "level"),
+			Description: value(row, "description"),
+		}
+		if v := value(row, "total_spots"); v != "" {
+			if s.TotalSpots, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("line %d: illegal value for 'total_spots': %s", line, v)
+			}
+		}
+		garages[i].Sections = append(garages[i].Sections, s)
+	}
+	return garages, nil
+}
+
+func (s *server) httpExport(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.getExport(w, r)
+	default:
+		errMsg := fmt.Sprintf("invalid request for resource '%s'", api.Export)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+	}
+}
+
+func (s *server) httpImport(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.postImport(w, r)
+	default:
+		errMsg := fmt.Sprintf("invalid request for resource '%s'", api.Import)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+	}
+}
+
+func (s *server) getExport(w http.ResponseWriter, r *http.Request) {
+	garages := s.garages.exportGarages()
+
+	var (
+		resp        []byte
+		err         error
+		contentType string
+	)
+	switch format := transferFormat(r, "Accept"); format {
+	case api.FormatJSON:
+		resp, err = json.Marshal(garages)
+		contentType = "application/json"
+	case api.FormatCSV:
+		resp, err = garagesToCSV(garages)
+		contentType = "text/csv"
+	default:
+		errMsg := fmt.Sprintf("unknown format '%s', use '%s' or '%s'", format, api.FormatJSON, api.FormatCSV)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(resp)
+}
+
+func (s *server) postImport(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+
+	var (
+		garages       []resources.Garage
+		fields        []string
+		sectionFields []string
+	)
+	switch format := transferFormat(r, "Content-Type"); format {
+	case api.FormatJSON:
+		err = json.Unmarshal(body, &garages)
+	case api.FormatCSV:
+		garages, err = garagesFromCSV(body)
+		fields = csvGarageProperties
+		sectionFields = csvSectionProperties
+	default:
+		errMsg := fmt.Sprintf("unknown format '%s', use '%s' or '%s'", format, api.FormatJSON, api.FormatCSV)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+	if err != nil {
+		errMsg := "failed to read garages: " + err.Error()
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+
+	query := r.URL.Query()
+	dryRun := query.Get(api.QueryDryRun) == "true"
+	force := query.Get(api.QueryForce) == "true"
+	report, err := s.garages.importGarages(requestActor(r), garages, fields, sectionFields, dryRun, force)
+	if err != nil {
+		err = errors.New("DB error: failed to import garages: " + err.Error())
+		httpInternalError(w, r, err)
+		return
+	}
+
+	resp, err := json.Marshal(report)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !dryRun && !report.Applied {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	w.Write(resp)
+}
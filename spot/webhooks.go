@@ -0,0 +1,546 @@
+package spot
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cicovic-andrija/spot/api"
+	"github.com/cicovic-andrija/spot/db"
+	"github.com/cicovic-andrija/spot/log"
+	"github.com/cicovic-andrija/spot/resources"
+	"github.com/cicovic-andrija/spot/util"
+	"github.com/gorilla/mux"
+)
+
+// Webhook event types
+const (
+	// eventSectionFull happens when the last free spot of a section is taken
+	eventSectionFull = "section_full"
+	// eventBelowThreshold happens when the number of free spots of a section
+	// drops below the threshold of the webhook
+	eventBelowThreshold = "below_threshold"
+	// eventSpotsOffline happens when at least the minimum number of spots of
+	// the webhook go offline at once, by disconnecting or timing out
+	eventSpotsOffline = "spots_offline"
+)
+
+var eventTypes = []string{eventSectionFull, eventBelowThreshold, eventSpotsOffline}
+
+const (
+	webhookMaxAttempts = 10
+	webhookBackoff     = 10 * time.Second
+	webhookMaxBackoff  = time.Hour
+	webhookBatch       = 100
+
+	// Deliveries are signed with HMAC-SHA256 of the body, keyed with the
+	// secret of the webhook
+	webhookSignatureHeader = "X-Spot-Signature"
+	webhookEventHeader     = "X-Spot-Event"
+	webhookDeliveryHeader  = "X-Spot-Delivery"
+)
+
+type webhookManager struct {
+	db     *db.Client
+	rw     *sync.RWMutex
+	hooks  map[string]*resources.Webhook
+	client *http.Client
+	wake   chan struct{}
+}
+
+func newWebhookManager(db *db.Client) (*webhookManager, error) {
+	var err error
+
+	wm := &webhookManager{
+		db:     db,
+		rw:     &sync.RWMutex{},
+		client: &http.Client{Timeout: 10 * time.Second},
+		wake:   make(chan struct{}, 1),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wm.hooks, err = db.FindAllWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return wm, nil
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookRetryDelay returns the time to wait before the next attempt of a
+// delivery which failed the given number of times
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookBackoff
+	for i := 1; i < attempts && delay < webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxBackoff {
+		delay = webhookMaxBackoff
+	}
+	return delay
+}
+
+func validWebhook(hook *resources.Webhook) error {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("webhook URL must be an absolute http or https URL")
+	}
+
+	for _, e := range hook.Events {
+		valid := false
+		for _, t := range eventTypes {
+			valid = valid || e == t
+		}
+		if !valid {
+			return fmt.Errorf("unknown event type '%s', use one of %v", e, eventTypes)
+		}
+		if e == eventBelowThreshold && hook.Threshold < 1 {
+			return fmt.Errorf("'%s' events require a positive threshold", eventBelowThreshold)
+		}
+	}
+
+	if hook.SectionID != "" && hook.GarageID == "" {
+		return errors.New("a section can only be selected together with its garage")
+	}
+	if hook.Threshold < 0 || hook.MinOffline < 0 {
+		return errors.New("thresholds must not be negative")
+	}
+	return nil
+}
+
+// occupancyChange is a change of the free or online spots of a section made
+// at once, by a single request or check
+type occupancyChange struct {
+	garageID    string
+	garageName  string
+	sectionID   string
+	sectionName string
+	totalSpots  int
+	freeBefore  int
+	freeAfter   int
+	offline     int
+	timestamp   time.Time
+}
+
+// newOccupancyChange describes the change of a section which had freeBefore
+// free spots, and of which offline spots went offline, and reports whether
+// there was a change at all
+func newOccupancyChange(garage *resources.Garage, section *resources.Section, freeBefore int, offline int, now time.Time) (occupancyChange, bool) {
+	// NOTE: This function is *not* thread-safe
+	return occupancyChange{
+		garageID:    garage.ID,
+		garageName:  garage.Name,
+		sectionID:   section.ID,
+		sectionName: section.Name,
+		totalSpots:  section.TotalSpots,
+		freeBefore:  freeBefore,
+		freeAfter:   section.FreeSpots,
+		offline:     offline,
+		timestamp:   now,
+	}, freeBefore != section.FreeSpots || offline > 0
+}
+
+// events returns the events of the change the webhook is subscribed to
+func (c *occupancyChange) events(hook *resources.Webhook) []resources.WebhookEvent {
+	if (hook.GarageID != "" && hook.GarageID != c.garageID) ||
+		(hook.SectionID != "" && hook.SectionID != c.sectionID) {
+		return nil
+	}
+
+	subscribed := func(eventType string) bool {
+		if len(hook.Events) == 0 {
+			return true
+		}
+		for _, e := range hook.Events {
+			if e == eventType {
+				return true
+			}
+		}
+		return false
+	}
+
+	event := resources.WebhookEvent{
+		Timestamp:   c.timestamp,
+		GarageID:    c.garageID,
+		GarageName:  c.garageName,
+		SectionID:   c.sectionID,
+		SectionName: c.sectionName,
+		TotalSpots:  c.totalSpots,
+		FreeSpots:   c.freeAfter,
+	}
+
+	events := []resources.WebhookEvent{}
+	if subscribed(eventSectionFull) && c.freeBefore > 0 && c.freeAfter == 0 {
+		e := event
+		e.Type = eventSectionFull
+		events = append(events, e)
+	}
+	if subscribed(eventBelowThreshold) && hook.Threshold > 0 &&
+		c.freeBefore >= hook.Threshold && c.freeAfter < hook.Threshold {
+		e := event
+		e.Type = eventBelowThreshold
+		e.Threshold = hook.Threshold
+		events = append(events, e)
+	}
+	if subscribed(eventSpotsOffline) && c.offline > 0 && c.offline >= hook.MinOffline {
+		e := event
+		e.Type = eventSpotsOffline
+		e.OfflineSpots = c.offline
+		events = append(events, e)
+	}
+	return events
+}
+
+// notify queues the events of the changes for delivery to the webhooks
+// subscribed to them. Failing to queue them is reported but not returned, as
+// the changes have already been made.
+func (w *webhookManager) notify(changes []occupancyChange) {
+	if len(changes) == 0 {
+		return
+	}
+
+	now := time.Now()
+	deliveries := []*resources.WebhookDelivery{}
+	w.rw.RLock()
+	for i := range changes {
+		for _, hook := range w.hooks {
+			for _, event := range changes[i].events(hook) {
+				id, err := randomHex(8)
+				if err != nil {
+					log.Errorf("Failed to obtain a webhook delivery ID: %v", err)
+					continue
+				}
+				event.ID = id
+				deliveries = append(deliveries, &resources.WebhookDelivery{
+					ID:          id,
+					WebhookID:   hook.ID,
+					Event:       event,
+					NextAttempt: now,
+				})
+			}
+		}
+	}
+	w.rw.RUnlock()
+
+	if len(deliveries) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, d := range deliveries {
+		if err := w.db.InsertDelivery(ctx, d); err != nil {
+			log.Errorf(
+				"DB: failed to queue '%s' event of section id %s, garage id %s for webhook id %s: %v",
+				d.Event.Type,
+				d.Event.SectionID,
+				d.Event.GarageID,
+				d.WebhookID,
+				err,
+			)
+		}
+	}
+
+	// Wake the delivery runner, unless it has already been woken
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverDue attempts the deliveries which are due, and reschedules the ones
+// which fail until they run out of attempts
+func (w *webhookManager) deliverDue() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		deliveries, err := w.db.FindDueDeliveries(ctx, time.Now(), webhookBatch)
+		cancel()
+		if err != nil {
+			log.Errorf("DB: failed to get queued webhook deliveries: %v", err)
+			return
+		}
+
+		for i := range deliveries {
+			w.attempt(&deliveries[i])
+		}
+		if len(deliveries) < webhookBatch {
+			return
+		}
+	}
+}
+
+func (w *webhookManager) attempt(d *resources.WebhookDelivery) {
+	w.rw.RLock()
+	hook, found := w.hooks[d.WebhookID]
+	w.rw.RUnlock()
+
+	var err error
+	if found {
+		err = w.send(hook, d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	d.Attempts++
+	if err == nil || d.Attempts >= webhookMaxAttempts {
+		if err != nil {
+			log.Errorf(
+				"Webhook: dropping '%s' event %s for webhook id %s after %d attempts: %v",
+				d.Event.Type,
+				d.Event.ID,
+				d.WebhookID,
+				d.Attempts,
+				err,
+			)
+		}
+		err = w.db.DeleteDelivery(ctx, d.ID)
+	} else {
+		d.NextAttempt = time.Now().Add(webhookRetryDelay(d.Attempts))
+		d.LastError = err.Error()
+		err = w.db.RescheduleDelivery(ctx, d)
+	}
+	if err != nil {
+		log.Errorf("DB: failed to update queued webhook delivery %s: %v", d.ID, err)
+	}
+}
+
+func (w *webhookManager) send(hook *resources.Webhook, d *resources.WebhookDelivery) error {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.Event.Type)
+	req.Header.Set(webhookDeliveryHeader, d.ID)
+	req.Header.Set(webhookSignatureHeader, webhookSignature(hook.Secret, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *webhookManager) getWebhooks() []resources.Webhook {
+	w.rw.RLock()
+	defer w.rw.RUnlock()
+
+	respArray := []resources.Webhook{}
+	for _, hook := range w.hooks {
+		respObj := *hook
+		respObj.Secret = ""
+		respArray = append(respArray, respObj)
+	}
+	sort.Slice(respArray, func(i, j int) bool { return respArray[i].CreatedAt.Before(respArray[j].CreatedAt) })
+	return respArray
+}
+
+func (w *webhookManager) getWebhook(id string) (respObj resources.Webhook, found bool) {
+	w.rw.RLock()
+	defer w.rw.RUnlock()
+
+	hook, found := w.hooks[id]
+	if !found {
+		return
+	}
+	respObj = *hook
+	respObj.Secret = ""
+	return
+}
+
+// addWebhook subscribes the webhook, with a generated secret unless one is
+// given
+func (w *webhookManager) addWebhook(hook *resources.Webhook) error {
+	w.rw.Lock()
+	defer w.rw.Unlock()
+
+	var err error
+	for hook.ID == "" || w.hooks[hook.ID] != nil {
+		if hook.ID, err = util.NewRandomID(); err != nil {
+			return err
+		}
+	}
+	if hook.Secret == "" {
+		if hook.Secret, err = randomHex(32); err != nil {
+			return err
+		}
+	}
+	if hook.Events == nil {
+		hook.Events = []string{}
+	}
+	hook.CreatedAt = time.Now().UTC()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = w.db.InsertWebhook(ctx, hook); err != nil {
+		return err
+	}
+
+	w.hooks[hook.ID] = hook
+	return nil
+}
+
+func (w *webhookManager) removeWebhook(id string) (found bool, err error) {
+	w.rw.Lock()
+	defer w.rw.Unlock()
+
+	if _, found = w.hooks[id]; !found {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = w.db.DeleteWebhook(ctx, id); err != nil {
+		return
+	}
+
+	delete(w.hooks, id)
+	return
+}
+
+func (s *server) httpWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.getWebhooks(w, r)
+	case http.MethodPost:
+		s.postWebhooks(w, r)
+	default:
+		errMsg := fmt.Sprintf("invalid request for resource '%s'", api.CollectionWebhooks)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+	}
+}
+
+func (s *server) httpWebhook(w http.ResponseWriter, r *http.Request) {
+	urlVars := mux.Vars(r)
+	id := urlVars["webhook-id"]
+	switch r.Method {
+	case http.MethodGet:
+		s.getWebhook(w, r, id)
+	case http.MethodDelete:
+		s.deleteWebhook(w, r, id)
+	default:
+		errMsg := fmt.Sprintf("invalid request for resource '%s/%s'", api.CollectionWebhooks, id)
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+	}
+}
+
+func (s *server) getWebhooks(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.Marshal(s.webhooks.getWebhooks())
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+func (s *server) postWebhooks(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+
+	hook := &resources.Webhook{}
+	err = json.Unmarshal(body, hook)
+	if err != nil {
+		errMsg := "failed to unmarshal JSON object: " + err.Error()
+		httpErrorResp(w, r, http.StatusBadRequest, errMsg)
+		return
+	}
+	hook.ID = ""
+
+	if err = validWebhook(hook); err != nil {
+		httpErrorResp(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = s.webhooks.addWebhook(hook)
+	if err != nil {
+		err = errors.New("DB error: failed to insert webhook: " + err.Error())
+		httpInternalError(w, r, err)
+		return
+	}
+
+	// The secret is only ever returned here
+	resp, err := json.Marshal(hook)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resp)
+}
+
+func (s *server) getWebhook(w http.ResponseWriter, r *http.Request, id string) {
+	respObj, found := s.webhooks.getWebhook(id)
+	if !found {
+		errMsg := fmt.Sprintf("resource '%s/%s' not found", api.CollectionWebhooks, id)
+		httpErrorResp(w, r, http.StatusNotFound, errMsg)
+		return
+	}
+
+	resp, err := json.Marshal(respObj)
+	if err != nil {
+		httpInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+func (s *server) deleteWebhook(w http.ResponseWriter, r *http.Request, id string) {
+	found, err := s.webhooks.removeWebhook(id)
+	if !found {
+		errMsg := fmt.Sprintf("resource '%s/%s' not found", api.CollectionWebhooks, id)
+		httpErrorResp(w, r, http.StatusNotFound, errMsg)
+		return
+	}
+	if err != nil {
+		err = errors.New("DB error: failed to delete webhook: " + err.Error())
+		httpInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,12 +2,17 @@ package spot_test
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/cicovic-andrija/spot/resources"
 )
@@ -61,6 +66,37 @@ func CreateGarage(client *http.Client, garageName string, expectedStatus int) (*
 	return respObj, nil
 }
 
+func GetGarages(client *http.Client, query string, expectedStatus int) ([]resources.GarageRespObj, error) {
+	url := testBaseURL + path.Join("v1", "garages") + query
+	req, err := http.NewRequest(http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected GET status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	respArray := []resources.GarageRespObj{}
+	err = json.Unmarshal(respBody, &respArray)
+	if err != nil {
+		return nil, err
+	}
+
+	return respArray, nil
+}
+
 func GetGarage(client *http.Client, garageID string, expectedStatus int) (*resources.GarageRespObj, error) {
 	url := testBaseURL + path.Join("v1", "garages", garageID)
 	req, err := http.NewRequest(http.MethodGet, url, http.NoBody)
@@ -78,12 +114,51 @@ func GetGarage(client *http.Client, garageID string, expectedStatus int) (*resou
 		return nil, fmt.Errorf("Unexpected GET status: %d. Expected: %d", resp.StatusCode, expectedStatus)
 	}
 
+	respObj := &resources.GarageRespObj{}
+	if resp.StatusCode != http.StatusOK {
+		return respObj, nil
+	}
+
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
+	err = json.Unmarshal(respBody, respObj)
+	if err != nil {
+		return nil, err
+	}
+
+	return respObj, nil
+}
+
+func UpdateGarage(client *http.Client, method string, garageID string, body string, expectedStatus int) (*resources.GarageRespObj, error) {
+	url := testBaseURL + path.Join("v1", "garages", garageID)
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected %s status: %d. Expected: %d", method, resp.StatusCode, expectedStatus)
+	}
+
 	respObj := &resources.GarageRespObj{}
+	if resp.StatusCode != http.StatusOK {
+		return respObj, nil
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
 	err = json.Unmarshal(respBody, respObj)
 	if err != nil {
 		return nil, err
@@ -112,6 +187,34 @@ func DeleteGarage(client *http.Client, garageID string, expectedStatus int) erro
 	return nil
 }
 
+func ConditionalGarageRequest(client *http.Client, method string, garageID string, header string, tag string, body interface{}, expectedStatus int) (string, error) {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	url := testBaseURL + path.Join("v1", "garages", garageID)
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return "", err
+	}
+	if header != "" {
+		req.Header.Set(header, tag)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return "", fmt.Errorf("Unexpected %s status: %d. Expected: %d", method, resp.StatusCode, expectedStatus)
+	}
+
+	return resp.Header.Get("ETag"), nil
+}
+
 func CreateSection(client *http.Client, garageID string, sectionName string, totalSpots int, expectedStatus int) (*resources.SectionRespObj, error) {
 	section := struct {
 		Name       string `json:"name"`
@@ -142,12 +245,16 @@ func CreateSection(client *http.Client, garageID string, sectionName string, tot
 		return nil, fmt.Errorf("Unexpected POST status: %d. Expected: %d", resp.StatusCode, expectedStatus)
 	}
 
+	respObj := &resources.SectionRespObj{}
+	if resp.StatusCode != http.StatusCreated {
+		return respObj, nil
+	}
+
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	respObj := &resources.SectionRespObj{}
 	err = json.Unmarshal(respBody, respObj)
 	if err != nil {
 		return nil, err
@@ -204,12 +311,16 @@ func GetSection(client *http.Client, garageID string, sectionName string, expect
 		return nil, fmt.Errorf("Unexpected GET status: %d. Expected: %d", resp.StatusCode, expectedStatus)
 	}
 
+	respObj := &resources.SectionRespObj{}
+	if resp.StatusCode != http.StatusOK {
+		return respObj, nil
+	}
+
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	respObj := &resources.SectionRespObj{}
 	err = json.Unmarshal(respBody, &respObj)
 	if err != nil {
 		return nil, err
@@ -218,6 +329,136 @@ func GetSection(client *http.Client, garageID string, sectionName string, expect
 	return respObj, nil
 }
 
+func ResizeSection(client *http.Client, garageID string, sectionName string, totalSpots int, force bool, expectedStatus int) (*resources.SectionRespObj, error) {
+	section := struct {
+		TotalSpots int `json:"total_spots"`
+	}{
+		TotalSpots: totalSpots,
+	}
+
+	reqBody, err := json.Marshal(section)
+	if err != nil {
+		return nil, err
+	}
+
+	url := testBaseURL + path.Join("v1", "garages", garageID, "sections", sectionName)
+	if force {
+		url += "?force=true"
+	}
+	req, err := http.NewRequest(http.MethodPatch, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected PATCH status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	respObj := &resources.SectionRespObj{}
+	if resp.StatusCode != http.StatusOK {
+		return respObj, nil
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(respBody, respObj)
+	if err != nil {
+		return nil, err
+	}
+
+	return respObj, nil
+}
+
+func RenameSection(client *http.Client, garageID string, sectionName string, newName string, expectedStatus int) (*resources.SectionRespObj, error) {
+	section := struct {
+		Name string `json:"name"`
+	}{
+		Name: newName,
+	}
+
+	reqBody, err := json.Marshal(section)
+	if err != nil {
+		return nil, err
+	}
+
+	url := testBaseURL + path.Join("v1", "garages", garageID, "sections", sectionName)
+	req, err := http.NewRequest(http.MethodPatch, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected PATCH status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	respObj := &resources.SectionRespObj{}
+	if resp.StatusCode != http.StatusOK {
+		return respObj, nil
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(respBody, respObj)
+	if err != nil {
+		return nil, err
+	}
+
+	return respObj, nil
+}
+
+func UpdateSection(client *http.Client, method string, garageID string, sectionName string, body string, expectedStatus int) (*resources.SectionRespObj, error) {
+	url := testBaseURL + path.Join("v1", "garages", garageID, "sections", sectionName)
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected %s status: %d. Expected: %d", method, resp.StatusCode, expectedStatus)
+	}
+
+	respObj := &resources.SectionRespObj{}
+	if resp.StatusCode != http.StatusOK {
+		return respObj, nil
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(respBody, respObj)
+	if err != nil {
+		return nil, err
+	}
+
+	return respObj, nil
+}
+
 func DeleteSection(client *http.Client, garageID string, sectionName string, expectedStatus int) error {
 	url := testBaseURL + path.Join("v1", "garages", garageID, "sections", sectionName)
 	req, err := http.NewRequest(http.MethodDelete, url, http.NoBody)
@@ -276,6 +517,54 @@ func UpdateStatus(client *http.Client, garageID string, sectionName string, spot
 	return nil
 }
 
+func UpdateStatusObserved(client *http.Client, garageID string, sectionName string, spotNumber int, isTaken bool, observedAt time.Time, sequence uint64, expectedStatus int) (*resources.UpdateResult, error) {
+	type param struct {
+		Number     int       `json:"number"`
+		Taken      bool      `json:"taken"`
+		ObservedAt time.Time `json:"observed_at"`
+		Sequence   uint64    `json:"sequence,omitempty"`
+	}
+
+	actionMsg := struct {
+		Action string  `json:"action"`
+		Params []param `json:"params"`
+	}{
+		Action: "update",
+		Params: []param{param{Number: spotNumber, Taken: isTaken, ObservedAt: observedAt, Sequence: sequence}},
+	}
+
+	reqBody, err := json.Marshal(actionMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	url := testBaseURL + path.Join("v1", "garages", garageID, "sections", sectionName, "actions")
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected POST status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	respObj := &resources.UpdateRespObj{}
+	if err = json.NewDecoder(resp.Body).Decode(respObj); err != nil {
+		return nil, err
+	}
+	if len(respObj.Results) != 1 {
+		return nil, fmt.Errorf("Unexpected number of results: %d. Expected: 1", len(respObj.Results))
+	}
+
+	return &respObj.Results[0], nil
+}
+
 func Disconnect(client *http.Client, garageID string, sectionName string, spotNumber int, expectedStatus int) error {
 	type param struct {
 		Number int `json:"number"`
@@ -313,117 +602,1736 @@ func Disconnect(client *http.Client, garageID string, sectionName string, spotNu
 	return nil
 }
 
-func TestCreateGarage(t *testing.T) {
-	c := &http.Client{}
+func ReportSensorFault(client *http.Client, garageID string, sectionName string, spotNumber int, expectedStatus int) error {
+	type param struct {
+		Number int  `json:"number"`
+		Fault  bool `json:"fault"`
+	}
 
-	postRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
-	if err != nil {
-		t.Error(err)
+	actionMsg := struct {
+		Action string  `json:"action"`
+		Params []param `json:"params"`
+	}{
+		Action: "update",
+		Params: []param{param{Number: spotNumber, Fault: true}},
 	}
 
-	_, err = GetGarage(c, postRespObj.ID, http.StatusOK)
+	reqBody, err := json.Marshal(actionMsg)
 	if err != nil {
-		t.Error(err)
+		return err
 	}
 
-	err = DeleteGarage(c, postRespObj.ID, http.StatusNoContent)
+	url := testBaseURL + path.Join("v1", "garages", garageID, "sections", sectionName, "actions")
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(reqBody))
 	if err != nil {
-		t.Error(err)
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("Unexpected POST status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	return nil
+}
+
+func Audit(client *http.Client, expectedStatus int) ([]resources.FreeSpotsDiscrepancy, error) {
+	actionMsg := struct {
+		Action string `json:"action"`
+	}{
+		Action: "audit",
+	}
+
+	reqBody, err := json.Marshal(actionMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	url := testBaseURL + path.Join("v1", "control")
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected POST status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	respArray := make([]resources.FreeSpotsDiscrepancy, 0)
+	err = json.Unmarshal(respBody, &respArray)
+	if err != nil {
+		return nil, err
+	}
+
+	return respArray, nil
+}
+
+func GetAudit(client *http.Client, garageID string, expectedStatus int) ([]resources.AuditEntry, error) {
+	url := testBaseURL + path.Join("v1", "audit") + "?garage_id=" + garageID
+	req, err := http.NewRequest(http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected GET status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	respArray := make([]resources.AuditEntry, 0)
+	err = json.Unmarshal(respBody, &respArray)
+	if err != nil {
+		return nil, err
+	}
+
+	return respArray, nil
+}
+
+func Restore(client *http.Client, resourcePath string, expectedStatus int) error {
+	url := testBaseURL + path.Join("v1", resourcePath, "restore")
+	req, err := http.NewRequest(http.MethodPost, url, http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("Unexpected POST status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	return nil
+}
+
+func HardDelete(client *http.Client, resourcePath string, expectedStatus int) error {
+	url := testBaseURL + path.Join("v1", resourcePath) + "?hard=true"
+	req, err := http.NewRequest(http.MethodDelete, url, http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("Unexpected DELETE status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	return nil
+}
+
+func Import(client *http.Client, body string, query string, expectedStatus int) (*resources.ImportReport, error) {
+	url := testBaseURL + path.Join("v1", "import") + query
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected POST status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &resources.ImportReport{}
+	err = json.Unmarshal(respBody, report)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func Export(client *http.Client, format string, expectedStatus int) (string, error) {
+	url := testBaseURL + path.Join("v1", "export") + "?format=" + format
+	req, err := http.NewRequest(http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return "", fmt.Errorf("Unexpected GET status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(respBody), nil
+}
+
+func GetQuote(client *http.Client, garageID string, query string, expectedStatus int) (*resources.QuoteRespObj, error) {
+	url := testBaseURL + path.Join("v1", "garages", garageID, "quote") + query
+	req, err := http.NewRequest(http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected GET status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	respObj := &resources.QuoteRespObj{}
+	if resp.StatusCode != http.StatusOK {
+		return respObj, nil
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(respBody, respObj)
+	if err != nil {
+		return nil, err
+	}
+
+	return respObj, nil
+}
+
+func GetSessions(client *http.Client, garageID string, expectedStatus int) ([]resources.Session, error) {
+	url := testBaseURL + path.Join("v1", "garages", garageID, "sessions")
+	req, err := http.NewRequest(http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected GET status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	respArray := []resources.Session{}
+	err = json.Unmarshal(respBody, &respArray)
+	if err != nil {
+		return nil, err
+	}
+
+	return respArray, nil
+}
+
+func CreateWebhook(client *http.Client, body string, expectedStatus int) (*resources.Webhook, error) {
+	url := testBaseURL + path.Join("v1", "webhooks")
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected POST status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	respObj := &resources.Webhook{}
+	err = json.Unmarshal(respBody, respObj)
+	if err != nil {
+		return nil, err
+	}
+
+	return respObj, nil
+}
+
+func DeleteWebhook(client *http.Client, id string, expectedStatus int) error {
+	url := testBaseURL + path.Join("v1", "webhooks", id)
+	req, err := http.NewRequest(http.MethodDelete, url, http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("Unexpected DELETE status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	return nil
+}
+
+func GetOfflineSpots(client *http.Client, garageID string, expectedStatus int) ([]resources.OfflineSpot, error) {
+	url := testBaseURL + path.Join("v1", "devices", "offline") + "?garage_id=" + garageID
+	req, err := http.NewRequest(http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected GET status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	respArray := []resources.OfflineSpot{}
+	err = json.Unmarshal(respBody, &respArray)
+	if err != nil {
+		return nil, err
+	}
+
+	return respArray, nil
+}
+
+func PutDeviceConfig(client *http.Client, id string, body string, expectedStatus int) error {
+	url := testBaseURL + path.Join("v1", "devices", id, "config")
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("Unexpected PUT status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	return nil
+}
+
+func GetDeviceConfig(client *http.Client, id string, tag string, expectedStatus int) (*resources.DeviceConfig, string, error) {
+	url := testBaseURL + path.Join("v1", "devices", id, "config")
+	req, err := http.NewRequest(http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, "", err
+	}
+	if tag != "" {
+		req.Header.Set("If-None-Match", tag)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, "", fmt.Errorf("Unexpected GET status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", nil
+	}
+
+	respObj := &resources.DeviceConfig{}
+	err = json.NewDecoder(resp.Body).Decode(respObj)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return respObj, resp.Header.Get("ETag"), nil
+}
+
+func DeleteDeviceConfig(client *http.Client, id string, expectedStatus int) error {
+	url := testBaseURL + path.Join("v1", "devices", id, "config")
+	req, err := http.NewRequest(http.MethodDelete, url, http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("Unexpected DELETE status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	return nil
+}
+
+func CreateProvisioningToken(client *http.Client, garageID string, section string, expectedStatus int) (*resources.ProvisioningToken, error) {
+	reqBody, err := json.Marshal(resources.ProvisioningToken{GarageID: garageID, Section: section})
+	if err != nil {
+		return nil, err
+	}
+
+	url := testBaseURL + path.Join("v1", "devices", "tokens")
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected POST status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+	if expectedStatus != http.StatusCreated {
+		return nil, nil
+	}
+
+	respObj := &resources.ProvisioningToken{}
+	if err = json.NewDecoder(resp.Body).Decode(respObj); err != nil {
+		return nil, err
+	}
+	return respObj, nil
+}
+
+func RegisterDevice(client *http.Client, id string, token string, secret string, spots int, expectedStatus int) (*resources.DeviceRegistration, error) {
+	reqBody, err := json.Marshal(resources.RegistrationReq{Token: token, Secret: secret, Spots: spots})
+	if err != nil {
+		return nil, err
+	}
+
+	url := testBaseURL + path.Join("v1", "devices", id, "registration")
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("Unexpected POST status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+	if expectedStatus != http.StatusOK && expectedStatus != http.StatusCreated {
+		return nil, nil
+	}
+
+	respObj := &resources.DeviceRegistration{}
+	if err = json.NewDecoder(resp.Body).Decode(respObj); err != nil {
+		return nil, err
+	}
+	return respObj, nil
+}
+
+func DeleteRegistration(client *http.Client, id string, expectedStatus int) error {
+	url := testBaseURL + path.Join("v1", "devices", id, "registration")
+	req, err := http.NewRequest(http.MethodDelete, url, http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("Unexpected DELETE status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	return nil
+}
+
+func UpdateStatusAs(client *http.Client, deviceID string, secret string, garageID string, sectionName string, spotNumber int, isTaken bool, expectedStatus int) error {
+	reqBody := fmt.Sprintf(`{"action": "update", "params": [{"number": %d, "taken": %t}]}`, spotNumber, isTaken)
+	url := testBaseURL + path.Join("v1", "garages", garageID, "sections", sectionName, "actions")
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(reqBody))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(deviceID, secret)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("Unexpected POST status: %d. Expected: %d", resp.StatusCode, expectedStatus)
+	}
+
+	return nil
+}
+
+func TestCreateGarage(t *testing.T) {
+	c := &http.Client{}
+
+	postRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = GetGarage(c, postRespObj.ID, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = DeleteGarage(c, postRespObj.ID, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateSection(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = CreateSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	sections, err := GetSections(c, garageRespObj.ID, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len := len(sections); len != 1 {
+		t.Errorf("Just one section expected. Found %d", len)
+	} else if sections[0].Name != testSectionName {
+		t.Errorf("Unexpected section name: %s. Expected: %s", sections[0].Name, testSectionName)
+	} else if sections[0].TotalSpots != testSectionTotalSpots {
+		t.Errorf("Unexpected section's total spot number: %d. Expected: %d", sections[0].TotalSpots, testSectionTotalSpots)
+	} else if sections[0].FreeSpots != 0 {
+		t.Errorf("Unexpected section's free spot number: %d. Expected: 0", sections[0].FreeSpots)
+	}
+
+	err = DeleteSection(c, garageRespObj.ID, testSectionName, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = DeleteGarage(c, garageRespObj.ID, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateSpots(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = CreateSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Updating all spots to status FREE")
+	for i := 1; i <= testSectionTotalSpots; i++ {
+		err = UpdateStatus(c, garageRespObj.ID, testSectionName, i, false, http.StatusOK)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	sectionRespObj, err := GetSection(c, garageRespObj.ID, testSectionName, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if sectionRespObj.FreeSpots != testSectionTotalSpots {
+		t.Errorf("Unexpected section's free spot number: %d. Expected: %d", sectionRespObj.FreeSpots, testSectionTotalSpots)
+	} else {
+		t.Logf("Expected free spot number: %d. Found: %d", testSectionTotalSpots, sectionRespObj.FreeSpots)
+	}
+
+	t.Log("Disconnecting all spots")
+	for i := 1; i <= testSectionTotalSpots; i++ {
+		err = Disconnect(c, garageRespObj.ID, testSectionName, i, http.StatusOK)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	sectionRespObj, err = GetSection(c, garageRespObj.ID, testSectionName, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if sectionRespObj.FreeSpots != 0 {
+		t.Errorf("Unexpected section's free spot number: %d. Expected: 0", sectionRespObj.FreeSpots)
+	} else {
+		t.Logf("Expected free spot number: 0. Found: %d", sectionRespObj.FreeSpots)
+	}
+
+	err = DeleteSection(c, garageRespObj.ID, testSectionName, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = DeleteGarage(c, garageRespObj.ID, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRepeatedUpdates(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = CreateSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Updating spot #1 to status FREE three times")
+	for i := 0; i < 3; i++ {
+		err = UpdateStatus(c, garageRespObj.ID, testSectionName, 1, false, http.StatusOK)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	sectionRespObj, err := GetSection(c, garageRespObj.ID, testSectionName, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if sectionRespObj.FreeSpots != 1 {
+		t.Errorf("Unexpected section's free spot number: %d. Expected: 1", sectionRespObj.FreeSpots)
+	}
+
+	discrepancies, err := Audit(c, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else {
+		for _, d := range discrepancies {
+			if d.GarageID == garageRespObj.ID {
+				t.Errorf("Unexpected discrepancy in section '%s': recorded %d, actual %d", d.SectionName, d.RecordedCount, d.ActualCount)
+			}
+		}
+	}
+
+	err = DeleteSection(c, garageRespObj.ID, testSectionName, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = DeleteGarage(c, garageRespObj.ID, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResizeSection(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = CreateSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Updating first and last spot to status FREE")
+	for _, i := range []int{1, testSectionTotalSpots} {
+		err = UpdateStatus(c, garageRespObj.ID, testSectionName, i, false, http.StatusOK)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	t.Log("Growing the section by two spots")
+	sectionRespObj, err := ResizeSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots+2, false, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if sectionRespObj.FreeSpots != 2 {
+		t.Errorf("Unexpected section's free spot number: %d. Expected: 2", sectionRespObj.FreeSpots)
+	}
+
+	t.Log("Shrinking the section over a spot in use")
+	_, err = ResizeSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots-1, false, http.StatusConflict)
+	if err != nil {
+		t.Error(err)
+	}
+
+	sectionRespObj, err = ResizeSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots-1, true, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if sectionRespObj.FreeSpots != 1 {
+		t.Errorf("Unexpected section's free spot number: %d. Expected: 1", sectionRespObj.FreeSpots)
+	} else if len := len(sectionRespObj.RemovedSpots); len != 3 {
+		t.Errorf("Unexpected number of removed spots: %d. Expected: 3", len)
+	}
+
+	err = DeleteSection(c, garageRespObj.ID, testSectionName, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = DeleteGarage(c, garageRespObj.ID, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRenameSection(t *testing.T) {
+	c := &http.Client{}
+	newName := testSectionName + "Renamed"
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	sectionRespObj, err := CreateSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+	sectionID := sectionRespObj.ID
+
+	_, err = RenameSection(c, garageRespObj.ID, testSectionName, newName, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Addressing the section by its former name and by its ID")
+	for _, name := range []string{testSectionName, sectionID} {
+		sectionRespObj, err = GetSection(c, garageRespObj.ID, name, http.StatusOK)
+		if err != nil {
+			t.Error(err)
+		} else if sectionRespObj.Name != newName || sectionRespObj.ID != sectionID {
+			t.Errorf("Unexpected section: %s (id %s). Expected: %s (id %s)", sectionRespObj.Name, sectionRespObj.ID, newName, sectionID)
+		}
+	}
+
+	err = UpdateStatus(c, garageRespObj.ID, testSectionName, 1, false, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Creating a section with the former name")
+	_, err = CreateSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots, http.StatusBadRequest)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = DeleteSection(c, garageRespObj.ID, newName, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = DeleteGarage(c, garageRespObj.ID, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	c := &http.Client{}
+	update := struct {
+		Name string `json:"name"`
+	}{
+		Name: testGarageName + "Renamed",
+	}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	tag, err := ConditionalGarageRequest(c, http.MethodGet, garageRespObj.ID, "", "", nil, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Polling an unchanged garage")
+	_, err = ConditionalGarageRequest(c, http.MethodGet, garageRespObj.ID, "If-None-Match", tag, nil, http.StatusNotModified)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Updating the garage twice with the same ETag")
+	_, err = ConditionalGarageRequest(c, http.MethodPut, garageRespObj.ID, "If-Match", tag, update, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = ConditionalGarageRequest(c, http.MethodPut, garageRespObj.ID, "If-Match", tag, update, http.StatusPreconditionFailed)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ConditionalGarageRequest(c, http.MethodDelete, garageRespObj.ID, "If-Match", tag, nil, http.StatusPreconditionFailed)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = DeleteGarage(c, garageRespObj.ID, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPatchGarage(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Patching city and address")
+	respObj, err := UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `{"city": "Belgrade", "address": "Bulevar 73"}`, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if respObj.Name != testGarageName || respObj.City != "Belgrade" || respObj.Address != "Bulevar 73" {
+		t.Errorf("Unexpected garage: %+v", respObj)
+	}
+
+	t.Log("Clearing address with null")
+	respObj, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `{"address": null}`, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if respObj.City != "Belgrade" || respObj.Address != "" {
+		t.Errorf("Unexpected garage: %+v", respObj)
+	}
+
+	t.Log("Replacing the garage")
+	respObj, err = UpdateGarage(c, http.MethodPut, garageRespObj.ID, `{"name": "Replaced"}`, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if respObj.Name != "Replaced" || respObj.City != "" {
+		t.Errorf("Unexpected garage: %+v", respObj)
+	}
+
+	_, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `["not", "an", "object"]`, http.StatusBadRequest)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = DeleteGarage(c, garageRespObj.ID, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRelocateGarage(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	respObj, err := UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `{"geolocation": {"longitude": 20.4573, "latitude": 44.8125}}`, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if respObj.Geolocation.Longitude != 20.4573 || respObj.Geolocation.Latitude != 44.8125 {
+		t.Errorf("Unexpected geolocation: %+v", respObj.Geolocation)
+	}
+
+	t.Log("Patching latitude only")
+	respObj, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `{"geolocation": {"latitude": 44.8}}`, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if respObj.Geolocation.Longitude != 20.4573 || respObj.Geolocation.Latitude != 44.8 {
+		t.Errorf("Unexpected geolocation: %+v", respObj.Geolocation)
+	}
+
+	_, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `{"geolocation": {"latitude": 100}}`, http.StatusBadRequest)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = DeleteGarage(c, garageRespObj.ID, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `{"city": "Belgrade"}`, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = DeleteGarage(c, garageRespObj.ID, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+
+	entries, err := GetAudit(c, garageRespObj.ID, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if len := len(entries); len != 3 {
+		t.Errorf("Unexpected number of audit log entries: %d. Expected: 3", len)
+	} else {
+		// entries are returned newest first
+		for i, action := range []string{"garage.delete", "garage.update", "garage.create"} {
+			if entries[i].Action != action {
+				t.Errorf("Unexpected audit log action: %s. Expected: %s", entries[i].Action, action)
+			}
+		}
+		if entries[1].After["city"] != "Belgrade" {
+			t.Errorf("Unexpected audit log change: %v", entries[1].After)
+		}
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+	garagePath := path.Join("garages", garageRespObj.ID)
+	sectionPath := path.Join(garagePath, "sections", testSectionName)
+
+	_, err = CreateSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Deleting and restoring the section")
+	err = DeleteSection(c, garageRespObj.ID, testSectionName, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = GetSection(c, garageRespObj.ID, testSectionName, http.StatusNotFound)
+	if err != nil {
+		t.Error(err)
+	}
+	err = Restore(c, sectionPath, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = GetSection(c, garageRespObj.ID, testSectionName, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Deleting and restoring the garage")
+	err = DeleteGarage(c, garageRespObj.ID, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = GetGarage(c, garageRespObj.ID, http.StatusNotFound)
+	if err != nil {
+		t.Error(err)
+	}
+	err = Restore(c, garagePath, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	sections, err := GetSections(c, garageRespObj.ID, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if len := len(sections); len != 1 {
+		t.Errorf("Just one section expected. Found %d", len)
+	}
+
+	t.Log("Deleting the garage permanently")
+	err = HardDelete(c, garagePath, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+	err = Restore(c, garagePath, http.StatusNotFound)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = CreateSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	csv := "garage_id,garage_name,city,section_name,total_spots\n" +
+		garageRespObj.ID + "," + testGarageName + ",Belgrade," + testSectionName + ",5\n" +
+		garageRespObj.ID + "," + testGarageName + ",Belgrade,B,3\n"
+
+	t.Log("Importing the garage, dry run")
+	report, err := Import(c, csv, "?format=csv&dry_run=true", http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if len := len(report.Changes); len != 3 {
+		t.Errorf("Unexpected number of changes: %d. Expected: 3", len)
+	} else {
+		for i, action := range []string{"update", "update", "create"} {
+			if report.Changes[i].Action != action {
+				t.Errorf("Unexpected import action: %s. Expected: %s", report.Changes[i].Action, action)
+			}
+		}
+	}
+	_, err = GetSection(c, garageRespObj.ID, "B", http.StatusNotFound)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Importing an illegal section")
+	_, err = Import(c, csv+garageRespObj.ID+","+testGarageName+",Belgrade,C,0\n", "?format=csv", http.StatusBadRequest)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = GetSection(c, garageRespObj.ID, "B", http.StatusNotFound)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Importing the garage")
+	_, err = Import(c, csv, "?format=csv", http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	sectionRespObj, err := GetSection(c, garageRespObj.ID, testSectionName, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if sectionRespObj.TotalSpots != 5 {
+		t.Errorf("Unexpected total spots: %d. Expected: 5", sectionRespObj.TotalSpots)
+	}
+	_, err = GetSection(c, garageRespObj.ID, "B", http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Exporting garages")
+	export, err := Export(c, "json", http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	report, err = Import(c, export, "?dry_run=true", http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else {
+		for _, change := range report.Changes {
+			if change.Action != "unchanged" {
+				t.Errorf("Unexpected import action after export: %s. Expected: unchanged", change.Action)
+			}
+		}
+	}
+}
+
+func TestOpeningHours(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+	if !garageRespObj.Open {
+		t.Error("Garage without opening hours expected to be open")
+	}
+
+	t.Log("Closing the garage for today")
+	today := time.Now().UTC().Format("2006-01-02")
+	hours := `{"hours": {"timezone": "UTC", "weekly": [], "exceptions": [{"date": "` + today + `"}]}}`
+	garageRespObj, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, hours, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if garageRespObj.Open {
+		t.Error("Garage expected to be closed")
+	}
+
+	garages, err := GetGarages(c, "?open=true", http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, g := range garages {
+		if g.ID == garageRespObj.ID {
+			t.Error("Closed garage listed among open garages")
+		}
+	}
+
+	t.Log("Changing the time zone of the opening hours")
+	garageRespObj, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `{"hours": {"timezone": "Etc/GMT-14"}}`, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if garageRespObj.Hours == nil || garageRespObj.Hours.Timezone != "Etc/GMT-14" || len(garageRespObj.Hours.Exceptions) != 1 {
+		t.Errorf("Unexpected opening hours: %+v", garageRespObj.Hours)
+	}
+	_, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `{"hours": {"timezone": "UTC"}}`, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Setting illegal opening hours")
+	_, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `{"hours": {"timezone": "Mars/Olympus"}}`, http.StatusBadRequest)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `{"hours": {"timezone": "UTC", "weekly": [{"day": "someday", "open": "08:00", "close": "20:00"}]}}`, http.StatusBadRequest)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Removing opening hours")
+	garageRespObj, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `{"hours": null}`, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if !garageRespObj.Open {
+		t.Error("Garage without opening hours expected to be open")
+	}
+}
+
+func TestSpotTypes(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = CreateSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Assigning spot types")
+	spotTypes := `{"spot_types": [{"type": "ev", "from": 1, "to": 2}, {"type": "accessible", "from": 2, "to": 2}]}`
+	updated, err := UpdateSection(c, http.MethodPatch, garageRespObj.ID, testSectionName, spotTypes, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if len(updated.SpotTypes) != 2 || updated.FreeSpotsByType == nil {
+		t.Errorf("Unexpected updated section: %+v", updated)
+	}
+	_, err = UpdateSection(c, http.MethodPatch, garageRespObj.ID, testSectionName, `{"spot_types": [{"type": "helipad", "from": 1, "to": 1}]}`, http.StatusBadRequest)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, number := range []int{2, 3} {
+		err = UpdateStatus(c, garageRespObj.ID, testSectionName, number, false, http.StatusOK)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	sectionRespObj, err := GetSection(c, garageRespObj.ID, testSectionName, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else {
+		expected := map[string]int{"ev": 1, "accessible": 1, "standard": 1}
+		for spotType, free := range expected {
+			if sectionRespObj.FreeSpotsByType[spotType] != free {
+				t.Errorf("Unexpected free %s spots: %d. Expected: %d", spotType, sectionRespObj.FreeSpotsByType[spotType], free)
+			}
+		}
+	}
+
+	t.Log("Filtering garages by spot type")
+	for query, listed := range map[string]bool{"?type=ev&min_free=1": true, "?type=ev&min_free=2": false, "?type=motorcycle": false} {
+		garages, err := GetGarages(c, query, http.StatusOK)
+		if err != nil {
+			t.Error(err)
+		}
+		found := false
+		for _, g := range garages {
+			found = found || g.ID == garageRespObj.ID
+		}
+		if found != listed {
+			t.Errorf("Unexpected listing of the garage with %s: %v. Expected: %v", query, found, listed)
+		}
+	}
+}
+
+func TestTariff(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = GetQuote(c, garageRespObj.ID, "?arrival=2019-06-01T10:00:00Z&departure=2019-06-01T13:00:00Z", http.StatusNotFound)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Setting the tariff")
+	tariff := `{"tariff": {"currency": "EUR", "timezone": "UTC", "hourly_rate": 2, "daily_cap": 15,
+		"bands": [{"from": "22:00", "to": "06:00", "hourly_rate": 1}], "surcharges": {"ev": 1}}}`
+	garageRespObj, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, tariff, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if garageRespObj.Tariff == nil || garageRespObj.Tariff.HourlyRate != 2 {
+		t.Errorf("Unexpected tariff: %v", garageRespObj.Tariff)
+	}
+	_, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `{"tariff": {"timezone": "UTC", "hourly_rate": -1}}`, http.StatusBadRequest)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Getting quotes")
+	quotes := map[string]float64{
+		"?arrival=2019-06-01T10:00:00Z&departure=2019-06-01T13:00:00Z":         6,
+		"?arrival=2019-06-01T10:00:00Z&departure=2019-06-01T13:00:00Z&type=ev": 9,
+		"?arrival=2019-06-01T21:00:00Z&departure=2019-06-01T23:00:00Z":         3,
+		"?arrival=2019-06-01T10:00:00Z&departure=2019-06-02T12:00:00Z":         19,
+	}
+	for query, price := range quotes {
+		quote, err := GetQuote(c, garageRespObj.ID, query, http.StatusOK)
+		if err != nil {
+			t.Error(err)
+		} else if quote.Price != price {
+			t.Errorf("Unexpected price for %s: %v. Expected: %v", query, quote.Price, price)
+		}
+	}
+	_, err = GetQuote(c, garageRespObj.ID, "?arrival=2019-06-01T13:00:00Z&departure=2019-06-01T10:00:00Z", http.StatusBadRequest)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = GetQuote(c, garageRespObj.ID, "?arrival=1800-01-01T00:00:00Z&departure=2100-01-01T00:00:00Z", http.StatusBadRequest)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Changing a part of the tariff")
+	garageRespObj, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `{"tariff": {"daily_cap": 20, "surcharges": {"ev": null, "motorcycle": 0.5}}}`, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if tariff := garageRespObj.Tariff; tariff == nil || tariff.DailyCap != 20 || tariff.HourlyRate != 2 || tariff.Currency != "EUR" ||
+		len(tariff.Bands) != 1 || len(tariff.Surcharges) != 1 || tariff.Surcharges["motorcycle"] != 0.5 {
+		t.Errorf("Unexpected tariff: %+v", garageRespObj.Tariff)
 	}
 }
 
-func TestCreateSection(t *testing.T) {
+func TestSessions(t *testing.T) {
 	c := &http.Client{}
 
 	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
 	if err != nil {
 		t.Error(err)
 	}
-
+	_, err = UpdateGarage(c, http.MethodPatch, garageRespObj.ID, `{"tariff": {"currency": "EUR", "timezone": "UTC", "hourly_rate": 60}}`, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
 	_, err = CreateSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots, http.StatusCreated)
 	if err != nil {
 		t.Error(err)
 	}
 
-	sections, err := GetSections(c, garageRespObj.ID, http.StatusOK)
+	t.Log("Parking in spot #1 and leaving")
+	for _, taken := range []bool{false, true, false} {
+		err = UpdateStatus(c, garageRespObj.ID, testSectionName, 1, taken, http.StatusOK)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	t.Log("Parking in spot #2")
+	for _, taken := range []bool{false, true} {
+		err = UpdateStatus(c, garageRespObj.ID, testSectionName, 2, taken, http.StatusOK)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	sessions, err := GetSessions(c, garageRespObj.ID, http.StatusOK)
 	if err != nil {
 		t.Error(err)
+	} else if len := len(sessions); len != 2 {
+		t.Errorf("Unexpected number of sessions: %d. Expected: 2", len)
+	} else {
+		// the ongoing session comes first
+		if sessions[0].Spot != 2 || sessions[0].End != nil {
+			t.Errorf("Unexpected ongoing session: %+v", sessions[0])
+		}
+		if sessions[1].Spot != 1 || sessions[1].End == nil || sessions[1].EndReason != "freed" {
+			t.Errorf("Unexpected ended session: %+v", sessions[1])
+		}
+		// a minute started is charged in full at 60 an hour
+		if sessions[1].Fee == nil || *sessions[1].Fee != 1 {
+			t.Errorf("Unexpected session fee: %v. Expected: 1", sessions[1].Fee)
+		}
 	}
 
-	if len := len(sections); len != 1 {
-		t.Errorf("Just one section expected. Found %d", len)
-	} else if sections[0].Name != testSectionName {
-		t.Errorf("Unexpected section name: %s. Expected: %s", sections[0].Name, testSectionName)
-	} else if sections[0].TotalSpots != testSectionTotalSpots {
-		t.Errorf("Unexpected section's total spot number: %d. Expected: %d", sections[0].TotalSpots, testSectionTotalSpots)
-	} else if sections[0].FreeSpots != 0 {
-		t.Errorf("Unexpected section's free spot number: %d. Expected: 0", sections[0].FreeSpots)
+	t.Log("Disconnecting spot #2")
+	err = Disconnect(c, garageRespObj.ID, testSectionName, 2, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	sessions, err = GetSessions(c, garageRespObj.ID, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if len(sessions) != 2 || sessions[0].EndReason != "disconnected" {
+		t.Errorf("Unexpected sessions after disconnecting: %+v", sessions)
 	}
+}
 
-	err = DeleteSection(c, garageRespObj.ID, testSectionName, http.StatusNoContent)
+func TestWebhooks(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = CreateSection(c, garageRespObj.ID, testSectionName, 2, http.StatusCreated)
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = DeleteGarage(c, garageRespObj.ID, http.StatusNoContent)
+	t.Log("Creating webhooks with illegal properties")
+	for _, body := range []string{
+		`{"url": "localhost/hook"}`,
+		`{"url": "http://localhost/hook", "events": ["section_empty"]}`,
+		`{"url": "http://localhost/hook", "events": ["below_threshold"]}`,
+	} {
+		_, err = CreateWebhook(c, body, http.StatusBadRequest)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// The test server receives the events; the service must be able to
+	// reach it
+	type delivery struct {
+		event     resources.WebhookEvent
+		signature string
+		body      []byte
+	}
+	deliveries := make(chan delivery, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := delivery{signature: r.Header.Get("X-Spot-Signature")}
+		d.body, _ = ioutil.ReadAll(r.Body)
+		json.Unmarshal(d.body, &d.event)
+		deliveries <- d
+	}))
+	defer receiver.Close()
+
+	body := fmt.Sprintf(`{"url": "%s", "events": ["section_full"], "garage_id": "%s"}`, receiver.URL, garageRespObj.ID)
+	webhook, err := CreateWebhook(c, body, http.StatusCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if webhook.Secret == "" {
+		t.Error("Webhook secret not returned")
+	}
+
+	t.Log("Taking all spots")
+	for number := 1; number <= 2; number++ {
+		for _, taken := range []bool{false, true} {
+			err = UpdateStatus(c, garageRespObj.ID, testSectionName, number, taken, http.StatusOK)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	select {
+	case d := <-deliveries:
+		if d.event.Type != "section_full" || d.event.GarageID != garageRespObj.ID || d.event.FreeSpots != 0 {
+			t.Errorf("Unexpected event: %+v", d.event)
+		}
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write(d.body)
+		if expected := "sha256=" + hex.EncodeToString(mac.Sum(nil)); d.signature != expected {
+			t.Errorf("Unexpected signature: %s. Expected: %s", d.signature, expected)
+		}
+	case <-time.After(15 * time.Second):
+		t.Error("Event not delivered")
+	}
+
+	err = DeleteWebhook(c, webhook.ID, http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+	err = DeleteWebhook(c, webhook.ID, http.StatusNotFound)
 	if err != nil {
 		t.Error(err)
 	}
 }
 
-func TestUpdateSpots(t *testing.T) {
+func TestOfflineDevices(t *testing.T) {
 	c := &http.Client{}
 
 	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
 	if err != nil {
 		t.Error(err)
 	}
+	_, err = CreateSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Connecting spots #1 and #2, then disconnecting spot #2")
+	for number := 1; number <= 2; number++ {
+		err = UpdateStatus(c, garageRespObj.ID, testSectionName, number, false, http.StatusOK)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err = Disconnect(c, garageRespObj.ID, testSectionName, 2, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Spots which were never connected are not reported
+	offline, err := GetOfflineSpots(c, garageRespObj.ID, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if len := len(offline); len != 1 {
+		t.Errorf("Unexpected number of offline spots: %d. Expected: 1", len)
+	} else if o := offline[0]; o.Spot != 2 || o.Online || o.OfflineReason != "disconnected" || o.LastSeen.IsZero() || o.Flapping {
+		t.Errorf("Unexpected offline spot: %+v", o)
+	}
+
+	_, err = GetOfflineSpots(c, "ffffffff", http.StatusNotFound)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDelayedUpdates(t *testing.T) {
+	c := &http.Client{}
 
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
 	_, err = CreateSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots, http.StatusCreated)
 	if err != nil {
 		t.Error(err)
 	}
 
-	t.Log("Updating all spots to status FREE")
-	for i := 1; i <= testSectionTotalSpots; i++ {
-		err = UpdateStatus(c, garageRespObj.ID, testSectionName, i, false, http.StatusOK)
+	t.Log("Replaying queued updates of spot #1")
+	now := time.Now()
+	for _, update := range []struct {
+		taken          bool
+		observedAt     time.Time
+		sequence       uint64
+		expectedStatus int
+		expectedResult string
+	}{
+		{false, now.Add(-10 * time.Minute), 1, http.StatusOK, "applied"},
+		{true, now.Add(-8 * time.Minute), 2, http.StatusOK, "applied"},
+		// Older than the state of the spot
+		{false, now.Add(-9 * time.Minute), 3, http.StatusOK, "ignored"},
+		// A retry of an update already applied
+		{false, now.Add(-8 * time.Minute), 2, http.StatusOK, "ignored"},
+		// Observed by a device whose clock is far ahead
+		{false, now.Add(time.Hour), 4, http.StatusBadRequest, "rejected"},
+	} {
+		result, err := UpdateStatusObserved(c, garageRespObj.ID, testSectionName, 1, update.taken, update.observedAt, update.sequence, update.expectedStatus)
 		if err != nil {
 			t.Error(err)
+		} else if result.Result != update.expectedResult {
+			t.Errorf("Unexpected result: %+v. Expected: %s", result, update.expectedResult)
 		}
 	}
 
 	sectionRespObj, err := GetSection(c, garageRespObj.ID, testSectionName, http.StatusOK)
 	if err != nil {
 		t.Error(err)
-	} else if sectionRespObj.FreeSpots != testSectionTotalSpots {
-		t.Errorf("Unexpected section's free spot number: %d. Expected: %d", sectionRespObj.FreeSpots, testSectionTotalSpots)
-	} else {
-		t.Logf("Expected free spot number: %d. Found: %d", testSectionTotalSpots, sectionRespObj.FreeSpots)
+	} else if sectionRespObj.FreeSpots != 0 {
+		t.Errorf("Unexpected number of free spots: %d. Expected: 0", sectionRespObj.FreeSpots)
 	}
 
-	t.Log("Disconnecting all spots")
-	for i := 1; i <= testSectionTotalSpots; i++ {
-		err = Disconnect(c, garageRespObj.ID, testSectionName, i, http.StatusOK)
+	// The session started when the spot was taken, not when the update came
+	sessions, err := GetSessions(c, garageRespObj.ID, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if len(sessions) != 1 || sessions[0].Duration < 8*60 {
+		t.Errorf("Unexpected sessions: %+v", sessions)
+	}
+}
+
+func TestSensorFault(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = CreateSection(c, garageRespObj.ID, testSectionName, testSectionTotalSpots, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expectFreeSpots := func(expected int) {
+		sectionRespObj, err := GetSection(c, garageRespObj.ID, testSectionName, http.StatusOK)
 		if err != nil {
 			t.Error(err)
+		} else if sectionRespObj.FreeSpots != expected {
+			t.Errorf("Unexpected number of free spots: %d. Expected: %d", sectionRespObj.FreeSpots, expected)
 		}
 	}
 
-	sectionRespObj, err = GetSection(c, garageRespObj.ID, testSectionName, http.StatusOK)
+	err = UpdateStatus(c, garageRespObj.ID, testSectionName, 1, false, http.StatusOK)
 	if err != nil {
 		t.Error(err)
-	} else if sectionRespObj.FreeSpots != 0 {
-		t.Errorf("Unexpected section's free spot number: %d. Expected: 0", sectionRespObj.FreeSpots)
-	} else {
-		t.Logf("Expected free spot number: 0. Found: %d", sectionRespObj.FreeSpots)
 	}
+	expectFreeSpots(1)
 
-	err = DeleteSection(c, garageRespObj.ID, testSectionName, http.StatusNoContent)
+	t.Log("Reporting a sensor fault of spot #1")
+	err = ReportSensorFault(c, garageRespObj.ID, testSectionName, 1, http.StatusOK)
 	if err != nil {
 		t.Error(err)
 	}
+	expectFreeSpots(0)
 
-	err = DeleteGarage(c, garageRespObj.ID, http.StatusNoContent)
+	offline, err := GetOfflineSpots(c, garageRespObj.ID, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if len := len(offline); len != 1 {
+		t.Errorf("Unexpected number of offline spots: %d. Expected: 1", len)
+	} else if o := offline[0]; o.Spot != 1 || o.Online || o.OfflineReason != "sensor_fault" {
+		t.Errorf("Unexpected offline spot: %+v", o)
+	}
+
+	t.Log("Recovering the sensor of spot #1")
+	err = UpdateStatus(c, garageRespObj.ID, testSectionName, 1, false, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	expectFreeSpots(1)
+
+	offline, err = GetOfflineSpots(c, garageRespObj.ID, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if len(offline) != 0 {
+		t.Errorf("Unexpected offline spots: %+v", offline)
+	}
+}
+
+func TestDeviceConfig(t *testing.T) {
+	c := &http.Client{}
+
+	_, _, err := GetDeviceConfig(c, "test-pi", "", http.StatusNotFound)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Configuring all devices, then a single one")
+	err = PutDeviceConfig(c, "default", `{"heartbeat_interval": 600, "taken_ratio": 0.8}`, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+	err = PutDeviceConfig(c, "test-pi", `{"taken_ratio": 0.7}`, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+	err = PutDeviceConfig(c, "test-pi", `{"taken_ratio": 1.5}`, http.StatusBadRequest)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Values the device does not set are taken from the default
+	config, tag, err := GetDeviceConfig(c, "test-pi", "", http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if config.HeartbeatInterval != 600 || config.TakenRatio != 0.7 || tag == "" {
+		t.Errorf("Unexpected device configuration: %+v (ETag %s)", config, tag)
+	}
+	_, _, err = GetDeviceConfig(c, "test-pi", tag, http.StatusNotModified)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = PutDeviceConfig(c, "test-pi", `{"taken_ratio": 0.75}`, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	_, _, err = GetDeviceConfig(c, "test-pi", tag, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Removing the configurations")
+	err = DeleteDeviceConfig(c, "test-pi", http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+	config, _, err = GetDeviceConfig(c, "test-pi", "", http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if config.TakenRatio != 0.8 {
+		t.Errorf("Unexpected device configuration: %+v", config)
+	}
+	err = DeleteDeviceConfig(c, "default", http.StatusNoContent)
+	if err != nil {
+		t.Error(err)
+	}
+	_, _, err = GetDeviceConfig(c, "test-pi", "", http.StatusNotFound)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeviceRegistration(t *testing.T) {
+	c := &http.Client{}
+
+	garageRespObj, err := CreateGarage(c, testGarageName, http.StatusCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateSection(c, garageRespObj.ID, testSectionName, 3, http.StatusCreated)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = CreateProvisioningToken(c, garageRespObj.ID, "NoSuchSection", http.StatusNotFound)
+	if err != nil {
+		t.Error(err)
+	}
+	token, err := CreateProvisioningToken(c, garageRespObj.ID, testSectionName, http.StatusCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A spot with a device already online is not assigned
+	err = UpdateStatus(c, garageRespObj.ID, testSectionName, 1, false, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Registering devices")
+	_, err = RegisterDevice(c, "test-reg-1", "invalid", "", 1, http.StatusUnauthorized)
+	if err != nil {
+		t.Error(err)
+	}
+	reg, err := RegisterDevice(c, "test-reg-1", token.Token, "", 1, http.StatusCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reg.Spots) != 1 || reg.Spots[0].Number != 2 || reg.SectionName != testSectionName || reg.Secret == "" {
+		t.Errorf("Unexpected registration: %+v", reg)
+	}
+	_, err = RegisterDevice(c, "test-reg-2", token.Token, "", 2, http.StatusConflict)
+	if err != nil {
+		t.Error(err)
+	}
+
+	t.Log("Confirming the registration")
+	_, err = RegisterDevice(c, "test-reg-1", token.Token, "invalid", 1, http.StatusUnauthorized)
+	if err != nil {
+		t.Error(err)
+	}
+	confirmed, err := RegisterDevice(c, "test-reg-1", token.Token, reg.Secret, 1, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	} else if len(confirmed.Spots) != 1 || confirmed.Spots[0].Number != 2 || confirmed.Secret != "" {
+		t.Errorf("Unexpected confirmed registration: %+v", confirmed)
+	}
+
+	t.Log("Updating registered spots")
+	err = UpdateStatus(c, garageRespObj.ID, testSectionName, 2, true, http.StatusUnauthorized)
+	if err != nil {
+		t.Error(err)
+	}
+	err = UpdateStatusAs(c, "test-reg-1", reg.Secret, garageRespObj.ID, testSectionName, 2, true, http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	other, err := RegisterDevice(c, "test-reg-2", token.Token, "", 1, http.StatusCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = UpdateStatusAs(c, "test-reg-2", other.Secret, garageRespObj.ID, testSectionName, 2, false, http.StatusForbidden)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, id := range []string{"test-reg-1", "test-reg-2"} {
+		err = DeleteRegistration(c, id, http.StatusNoContent)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err = DeleteRegistration(c, "test-reg-1", http.StatusNotFound)
 	if err != nil {
 		t.Error(err)
 	}